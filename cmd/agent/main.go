@@ -8,5 +8,7 @@ import (
 func main() {
 	agent := application.NewAgent()
 	log.Println("Starting Agent...")
-	agent.Run()
+	if err := agent.Run(); err != nil {
+		log.Fatal(err)
+	}
 }
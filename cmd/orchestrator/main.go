@@ -1,14 +1,161 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"os"
+	"strconv"
 	"yandexlyceum/internal/application"
+	"yandexlyceum/internal/database"
 )
 
 func main() {
-	app := application.NewOrchestrator()
+	config := application.ConfigFromEnv()
+	if len(os.Args) > 1 {
+		if err := runCommand(config, os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	store, err := openStore(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+	app := application.NewOrchestrator(config, store)
 	log.Println("Starting Orchestrator on port", app.Config.Addr)
 	if err := app.RunServer(); err != nil {
 		log.Fatal(err)
 	}
 }
+
+// openStore подключается к базе и применяет миграции
+func openStore(config *application.Config) (*database.SQLStore, error) {
+	db, err := database.InitDB(config.DatabaseDSN)
+	if err != nil {
+		return nil, err
+	}
+	return database.NewSQLStore(db), nil
+}
+
+func runCommand(config *application.Config, args []string) error {
+	switch args[0] {
+	case "agent-token":
+		return agentTokenCommand(config, args[1:])
+	case "user":
+		return userCommand(config, args[1:])
+	case "migrate":
+		return migrateCommand(config, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// agentTokenCommand управляет персональными токенами агентов: issue, revoke и list
+func agentTokenCommand(config *application.Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: orchestrator agent-token issue|revoke|list [agent-id]")
+	}
+	store, err := openStore(config)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	ctx := context.TODO()
+	switch {
+	case args[0] == "issue" && len(args) == 2:
+		token, err := application.IssueAgentToken(ctx, args[1], store)
+		if err != nil {
+			return err
+		}
+		fmt.Println(token)
+	case args[0] == "revoke" && len(args) == 2:
+		ok, err := store.DeleteAgentToken(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("agent %s has no token", args[1])
+		}
+		fmt.Printf("Token of agent %s revoked\n", args[1])
+	case args[0] == "list" && len(args) == 1:
+		tokens, err := store.GetAgentTokens(ctx)
+		if err != nil {
+			return err
+		}
+		for _, token := range tokens {
+			fmt.Printf("%s\t%s\n", token.AgentId, token.CreatedAt.Format("2006-01-02 15:04:05"))
+		}
+	default:
+		return fmt.Errorf("usage: orchestrator agent-token issue|revoke|list [agent-id]")
+	}
+	return nil
+}
+
+// userCommand назначает роль пользователю: так создаётся первый администратор
+func userCommand(config *application.Config, args []string) error {
+	if len(args) != 3 || args[0] != "set-role" || args[2] != application.RoleUser && args[2] != application.RoleAdmin {
+		return fmt.Errorf("usage: orchestrator user set-role <login> user|admin")
+	}
+	store, err := openStore(config)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	ok, err := store.SetUserRole(context.TODO(), args[1], args[2])
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("user %s not found", args[1])
+	}
+	fmt.Printf("User %s now has role %s\n", args[1], args[2])
+	return nil
+}
+
+// migrateCommand показывает состояние миграций (status) или применяет их до указанной версии (up [version])
+func migrateCommand(config *application.Config, args []string) error {
+	usage := fmt.Errorf("usage: orchestrator migrate status|up [version]")
+	if len(args) == 0 || len(args) > 2 {
+		return usage
+	}
+	db, err := database.Open(config.DatabaseDSN)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ctx := context.TODO()
+	switch {
+	case args[0] == "status" && len(args) == 1:
+		states, err := database.MigrationStatus(ctx, db)
+		if err != nil {
+			return err
+		}
+		for _, state := range states {
+			applied := "pending"
+			if state.AppliedAt != nil {
+				applied = "applied " + state.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d\t%s\t%s\n", state.Version, state.Name, applied)
+		}
+	case args[0] == "up":
+		version := database.LatestVersion()
+		if len(args) == 2 {
+			if version, err = strconv.Atoi(args[1]); err != nil {
+				return usage
+			}
+		}
+		if err := database.Migrate(ctx, version, db); err != nil {
+			return err
+		}
+		current, err := database.SchemaVersion(ctx, db)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Database schema is at version %d\n", current)
+	default:
+		return usage
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	"yandexlyceum/internal/database"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// checkPassword проверяет текущий пароль пользователя с учётом блокировки после неудачных попыток
+func (o *Orchestrator) checkPassword(w http.ResponseWriter, r *http.Request, event, login, password string) bool {
+	ip := clientIP(r)
+	retryAfter, err := o.loginRetryAfter(context.TODO(), login, ip)
+	if err != nil {
+		http.Error(w, `{"error":"Something went wrong"}`, http.StatusInternalServerError)
+		return false
+	}
+	if retryAfter > 0 {
+		o.audit(r, database.AuditEvent{Event: event, Outcome: auditFailure, Details: "locked"})
+		writeTooManyAttempts(w, retryAfter)
+		return false
+	}
+	if !o.Store.IsAuth(context.TODO(), login, password) {
+		if err := o.recordLoginFailure(context.TODO(), login, ip); err != nil {
+			log.Printf("Failed to record login failure: %v", err)
+		}
+		o.audit(r, database.AuditEvent{Event: event, Outcome: auditFailure, Details: "invalid password"})
+		http.Error(w, `{"error":"Invalid credentials"}`, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// PasswordHandler меняет пароль; все сессии пользователя отзываются, и в ответе выдаются новые токены
+func (o *Orchestrator) PasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error":"Wrong Method"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		OldPassword string `json:"old_password"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid Body"}`, http.StatusUnprocessableEntity)
+		return
+	}
+	claims, _ := r.Context().Value(UserContextKey).(jwt.MapClaims)
+	login, _ := claims["login"].(string)
+	user, err := o.Store.GetUserByLogin(context.TODO(), login)
+	if err != nil {
+		http.Error(w, `{"error": "Invalid user data"}`, http.StatusInternalServerError)
+		return
+	}
+	if !o.checkPassword(w, r, "password_change", login, req.OldPassword) {
+		return
+	}
+	if err := o.Config.Credentials.ValidatePassword(req.NewPassword); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusUnprocessableEntity)
+		return
+	}
+	hash, err := GeneratePassword(req.NewPassword)
+	if err != nil {
+		http.Error(w, `{"error":"Error encoding password"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := o.Store.UpdatePassword(context.TODO(), user.Id, hash); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := o.Store.RevokeUserSessions(context.TODO(), user.Id, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Password changed for %s", login)
+	o.audit(r, database.AuditEvent{Event: "password_change", Outcome: auditSuccess})
+	pair, err := o.startSession(context.TODO(), user)
+	if err != nil {
+		http.Error(w, `{"error":"Error generating jwt"}`, http.StatusInternalServerError)
+		return
+	}
+	o.writeTokens(w, pair)
+}
+
+// AccountHandler удаляет учётную запись вместе с выражениями; требуется текущий пароль
+func (o *Orchestrator) AccountHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, `{"error":"Wrong Method"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid Body"}`, http.StatusUnprocessableEntity)
+		return
+	}
+	claims, _ := r.Context().Value(UserContextKey).(jwt.MapClaims)
+	login, _ := claims["login"].(string)
+	userID, ok := userIDFromRequest(r)
+	if !ok {
+		http.Error(w, `{"error": "Invalid user data"}`, http.StatusInternalServerError)
+		return
+	}
+	if !o.checkPassword(w, r, "account_delete", login, req.Password) {
+		return
+	}
+	ids, err := o.Store.DeleteUser(context.TODO(), userID)
+	if err != nil {
+		http.Error(w, `{"error":"Something went wrong"}`, http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Account %s deleted with %d expressions", login, len(ids))
+	o.audit(r, database.AuditEvent{Event: "account_delete", Outcome: auditSuccess})
+	clearAuthCookies(w)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,199 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"yandexlyceum/internal/database"
+)
+
+type QueuedTask struct {
+	ID            string     `json:"id"`
+	ExpressionID  string     `json:"expression_id"`
+	Operation     string     `json:"operation"`
+	AgentID       string     `json:"agent_id,omitempty"`
+	LeaseDeadline *time.Time `json:"lease_deadline,omitempty"`
+}
+
+type QueueState struct {
+	Expressions  int          `json:"expressions_in_progress"`
+	Queued       int          `json:"queued"`
+	InProgress   int          `json:"in_progress"`
+	AgentsOnline int          `json:"agents_online"`
+	Tasks        []QueuedTask `json:"tasks"`
+}
+
+// QueueState собирает состояние очереди из Store: задачи всех экземпляров, работающих с базой,
+// и агентов, зарегистрированных на этом
+func (o *Orchestrator) QueueState() (QueueState, error) {
+	state := QueueState{Tasks: []QueuedTask{}}
+	expressions, err := o.Store.GetUnfinishedExpressions(context.TODO())
+	if err != nil {
+		return state, err
+	}
+	tasks, err := o.Store.GetTasks(context.TODO())
+	if err != nil {
+		return state, err
+	}
+	state.Expressions = len(expressions)
+	for _, task := range tasks {
+		queued := QueuedTask{ID: strconv.Itoa(task.Id), ExpressionID: strconv.Itoa(task.ExpressionId), Operation: task.Operation}
+		if task.LeaseDeadline.IsZero() {
+			state.Queued++
+		} else {
+			state.InProgress++
+			queued.AgentID = task.AgentId
+			deadline := task.LeaseDeadline
+			queued.LeaseDeadline = &deadline
+		}
+		state.Tasks = append(state.Tasks, queued)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, agent := range o.agents {
+		if agent.Status == "online" {
+			state.AgentsOnline++
+		}
+	}
+	return state, nil
+}
+
+func (o *Orchestrator) AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error":"Wrong Method"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	users, err := o.Store.GetUsers(context.TODO())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"users": users})
+}
+
+// AdminUserHandler меняет роль пользователя или блокирует его; блокировка отзывает все его сессии.
+// POST /api/v1/admin/users/{id}/unlock снимает блокировку входа после неудачных попыток
+func (o *Orchestrator) AdminUserHandler(w http.ResponseWriter, r *http.Request) {
+	path, unlock := strings.CutSuffix(r.URL.Path[len("/api/v1/admin/users/"):], "/unlock")
+	if unlock && r.Method != http.MethodPost || !unlock && r.Method != http.MethodPatch {
+		http.Error(w, `{"error":"Wrong Method"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(path)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid id"}`, http.StatusUnprocessableEntity)
+		return
+	}
+	if unlock {
+		o.unlockUser(w, r, id)
+		return
+	}
+	var req struct {
+		Role     *string `json:"role"`
+		Disabled *bool   `json:"disabled"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Role == nil && req.Disabled == nil ||
+		req.Role != nil && *req.Role != RoleUser && *req.Role != RoleAdmin {
+		http.Error(w, `{"error":"Invalid Body"}`, http.StatusUnprocessableEntity)
+		return
+	}
+	adminID, ok := userIDFromRequest(r)
+	if !ok {
+		http.Error(w, `{"error": "Invalid user data"}`, http.StatusInternalServerError)
+		return
+	}
+	if adminID == id {
+		http.Error(w, `{"error":"Cannot change own account"}`, http.StatusConflict)
+		return
+	}
+	// роль записана в выданных JWT, поэтому при её смене сессии пользователя отзываются,
+	// как и при блокировке: новые токены получат уже новую роль
+	roleChanged := false
+	if req.Role != nil {
+		if user, err := o.Store.GetUserByID(context.TODO(), id); err == nil {
+			roleChanged = user.Role != *req.Role
+		}
+	}
+	updated, err := o.Store.UpdateUser(context.TODO(), id, req.Role, req.Disabled)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !updated {
+		http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
+		return
+	}
+	o.audit(r, database.AuditEvent{Event: "admin_user_update", Outcome: auditSuccess, Details: userChanges(id, req.Role, req.Disabled)})
+	if req.Disabled != nil && *req.Disabled || roleChanged {
+		if err := o.Store.RevokeUserSessions(context.TODO(), id, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"User updated"}`))
+}
+
+func (o *Orchestrator) AdminExpressionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error":"Wrong Method"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	expressions, err := o.Store.GetAllExpressions(context.TODO())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"expressions": expressions})
+}
+
+func (o *Orchestrator) AdminQueueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error":"Wrong Method"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	state, err := o.QueueState()
+	if err != nil {
+		http.Error(w, `{"error":"Something went wrong"}`, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+func (o *Orchestrator) unlockUser(w http.ResponseWriter, r *http.Request, id int) {
+	user, err := o.Store.GetUserByID(context.TODO(), id)
+	if err != nil {
+		http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
+		return
+	}
+	if _, err := o.Store.ResetLoginAttempts(context.TODO(), loginKey(user.Login)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Login lock for %s removed by admin", user.Login)
+	o.audit(r, database.AuditEvent{Event: "admin_user_unlock", Outcome: auditSuccess, Details: fmt.Sprintf("user %d (%s)", user.Id, user.Login)})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"User unlocked"}`))
+}
+
+func userChanges(id int, role *string, disabled *bool) string {
+	details := fmt.Sprintf("user %d", id)
+	if role != nil {
+		details += ", role=" + *role
+	}
+	if disabled != nil {
+		details += fmt.Sprintf(", disabled=%t", *disabled)
+	}
+	return details
+}
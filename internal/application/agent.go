@@ -1,20 +1,27 @@
 package application
 
 import (
-	"bytes"
-	"encoding/json"
-	"io/ioutil"
+	"context"
+	"errors"
+	"fmt"
 	"log"
-	"net/http"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 	"yandexlyceum/pkg/calculation"
 )
 
+const taskWait = 30 * time.Second
+
 type Agent struct {
-	ComputingPower  int
-	OrchestratorURL string
+	ID                string
+	ComputingPower    int
+	OrchestratorURL   string
+	Transport         string
+	GRPCAddr          string
+	Token             string
+	HeartbeatInterval time.Duration
 }
 
 func NewAgent() *Agent {
@@ -26,72 +33,222 @@ func NewAgent() *Agent {
 	if orchestratorURL == "" {
 		orchestratorURL = "http://localhost:8080"
 	}
+	transport := os.Getenv("AGENT_TRANSPORT")
+	if transport == "" {
+		transport = "http"
+	}
+	grpcAddr := os.Getenv("ORCHESTRATOR_GRPC_ADDR")
+	if grpcAddr == "" {
+		grpcAddr = "localhost:9090"
+	}
+	id := os.Getenv("AGENT_ID")
+	if id == "" {
+		hostname, _ := os.Hostname()
+		id = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	token := os.Getenv("AGENT_TOKEN")
+	if token == "" {
+		token = os.Getenv("AGENT_SECRET")
+	}
+	hb, _ := strconv.Atoi(os.Getenv("AGENT_HEARTBEAT_MS"))
+	if hb == 0 {
+		hb = 5000
+	}
 	return &Agent{
-		ComputingPower:  cp,
-		OrchestratorURL: orchestratorURL,
+		ID:                id,
+		ComputingPower:    cp,
+		OrchestratorURL:   orchestratorURL,
+		Transport:         transport,
+		GRPCAddr:          grpcAddr,
+		Token:             token,
+		HeartbeatInterval: time.Duration(hb) * time.Millisecond,
 	}
 }
 
-func (a *Agent) Run() {
+func (a *Agent) newTransport() (taskTransport, error) {
+	switch a.Transport {
+	case "http":
+		return &httpTransport{url: a.OrchestratorURL, token: a.Token}, nil
+	case "grpc":
+		return newGRPCTransport(a.GRPCAddr, a.Token)
+	case "grpc-stream":
+		return newGRPCStreamTransport(a.GRPCAddr, a.Token)
+	default:
+		return nil, fmt.Errorf("unknown transport %q", a.Transport)
+	}
+}
+
+func (a *Agent) Run() error {
+	return a.RunContext(context.Background())
+}
+
+func (a *Agent) RunContext(ctx context.Context) error {
+	transport, err := a.newTransport()
+	if err != nil {
+		return err
+	}
+	defer transport.Close()
+	log.Printf("Agent %s uses %s transport", a.ID, a.Transport)
+	a.register(ctx, transport)
+	go a.heartbeats(ctx, transport)
+
+	tasks := make(chan *Task)
+	results := make(chan TaskResult, a.ComputingPower)
+	// слоты свободных воркеров: диспетчер запрашивает ровно столько задач, сколько есть слотов
+	slots := make(chan struct{}, a.ComputingPower)
+	var workers sync.WaitGroup
 	for i := 0; i < a.ComputingPower; i++ {
-		go a.worker(i)
+		slots <- struct{}{}
+		workers.Add(1)
+		go func(id int) {
+			defer workers.Done()
+			a.worker(id, tasks, results, slots)
+		}(i)
+	}
+	reported := make(chan struct{})
+	go func() {
+		a.reporter(transport, results)
+		close(reported)
+	}()
+
+	a.dispatcher(ctx, transport, tasks, slots)
+	close(tasks)
+	workers.Wait()
+	close(results)
+	<-reported
+	return nil
+}
+
+func (a *Agent) register(ctx context.Context, transport taskTransport) {
+	err := transport.Register(ctx, AgentRegistration{
+		ID:             a.ID,
+		ComputingPower: a.ComputingPower,
+		Operations:     calculation.Operations(),
+	})
+	if err != nil && ctx.Err() == nil {
+		log.Printf("Agent %s: error registering: %v", a.ID, err)
 	}
-	select {}
 }
 
-func (a *Agent) worker(id int) {
+func (a *Agent) heartbeats(ctx context.Context, transport taskTransport) {
+	interval := a.HeartbeatInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	for {
-		resp, err := http.Get(a.OrchestratorURL + "/internal/task")
-		if err != nil {
-			log.Printf("Worker %d: error getting task: %v", id, err)
-			time.Sleep(2 * time.Second)
-			continue
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
 		}
-		if resp.StatusCode == http.StatusNotFound {
-			resp.Body.Close()
-			time.Sleep(1 * time.Second)
-			continue
+		err := transport.Heartbeat(ctx, a.ID)
+		if errors.Is(err, ErrAgentNotRegistered) {
+			// оркестратор перезапустился и забыл агента
+			a.register(ctx, transport)
+		} else if err != nil && ctx.Err() == nil {
+			log.Printf("Agent %s: error sending heartbeat: %v", a.ID, err)
 		}
-		var taskResp struct {
-			Task struct {
-				ID            string  `json:"id"`
-				Arg1          float64 `json:"arg1"`
-				Arg2          float64 `json:"arg2"`
-				Operation     string  `json:"operation"`
-				OperationTime int     `json:"operation_time"`
-			} `json:"task"`
+	}
+}
+
+func (a *Agent) dispatcher(ctx context.Context, transport taskTransport, tasks chan<- *Task, slots chan struct{}) {
+	for {
+		select {
+		case <-slots:
+		case <-ctx.Done():
+			return
+		}
+		free := 1
+	collect:
+		for free < a.ComputingPower {
+			select {
+			case <-slots:
+				free++
+			default:
+				break collect
+			}
+		}
+		batch, err := transport.FetchTasks(ctx, a.ID, free, taskWait)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Dispatcher: error getting tasks: %v", err)
+		}
+		for i := len(batch); i < free; i++ {
+			slots <- struct{}{}
+		}
+		for _, task := range batch {
+			tasks <- task
 		}
-		err = json.NewDecoder(resp.Body).Decode(&taskResp)
-		resp.Body.Close()
 		if err != nil {
-			log.Printf("Worker %d: error decoding task: %v", id, err)
-			time.Sleep(1 * time.Second)
-			continue
+			select {
+			case <-time.After(2 * time.Second):
+			case <-ctx.Done():
+				return
+			}
 		}
-		task := taskResp.Task
-		log.Printf("Worker %d: received task %s: %f %s %f, simulating %d ms", id, task.ID, task.Arg1, task.Operation, task.Arg2, task.OperationTime)
+	}
+}
+
+func (a *Agent) worker(id int, tasks <-chan *Task, results chan<- TaskResult, slots chan<- struct{}) {
+	for task := range tasks {
+		results <- computeTask(id, task)
+		slots <- struct{}{}
+	}
+}
+
+func computeTask(workerID int, task *Task) TaskResult {
+	var result float64
+	var err error
+	if calculation.IsFunction(task.Operation) {
+		log.Printf("Worker %d: received task %s: %s%v, simulating %d ms", workerID, task.ID, task.Operation, task.Args, task.OperationTime)
 		time.Sleep(time.Duration(task.OperationTime) * time.Millisecond)
-		result, err := calculation.Compute(task.Operation, task.Arg1, task.Arg2)
-		if err != nil {
-			log.Printf("Worker %d: error computing task %s: %v", id, task.ID, err)
-			continue
+		result, err = calculation.Call(task.Operation, task.Args)
+	} else {
+		log.Printf("Worker %d: received task %s: %f %s %f, simulating %d ms", workerID, task.ID, task.Arg1, task.Operation, task.Arg2, task.OperationTime)
+		time.Sleep(time.Duration(task.OperationTime) * time.Millisecond)
+		result, err = calculation.Compute(task.Operation, task.Arg1, task.Arg2)
+	}
+	if err != nil {
+		log.Printf("Worker %d: error computing task %s: %v", workerID, task.ID, err)
+		return TaskResult{
+			ID: task.ID,
+			Error: &TaskError{
+				Code:    calculation.ErrorCode(err),
+				Message: err.Error(),
+			},
 		}
-		resultPayload := map[string]interface{}{
-			"id":     task.ID,
-			"result": result,
+	}
+	log.Printf("Worker %d: computed task %s with result %f", workerID, task.ID, result)
+	return TaskResult{ID: task.ID, Result: result}
+}
+
+// reporter отправляет накопившиеся результаты одним запросом
+func (a *Agent) reporter(transport taskTransport, results <-chan TaskResult) {
+	for result := range results {
+		batch := []TaskResult{result}
+	collect:
+		for len(batch) < a.ComputingPower {
+			select {
+			case result, ok := <-results:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, result)
+			default:
+				break collect
+			}
 		}
-		payloadBytes, _ := json.Marshal(resultPayload)
-		respPost, err := http.Post(a.OrchestratorURL+"/internal/task", "application/json", bytes.NewReader(payloadBytes))
+		statuses, err := transport.SubmitResults(context.Background(), batch)
 		if err != nil {
-			log.Printf("Worker %d: error posting result for task %s: %v", id, task.ID, err)
+			log.Printf("Reporter: error posting %d results: %v", len(batch), err)
 			continue
 		}
-		if respPost.StatusCode != http.StatusOK {
-			body, _ := ioutil.ReadAll(respPost.Body)
-			log.Printf("Worker %d: error response posting result for task %s: %s", id, task.ID, string(body))
-		} else {
-			log.Printf("Worker %d: successfully completed task %s with result %f", id, task.ID, result)
+		for _, status := range statuses {
+			if status.Status != "accepted" {
+				log.Printf("Reporter: result for task %s was not accepted: %s", status.ID, status.Status)
+			}
 		}
-		respPost.Body.Close()
+		log.Printf("Reporter: posted %d results", len(batch))
 	}
 }
@@ -0,0 +1,135 @@
+package application
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+	"yandexlyceum/internal/database"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// authenticateAgent проверяет токен агента: общий секрет AGENT_SECRET подходит любому агенту,
+// персональный токен привязан к одному агенту, и его идентификатор возвращается в agentID
+func (o *Orchestrator) authenticateAgent(ctx context.Context, token string) (agentID string, ok bool) {
+	if token == "" {
+		return "", false
+	}
+	if o.Config.AgentSecret != "" && subtle.ConstantTimeCompare([]byte(token), []byte(o.Config.AgentSecret)) == 1 {
+		return "", true
+	}
+	agentID, err := o.Store.GetAgentByToken(ctx, hashToken(token))
+	if err != nil {
+		return "", false
+	}
+	return agentID, true
+}
+
+// resolveAgentID сверяет заявленный агентом идентификатор с тем, к которому привязан токен
+func resolveAgentID(ctx context.Context, claimed string) (string, bool) {
+	bound, ok := ctx.Value(AgentContextKey).(string)
+	if !ok || bound == "" {
+		return claimed, true
+	}
+	if claimed != "" && claimed != bound {
+		return "", false
+	}
+	return bound, true
+}
+
+// tokenAgentID возвращает агента, к которому привязан токен запроса; "" - общий секрет
+func tokenAgentID(ctx context.Context) string {
+	bound, _ := ctx.Value(AgentContextKey).(string)
+	return bound
+}
+
+func (o *Orchestrator) AgentAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if token == "" {
+			log.Printf("Rejected agent request %s %s from %s: missing token", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, `{"error": "Missing agent token"}`, http.StatusUnauthorized)
+			return
+		}
+		agentID, ok := o.authenticateAgent(r.Context(), token)
+		if !ok {
+			log.Printf("Rejected agent request %s %s from %s: invalid token", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, `{"error": "Invalid agent token"}`, http.StatusUnauthorized)
+			return
+		}
+		ctx := context.WithValue(r.Context(), AgentContextKey, agentID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (o *Orchestrator) grpcAuthenticate(ctx context.Context, method string) (context.Context, error) {
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			if len(values[0]) > 7 && strings.EqualFold(values[0][:7], "Bearer ") {
+				token = strings.TrimSpace(values[0][7:])
+			}
+		}
+	}
+	agentID, ok := o.authenticateAgent(ctx, token)
+	if !ok {
+		log.Printf("Rejected gRPC agent call %s: invalid or missing token", method)
+		return nil, status.Error(codes.Unauthenticated, "invalid agent token")
+	}
+	return context.WithValue(ctx, AgentContextKey, agentID), nil
+}
+
+func (o *Orchestrator) unaryAuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := o.grpcAuthenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (o *Orchestrator) streamAuthInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := o.grpcAuthenticate(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+}
+
+// IssueAgentToken выпускает новый персональный токен агента, заменяя прежний
+func IssueAgentToken(ctx context.Context, agentID string, store database.Store) (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	if err := store.SetAgentToken(ctx, agentID, hashToken(token)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// agentCredentials передаёт токен агента в метаданных каждого gRPC-вызова
+type agentCredentials struct {
+	token string
+}
+
+func (c agentCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + c.token}, nil
+}
+
+func (c agentCredentials) RequireTransportSecurity() bool {
+	return false
+}
@@ -0,0 +1,199 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+type AgentInfo struct {
+	ID              string    `json:"id"`
+	ComputingPower  int       `json:"computing_power"`
+	Operations      []string  `json:"operations"`
+	Status          string    `json:"status"`
+	RegisteredAt    time.Time `json:"registered_at"`
+	LastSeen        time.Time `json:"last_seen"`
+	TasksInProgress int       `json:"tasks_in_progress"`
+	TasksCompleted  int       `json:"tasks_completed"`
+	TasksFailed     int       `json:"tasks_failed"`
+	Throughput      float64   `json:"throughput_per_minute"`
+	operations      map[string]bool
+}
+
+type AgentRegistration struct {
+	ID             string   `json:"id"`
+	ComputingPower int      `json:"computing_power"`
+	Operations     []string `json:"operations"`
+}
+
+// supports сообщает, может ли агент посчитать операцию; незарегистрированный агент считает всё
+func (a *AgentInfo) supports(operation string) bool {
+	if a == nil || len(a.operations) == 0 {
+		return true
+	}
+	return a.operations[operation]
+}
+
+func (a *AgentInfo) recordResult(result TaskResult) {
+	if result.Error != nil {
+		a.TasksFailed++
+	} else {
+		a.TasksCompleted++
+	}
+}
+
+// registerAgent добавляет агента в реестр или обновляет его данные; вызывается под o.mu
+func (o *Orchestrator) registerAgent(reg AgentRegistration) {
+	now := time.Now()
+	agent, ok := o.agents[reg.ID]
+	if !ok {
+		agent = &AgentInfo{ID: reg.ID, RegisteredAt: now}
+		o.agents[reg.ID] = agent
+	}
+	agent.ComputingPower = reg.ComputingPower
+	agent.Operations = reg.Operations
+	agent.operations = make(map[string]bool, len(reg.Operations))
+	for _, op := range reg.Operations {
+		agent.operations[op] = true
+	}
+	agent.Status = "online"
+	agent.LastSeen = now
+	log.Printf("Agent %s registered with computing power %d", reg.ID, reg.ComputingPower)
+}
+
+// heartbeat отмечает агента живым; false - агент не зарегистрирован; вызывается под o.mu
+func (o *Orchestrator) heartbeat(agentID string) bool {
+	agent, ok := o.agents[agentID]
+	if !ok {
+		return false
+	}
+	agent.LastSeen = time.Now()
+	agent.Status = "online"
+	return true
+}
+
+// RequeueLostAgents помечает offline агентов без heartbeat дольше AgentTimeout и возвращает
+// в очередь выданные им задачи. Реестр агентов у каждого экземпляра свой
+func (o *Orchestrator) RequeueLostAgents() {
+	timeout := time.Duration(o.Config.AgentTimeout) * time.Millisecond
+	now := time.Now()
+	var lost []string
+	o.mu.Lock()
+	for _, agent := range o.agents {
+		if agent.Status == "offline" || now.Sub(agent.LastSeen) < timeout {
+			continue
+		}
+		agent.Status = "offline"
+		lost = append(lost, agent.ID)
+	}
+	o.mu.Unlock()
+	requeuedTotal := 0
+	for _, agentID := range lost {
+		requeued, err := o.Store.RequeueAgentTasks(context.TODO(), agentID)
+		if err != nil {
+			log.Printf("Failed to requeue tasks of agent %s: %v", agentID, err)
+			continue
+		}
+		requeuedTotal += requeued
+		log.Printf("Agent %s stopped sending heartbeats, %d tasks requeued", agentID, requeued)
+	}
+	if requeuedTotal > 0 {
+		o.notifyTasks()
+	}
+}
+
+func (o *Orchestrator) Agents() ([]AgentInfo, error) {
+	tasks, err := o.Store.GetTasks(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	inProgress := make(map[string]int)
+	for _, task := range tasks {
+		if !task.LeaseDeadline.IsZero() {
+			inProgress[task.AgentId]++
+		}
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now()
+	agents := make([]AgentInfo, 0, len(o.agents))
+	for _, agent := range o.agents {
+		info := *agent
+		info.TasksInProgress = inProgress[agent.ID]
+		if minutes := now.Sub(agent.RegisteredAt).Minutes(); minutes > 0 {
+			info.Throughput = float64(agent.TasksCompleted+agent.TasksFailed) / minutes
+		}
+		agents = append(agents, info)
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].ID < agents[j].ID })
+	return agents, nil
+}
+
+func (o *Orchestrator) RegisterAgentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error":"Wrong Method"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	var req AgentRegistration
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.ID == "" || req.ComputingPower < 1 {
+		http.Error(w, `{"error":"Invalid Body"}`, http.StatusUnprocessableEntity)
+		return
+	}
+	if _, ok := resolveAgentID(r.Context(), req.ID); !ok {
+		http.Error(w, `{"error":"Token belongs to another agent"}`, http.StatusForbidden)
+		return
+	}
+	o.mu.Lock()
+	o.registerAgent(req)
+	o.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"Agent registered"}`))
+}
+
+func (o *Orchestrator) HeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error":"Wrong Method"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		ID string `json:"id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.ID == "" {
+		http.Error(w, `{"error":"Invalid Body"}`, http.StatusUnprocessableEntity)
+		return
+	}
+	if _, ok := resolveAgentID(r.Context(), req.ID); !ok {
+		http.Error(w, `{"error":"Token belongs to another agent"}`, http.StatusForbidden)
+		return
+	}
+	o.mu.Lock()
+	ok := o.heartbeat(req.ID)
+	o.mu.Unlock()
+	if !ok {
+		http.Error(w, `{"error":"Agent not registered"}`, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+func (o *Orchestrator) ListAgentsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error":"Wrong Method"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	agents, err := o.Agents()
+	if err != nil {
+		http.Error(w, `{"error":"Something went wrong"}`, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"agents": agents})
+}
@@ -0,0 +1,128 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"yandexlyceum/internal/database"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	ScopeRead   = "read"
+	ScopeSubmit = "submit"
+)
+
+// apiKeyPrefix отличает API-ключи от JWT в заголовке Authorization
+const apiKeyPrefix = "ak_"
+
+// scopeAllows сообщает, покрывает ли область ключа требуемую; submit включает read
+func scopeAllows(keyScope, required string) bool {
+	return keyScope == required || keyScope == ScopeSubmit && required == ScopeRead
+}
+
+// apiKeyClaims проверяет API-ключ и возвращает те же claims, что и у JWT, с добавлением scope.
+// Ключ принимается только на маршрутах, для которых указана подходящая область
+func (o *Orchestrator) apiKeyClaims(ctx context.Context, key string, scopes []string) (jwt.MapClaims, int, string) {
+	apiKey, err := o.Store.UseAPIKey(ctx, hashToken(key))
+	if err != nil {
+		return nil, http.StatusUnauthorized, `{"error": "Invalid API key"}`
+	}
+	if !slices.ContainsFunc(scopes, func(scope string) bool { return scopeAllows(apiKey.Scope, scope) }) {
+		return nil, http.StatusForbidden, `{"error": "API key scope does not allow this request"}`
+	}
+	return jwt.MapClaims{
+		"user_id":    float64(apiKey.UserId),
+		"login":      apiKey.Login,
+		"scope":      apiKey.Scope,
+		"api_key_id": float64(apiKey.Id),
+	}, http.StatusOK, ""
+}
+
+func (o *Orchestrator) APIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, `{"error":"Wrong Method"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	userID, ok := userIDFromRequest(r)
+	if !ok {
+		http.Error(w, `{"error": "Invalid user data"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		keys, err := o.Store.GetAPIKeys(context.TODO(), userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"apikeys": keys})
+		return
+	}
+
+	var req struct {
+		Name  string `json:"name"`
+		Scope string `json:"scope"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	req.Name = strings.TrimSpace(req.Name)
+	if err != nil || req.Name == "" || req.Scope != ScopeRead && req.Scope != ScopeSubmit {
+		http.Error(w, `{"error":"Invalid Body"}`, http.StatusUnprocessableEntity)
+		return
+	}
+	secret, err := generateToken()
+	if err != nil {
+		http.Error(w, `{"error":"Error generating API key"}`, http.StatusInternalServerError)
+		return
+	}
+	key := apiKeyPrefix + secret
+	apiKey, err := o.Store.AddAPIKey(context.TODO(), userID, req.Name, req.Scope, hashToken(key))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	o.audit(r, database.AuditEvent{Event: "apikey_create", Outcome: auditSuccess, Details: fmt.Sprintf("key %d (%s, %s)", apiKey.Id, apiKey.Name, apiKey.Scope)})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":         apiKey.Id,
+		"name":       apiKey.Name,
+		"scope":      apiKey.Scope,
+		"created_at": apiKey.CreatedAt,
+		"key":        key,
+	})
+}
+
+func (o *Orchestrator) APIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, `{"error":"Wrong Method"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(r.URL.Path[len("/api/v1/apikeys/"):])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid API key ID"}`, http.StatusUnprocessableEntity)
+		return
+	}
+	userID, ok := userIDFromRequest(r)
+	if !ok {
+		http.Error(w, `{"error": "Invalid user data"}`, http.StatusInternalServerError)
+		return
+	}
+	deleted, err := o.Store.DeleteAPIKey(context.TODO(), userID, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, `{"error":"API key not found"}`, http.StatusNotFound)
+		return
+	}
+	o.audit(r, database.AuditEvent{Event: "apikey_delete", Outcome: auditSuccess, Details: fmt.Sprintf("key %d", id)})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -2,17 +2,114 @@ package application
 
 import (
 	"fmt"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"unicode"
+	"yandexlyceum/pkg/calculation"
 )
 
 type ASTNode struct {
-	IsLeaf        bool
-	Value         float64
-	Operator      string
-	Left, Right   *ASTNode
-	TaskScheduled bool
+	IsLeaf   bool       `json:"leaf,omitempty"`
+	Value    float64    `json:"value,omitempty"`
+	Operator string     `json:"op,omitempty"`
+	Left     *ASTNode   `json:"left,omitempty"`
+	Right    *ASTNode   `json:"right,omitempty"`
+	Function string     `json:"fn,omitempty"`
+	Args     []*ASTNode `json:"args,omitempty"`
+	Variable string     `json:"var,omitempty"`
+}
+
+// children возвращает операнды узла: аргументы для вызова функции, иначе левый и правый
+func (n *ASTNode) children() []*ASTNode {
+	if n.Variable != "" {
+		return nil
+	}
+	if n.Function != "" {
+		return n.Args
+	}
+	return []*ASTNode{n.Left, n.Right}
+}
+
+// nodeAt находит узел по пути вида "0.1" из индексов операндов
+func (n *ASTNode) nodeAt(path string) *ASTNode {
+	node := n
+	if path == "" {
+		return node
+	}
+	for _, step := range strings.Split(path, ".") {
+		if node == nil || node.IsLeaf {
+			return nil
+		}
+		index, err := strconv.Atoi(step)
+		children := node.children()
+		if err != nil || index < 0 || index >= len(children) {
+			return nil
+		}
+		node = children[index]
+	}
+	return node
+}
+
+// ResolveVariables подставляет значения переменных вместо узлов-переменных
+func ResolveVariables(node *ASTNode, values map[string]float64) error {
+	var missing []string
+	var walk func(node *ASTNode)
+	walk = func(node *ASTNode) {
+		if node == nil || node.IsLeaf {
+			return
+		}
+		if node.Variable != "" {
+			value, ok := values[node.Variable]
+			if !ok {
+				missing = append(missing, node.Variable)
+				return
+			}
+			node.IsLeaf = true
+			node.Value = value
+			node.Variable = ""
+			return
+		}
+		for _, child := range node.children() {
+			walk(child)
+		}
+	}
+	walk(node)
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		missing = slices.Compact(missing)
+		return fmt.Errorf("undefined variables: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func IsIdentifier(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, ch := range name {
+		if !isIdentifierRune(ch, i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// isIdentifierRune допускает в имени только ASCII-буквы, цифры и '_': парсер читает выражение побайтно,
+// и переменную с другими буквами нельзя было бы использовать в выражении
+func isIdentifierRune(ch rune, first bool) bool {
+	if ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch == '_' {
+		return true
+	}
+	return !first && ch >= '0' && ch <= '9'
+}
+
+func childPath(path string, index int) string {
+	if path == "" {
+		return strconv.Itoa(index)
+	}
+	return path + "." + strconv.Itoa(index)
 }
 
 func ParseAST(expression string) (*ASTNode, error) {
@@ -82,8 +179,11 @@ func (p *parser) parseTerm() (*ASTNode, error) {
 	}
 	for {
 		ch := p.peek()
-		if ch == '*' || ch == '/' {
+		if ch == '*' || ch == '/' || ch == '%' {
 			op := string(p.get())
+			if op == "/" && p.peek() == '/' {
+				op += string(p.get())
+			}
 			right, err := p.parseFactor()
 			if err != nil {
 				return nil, err
@@ -101,7 +201,55 @@ func (p *parser) parseTerm() (*ASTNode, error) {
 	return node, nil
 }
 
+// parseFactor разбирает унарные знаки; у '^' приоритет выше, поэтому -2^2 = -(2^2)
 func (p *parser) parseFactor() (*ASTNode, error) {
+	ch := p.peek()
+	if ch != '+' && ch != '-' {
+		return p.parsePower()
+	}
+	p.get()
+	node, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	if ch == '+' {
+		return node, nil
+	}
+	if node.IsLeaf {
+		node.Value = -node.Value
+		return node, nil
+	}
+	return &ASTNode{
+		IsLeaf:   false,
+		Operator: "-",
+		Left:     &ASTNode{IsLeaf: true, Value: 0},
+		Right:    node,
+	}, nil
+}
+
+func (p *parser) parsePower() (*ASTNode, error) {
+	node, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != '^' {
+		return node, nil
+	}
+	p.get()
+	// правая ассоциативность: показатель степени сам может содержать '^'
+	right, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	return &ASTNode{
+		IsLeaf:   false,
+		Operator: "^",
+		Left:     node,
+		Right:    right,
+	}, nil
+}
+
+func (p *parser) parsePrimary() (*ASTNode, error) {
 	ch := p.peek()
 	if ch == '(' {
 		p.get() // потребляем '('
@@ -115,10 +263,10 @@ func (p *parser) parseFactor() (*ASTNode, error) {
 		p.get()
 		return node, nil
 	}
-	start := p.pos
-	if ch == '+' || ch == '-' {
-		p.get()
+	if isIdentifierRune(ch, true) {
+		return p.parseIdentifierOrCall()
 	}
+	start := p.pos
 	for {
 		ch = p.peek()
 		if unicode.IsDigit(ch) || ch == '.' {
@@ -140,3 +288,56 @@ func (p *parser) parseFactor() (*ASTNode, error) {
 		Value:  value,
 	}, nil
 }
+
+func (p *parser) parseIdentifier() string {
+	start := p.pos
+	for {
+		if isIdentifierRune(p.peek(), false) {
+			p.get()
+		} else {
+			break
+		}
+	}
+	return p.input[start:p.pos]
+}
+
+func (p *parser) parseIdentifierOrCall() (*ASTNode, error) {
+	start := p.pos
+	name := p.parseIdentifier()
+	if p.peek() != '(' {
+		return &ASTNode{
+			IsLeaf:   false,
+			Variable: name,
+		}, nil
+	}
+	if !calculation.IsFunction(name) {
+		return nil, fmt.Errorf("unknown function %s at position %d", name, start)
+	}
+	p.get()
+	var args []*ASTNode
+	if p.peek() != ')' {
+		for {
+			arg, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if p.peek() != ',' {
+				break
+			}
+			p.get()
+		}
+	}
+	if p.peek() != ')' {
+		return nil, fmt.Errorf("missing closing parenthesis")
+	}
+	p.get()
+	if err := calculation.CheckArity(name, len(args)); err != nil {
+		return nil, err
+	}
+	return &ASTNode{
+		IsLeaf:   false,
+		Function: name,
+		Args:     args,
+	}, nil
+}
@@ -0,0 +1,90 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"yandexlyceum/internal/database"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	auditSuccess = "success"
+	auditFailure = "failure"
+	// pending - пароль верен, ожидается второй фактор
+	auditPending = "pending"
+)
+
+const (
+	auditLimitDefault = 100
+	auditLimitMax     = 1000
+)
+
+// audit дописывает событие в журнал аудита. Время и IP берутся из запроса, а если исполнитель
+// не указан - из claims авторизованного пользователя. Ошибка записи не прерывает обработку запроса
+func (o *Orchestrator) audit(r *http.Request, event database.AuditEvent) {
+	event.CreatedAt = time.Now()
+	event.IP = clientIP(r)
+	if claims, ok := r.Context().Value(UserContextKey).(jwt.MapClaims); ok && event.ActorId == 0 && event.Actor == "" {
+		userID, _ := claims["user_id"].(float64)
+		event.ActorId = int(userID)
+		event.Actor, _ = claims["login"].(string)
+	}
+	if err := o.Store.AddAuditEvent(context.TODO(), event); err != nil {
+		log.Printf("Failed to write audit event %s: %v", event.Event, err)
+	}
+}
+
+// AdminAuditHandler отдаёт журнал аудита с фильтрами event, actor, actor_id, ip, outcome,
+// from и to (RFC 3339) и limit
+func (o *Orchestrator) AdminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error":"Wrong Method"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	filter := database.AuditFilter{
+		Event:   query.Get("event"),
+		Actor:   query.Get("actor"),
+		IP:      query.Get("ip"),
+		Outcome: query.Get("outcome"),
+		Limit:   auditLimitDefault,
+	}
+	var err error
+	if v := query.Get("actor_id"); v != "" {
+		if filter.ActorId, err = strconv.Atoi(v); err != nil {
+			http.Error(w, `{"error":"Invalid actor_id"}`, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	if v := query.Get("from"); v != "" {
+		if filter.From, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, `{"error":"Invalid from"}`, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		if filter.To, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, `{"error":"Invalid to"}`, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		filter.Limit, err = strconv.Atoi(v)
+		if err != nil || filter.Limit < 1 || filter.Limit > auditLimitMax {
+			http.Error(w, `{"error":"Invalid limit"}`, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	events, err := o.Store.GetAuditEvents(context.TODO(), filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"events": events})
+}
@@ -2,9 +2,14 @@ package application
 
 import (
 	"context"
-	"fmt"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"net/http"
+	"strings"
 	"time"
+	"yandexlyceum/internal/database"
 
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
@@ -13,64 +18,175 @@ import (
 type contextKey string
 
 const (
-	UserContextKey contextKey = "user"
+	RoleUser  = "user"
+	RoleAdmin = "admin"
 )
 
 const (
-	SecretKey = "super_secret_signature"
+	UserContextKey  contextKey = "user"
+	AgentContextKey contextKey = "agent"
 )
 
-func GenerateJWT(user_id int, login string) (string, error) {
-	const hmacSampleSecret = "super_secret_signature"
+func userIDFromRequest(r *http.Request) (int, bool) {
+	claims, ok := r.Context().Value(UserContextKey).(jwt.MapClaims)
+	if !ok {
+		return 0, false
+	}
+	userIDFloat, _ := claims["user_id"].(float64)
+	return int(userIDFloat), true
+}
+
+// generateToken возвращает случайный токен; в базе хранится только его хеш
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+func (o *Orchestrator) GenerateJWT(user database.User, session_id string) (string, error) {
+	jti, err := generateToken()
+	if err != nil {
+		return "", err
+	}
 	now := time.Now()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": user_id,
-		"login":   login,
-		"nbf":     now.Add(5 * time.Second).Unix(),
-		"exp":     now.Add(10 * time.Minute).Unix(),
+	return o.Config.JWTKeys.Sign(jwt.MapClaims{
+		"user_id": user.Id,
+		"login":   user.Login,
+		"role":    user.Role,
+		"sid":     session_id,
+		"jti":     jti,
+		"nbf":     now.Add(o.Config.TokenNotBefore).Unix(),
+		"exp":     now.Add(o.Config.TokenTTL).Unix(),
 		"iat":     now.Unix(),
 	})
-	tokenString, err := token.SignedString([]byte(hmacSampleSecret))
+}
+
+func GeneratePassword(password string) (string, error) {
+	if password == "" {
+		return "", ErrEmptyPassword
+	}
+	if len(password) > maxPasswordBytes {
+		return "", ErrPasswordTooLong
+	}
+	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return "", err
 	}
-	return tokenString, nil
+	return string(hashedBytes), nil
 }
 
-func GeneratePassword(password string) (string, error) {
-	if len(password) > 72 {
-		password = password[:72]
+var (
+	errMissingToken   = errors.New("missing token")
+	errMalformedToken = errors.New("malformed token")
+)
+
+// accessToken извлекает JWT из запроса. Заголовок Authorization имеет приоритет над Cookie auth_token:
+// если заголовок передан, Cookie не проверяется, даже когда заголовок некорректен
+func accessToken(r *http.Request) (string, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		token := bearerToken(r)
+		if token == "" {
+			return "", errMalformedToken
+		}
+		return token, nil
 	}
-	saltedBytes := []byte(password)
-	hashedBytes, err := bcrypt.GenerateFromPassword(saltedBytes, bcrypt.DefaultCost)
-	if err != nil {
-		return "", nil
+	cookie, err := r.Cookie("auth_token")
+	if err != nil || cookie.Value == "" {
+		return "", errMissingToken
 	}
-	hash := string(hashedBytes[:])
-	return hash, nil
+	return cookie.Value, nil
 }
 
-func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+// AuthMiddleware пропускает запросы с действительным JWT. scopes - области API-ключей,
+// которым разрешён маршрут; без них API-ключи на маршруте не принимаются
+func (o *Orchestrator) AuthMiddleware(next http.HandlerFunc, scopes ...string) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("auth_token")
-		if err != nil {
+		tokenString, err := accessToken(r)
+		if errors.Is(err, errMissingToken) {
 			http.Error(w, `{"error": "Missing token"}`, http.StatusUnauthorized)
 			return
 		}
-		token, err := jwt.Parse(cookie.Value, func(t *jwt.Token) (interface{}, error) {
-			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method")
+		if err != nil {
+			http.Error(w, `{"error": "Malformed token"}`, http.StatusUnauthorized)
+			return
+		}
+		if strings.HasPrefix(tokenString, apiKeyPrefix) {
+			claims, code, message := o.apiKeyClaims(r.Context(), tokenString, scopes)
+			if claims == nil {
+				http.Error(w, message, code)
+				return
 			}
-			return []byte(SecretKey), nil
-		})
-
-		if err != nil || !token.Valid {
+			ctx := context.WithValue(r.Context(), UserContextKey, claims)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		token, err := o.Config.JWTKeys.Parse(tokenString)
+		switch {
+		case errors.Is(err, jwt.ErrTokenMalformed):
+			http.Error(w, `{"error": "Malformed token"}`, http.StatusUnauthorized)
+			return
+		case errors.Is(err, jwt.ErrTokenExpired):
+			http.Error(w, `{"error": "Token expired"}`, http.StatusUnauthorized)
+			return
+		case errors.Is(err, jwt.ErrTokenNotValidYet):
+			http.Error(w, `{"error": "Token not valid yet"}`, http.StatusUnauthorized)
+			return
+		case err != nil || !token.Valid:
 			http.Error(w, `{"error": "Invalid token"}`, http.StatusForbidden)
 			return
 		}
-		if claims, ok := token.Claims.(jwt.MapClaims); ok {
-			ctx := context.WithValue(r.Context(), UserContextKey, claims)
-			r = r.WithContext(ctx)
+		claims, ok := token.Claims.(jwt.MapClaims)
+		if !ok {
+			http.Error(w, `{"error": "Invalid token"}`, http.StatusForbidden)
+			return
+		}
+		jti, _ := claims["jti"].(string)
+		sid, _ := claims["sid"].(string)
+		// все выдаваемые токены привязаны к сессии; токен без неё не мог быть выдан сервером
+		if sid == "" {
+			http.Error(w, `{"error": "Malformed token"}`, http.StatusUnauthorized)
+			return
+		}
+		revoked, err := o.Store.IsTokenRevoked(r.Context(), jti, sid)
+		if err != nil {
+			http.Error(w, `{"error": "Something went wrong"}`, http.StatusInternalServerError)
+			return
+		}
+		if jti == "" || revoked {
+			http.Error(w, `{"error": "Token revoked"}`, http.StatusUnauthorized)
+			return
+		}
+		ctx := context.WithValue(r.Context(), UserContextKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireRole пропускает только пользователей с указанной ролью; используется внутри AuthMiddleware
+func RequireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(UserContextKey).(jwt.MapClaims)
+		if !ok {
+			http.Error(w, `{"error": "Invalid user data"}`, http.StatusInternalServerError)
+			return
+		}
+		if userRole, _ := claims["role"].(string); userRole != role {
+			http.Error(w, `{"error": "Forbidden"}`, http.StatusForbidden)
+			return
 		}
 		next.ServeHTTP(w, r)
 	})
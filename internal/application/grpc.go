@@ -0,0 +1,239 @@
+package application
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"time"
+	"yandexlyceum/internal/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type taskServer struct {
+	pb.UnimplementedTaskServiceServer
+	o *Orchestrator
+}
+
+func NewGRPCServer(o *Orchestrator) *grpc.Server {
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(o.unaryAuthInterceptor),
+		grpc.StreamInterceptor(o.streamAuthInterceptor),
+	)
+	pb.RegisterTaskServiceServer(server, &taskServer{o: o})
+	return server
+}
+
+func (s *taskServer) GetTask(ctx context.Context, req *pb.GetTaskRequest) (*pb.GetTaskResponse, error) {
+	max := int(req.GetMax())
+	if max < 1 {
+		max = 1
+	}
+	wait := time.Duration(req.GetWaitMs()) * time.Millisecond
+	if wait > maxTaskWait {
+		wait = maxTaskWait
+	}
+	agentID, ok := resolveAgentID(ctx, req.GetAgentId())
+	if !ok {
+		return nil, status.Error(codes.PermissionDenied, "token belongs to another agent")
+	}
+	tasks := s.o.waitForTasks(ctx, agentID, max, wait)
+	resp := &pb.GetTaskResponse{Tasks: make([]*pb.Task, 0, len(tasks))}
+	for _, task := range tasks {
+		resp.Tasks = append(resp.Tasks, taskToProto(task))
+	}
+	return resp, nil
+}
+
+func (s *taskServer) SubmitResult(ctx context.Context, req *pb.SubmitResultRequest) (*pb.SubmitResultResponse, error) {
+	results := make([]TaskResult, 0, len(req.GetResults()))
+	for _, result := range req.GetResults() {
+		results = append(results, resultFromProto(result))
+	}
+	resp := &pb.SubmitResultResponse{}
+	for _, status := range s.o.submitResults(tokenAgentID(ctx), results) {
+		resp.Statuses = append(resp.Statuses, &pb.ResultStatus{Id: status.ID, Status: status.Status})
+	}
+	return resp, nil
+}
+
+func (s *taskServer) Stream(stream pb.TaskService_StreamServer) error {
+	ctx := stream.Context()
+	var sendMu sync.Mutex
+	send := func(msg *pb.OrchestratorMessage) error {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		return stream.Send(msg)
+	}
+
+	type readyMsg struct {
+		agentID string
+		n       int
+	}
+	ready := make(chan readyMsg, 1)
+	errs := make(chan error, 2)
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			switch payload := msg.GetPayload().(type) {
+			case *pb.AgentMessage_Ready:
+				if payload.Ready <= 0 {
+					errs <- status.Error(codes.InvalidArgument, "ready must be positive")
+					return
+				}
+				agentID, ok := resolveAgentID(ctx, msg.GetAgentId())
+				if !ok {
+					errs <- status.Error(codes.PermissionDenied, "token belongs to another agent")
+					return
+				}
+				select {
+				case ready <- readyMsg{agentID: agentID, n: int(payload.Ready)}:
+				case <-ctx.Done():
+					return
+				}
+			case *pb.AgentMessage_Result:
+				resultStatus := s.o.submitResults(tokenAgentID(ctx), []TaskResult{resultFromProto(payload.Result)})[0]
+				err := send(&pb.OrchestratorMessage{
+					Payload: &pb.OrchestratorMessage_Status{
+						Status: &pb.ResultStatus{Id: resultStatus.ID, Status: resultStatus.Status},
+					},
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}
+	}()
+
+	agentID := ""
+	credits := 0
+	for {
+		if credits == 0 {
+			select {
+			case msg := <-ready:
+				agentID = msg.agentID
+				credits = s.addCredits(agentID, credits, msg.n)
+				continue
+			case err := <-errs:
+				return streamErr(err)
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		select {
+		case msg := <-ready:
+			agentID = msg.agentID
+			credits = s.addCredits(agentID, credits, msg.n)
+		case err := <-errs:
+			return streamErr(err)
+		default:
+		}
+		tasks := s.o.waitForTasks(ctx, agentID, credits, time.Second)
+		if ctx.Err() != nil {
+			return nil
+		}
+		for _, task := range tasks {
+			if err := send(&pb.OrchestratorMessage{Payload: &pb.OrchestratorMessage_Task{Task: taskToProto(task)}}); err != nil {
+				log.Printf("Failed to stream task %s: %v", task.ID, err)
+				return err
+			}
+		}
+		credits -= len(tasks)
+	}
+}
+
+// addCredits прибавляет к кредитам потока n свободных воркеров агента. Кредиты не превышают
+// мощность зарегистрированного агента (для незарегистрированного - TaskBatchMax), чтобы клиент
+// не мог заставить оркестратор выдать ему неограниченное число задач
+func (s *taskServer) addCredits(agentID string, credits, n int) int {
+	s.o.mu.Lock()
+	defer s.o.mu.Unlock()
+	limit := s.o.Config.TaskBatchMax
+	if agent, ok := s.o.agents[agentID]; ok {
+		limit = agent.ComputingPower
+	}
+	return min(credits+n, limit)
+}
+
+func (s *taskServer) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.RegisterResponse, error) {
+	if req.GetId() == "" || req.GetComputingPower() < 1 {
+		return nil, status.Error(codes.InvalidArgument, "invalid registration")
+	}
+	if _, ok := resolveAgentID(ctx, req.GetId()); !ok {
+		return nil, status.Error(codes.PermissionDenied, "token belongs to another agent")
+	}
+	s.o.mu.Lock()
+	s.o.registerAgent(AgentRegistration{
+		ID:             req.GetId(),
+		ComputingPower: int(req.GetComputingPower()),
+		Operations:     req.GetOperations(),
+	})
+	s.o.mu.Unlock()
+	return &pb.RegisterResponse{}, nil
+}
+
+func (s *taskServer) Heartbeat(ctx context.Context, req *pb.HeartbeatRequest) (*pb.HeartbeatResponse, error) {
+	if _, ok := resolveAgentID(ctx, req.GetId()); !ok {
+		return nil, status.Error(codes.PermissionDenied, "token belongs to another agent")
+	}
+	s.o.mu.Lock()
+	ok := s.o.heartbeat(req.GetId())
+	s.o.mu.Unlock()
+	if !ok {
+		return nil, status.Error(codes.NotFound, "agent not registered")
+	}
+	return &pb.HeartbeatResponse{}, nil
+}
+
+func streamErr(err error) error {
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func taskToProto(task *Task) *pb.Task {
+	return &pb.Task{
+		Id:            task.ID,
+		Arg1:          task.Arg1,
+		Arg2:          task.Arg2,
+		Args:          task.Args,
+		Operation:     task.Operation,
+		OperationTime: int32(task.OperationTime),
+	}
+}
+
+func taskFromProto(task *pb.Task) *Task {
+	return &Task{
+		ID:            task.GetId(),
+		Arg1:          task.GetArg1(),
+		Arg2:          task.GetArg2(),
+		Args:          task.GetArgs(),
+		Operation:     task.GetOperation(),
+		OperationTime: int(task.GetOperationTime()),
+	}
+}
+
+func resultToProto(result TaskResult) *pb.TaskResult {
+	msg := &pb.TaskResult{Id: result.ID, Result: result.Result}
+	if result.Error != nil {
+		msg.Error = &pb.TaskError{Code: result.Error.Code, Message: result.Error.Message}
+	}
+	return msg
+}
+
+func resultFromProto(msg *pb.TaskResult) TaskResult {
+	result := TaskResult{ID: msg.GetId(), Result: msg.GetResult()}
+	if msg.GetError() != nil {
+		result.Error = &TaskError{Code: msg.GetError().GetCode(), Message: msg.GetError().GetMessage()}
+	}
+	return result
+}
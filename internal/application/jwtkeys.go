@@ -0,0 +1,96 @@
+package application
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// KeySet - набор ключей подписи JWT. Токены подписываются активным ключом, а проверяются
+// любым ключом из набора, поэтому при ротации старые токены остаются действительными до истечения срока
+type KeySet struct {
+	ActiveID string
+	Keys     map[string][]byte
+}
+
+// LoadKeySet читает ключи из файла JWT_KEYS_FILE, переменной JWT_KEYS или JWT_SECRET.
+// Формат JWT_KEYS и файла - пары kid=secret через запятую или перевод строки;
+// активный ключ задаётся JWT_ACTIVE_KID, по умолчанию - первый в списке
+func LoadKeySet() (*KeySet, error) {
+	var spec string
+	if path := os.Getenv("JWT_KEYS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading JWT keys file: %w", err)
+		}
+		spec = string(data)
+	} else if keys := os.Getenv("JWT_KEYS"); keys != "" {
+		spec = keys
+	} else if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		return &KeySet{ActiveID: "default", Keys: map[string][]byte{"default": []byte(secret)}}, nil
+	} else {
+		secret, err := generateToken()
+		if err != nil {
+			return nil, err
+		}
+		log.Println("JWT signing key is not configured, using a random key: tokens will not survive a restart")
+		return &KeySet{ActiveID: "default", Keys: map[string][]byte{"default": []byte(secret)}}, nil
+	}
+	return ParseKeySet(spec, os.Getenv("JWT_ACTIVE_KID"))
+}
+
+func ParseKeySet(spec, activeID string) (*KeySet, error) {
+	keys := &KeySet{ActiveID: activeID, Keys: make(map[string][]byte)}
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		kid, secret, ok := strings.Cut(entry, "=")
+		kid, secret = strings.TrimSpace(kid), strings.TrimSpace(secret)
+		if !ok || kid == "" || secret == "" {
+			return nil, fmt.Errorf("invalid JWT key entry %q, expected kid=secret", entry)
+		}
+		keys.Keys[kid] = []byte(secret)
+		if keys.ActiveID == "" {
+			keys.ActiveID = kid
+		}
+	}
+	if len(keys.Keys) == 0 {
+		return nil, fmt.Errorf("no JWT keys configured")
+	}
+	if _, ok := keys.Keys[keys.ActiveID]; !ok {
+		return nil, fmt.Errorf("active JWT key %q is not in the key set", keys.ActiveID)
+	}
+	return keys, nil
+}
+
+func (k *KeySet) Sign(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = k.ActiveID
+	return token.SignedString(k.Keys[k.ActiveID])
+}
+
+func (k *KeySet) Parse(tokenString string) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, ok := k.Keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return key, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+}
+
+// durationFromEnv разбирает длительность вида "10m" или "5s"
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return value
+}
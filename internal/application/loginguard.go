@@ -0,0 +1,75 @@
+package application
+
+import (
+	"context"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func loginKey(login string) string {
+	return "login:" + login
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// lockoutDuration удваивает блокировку за каждую неудачную попытку сверх порога
+func lockoutDuration(base, limit time.Duration, over int) time.Duration {
+	if over > 30 {
+		return limit
+	}
+	lockout := base * time.Duration(1<<over)
+	if lockout > limit || lockout <= 0 {
+		return limit
+	}
+	return lockout
+}
+
+// loginRetryAfter возвращает оставшееся время блокировки входа для логина и адреса клиента
+func (o *Orchestrator) loginRetryAfter(ctx context.Context, login, ip string) (time.Duration, error) {
+	until, err := o.Store.GetLoginLock(ctx, []string{loginKey(login), "ip:" + ip})
+	if err != nil {
+		return 0, err
+	}
+	return time.Until(until), nil
+}
+
+func (o *Orchestrator) recordLoginFailure(ctx context.Context, login, ip string) error {
+	now := time.Now()
+	limits := []struct {
+		key       string
+		threshold int
+	}{
+		{loginKey(login), o.Config.LoginMaxFailures},
+		{"ip:" + ip, o.Config.LoginMaxFailuresIP},
+	}
+	for _, limit := range limits {
+		failures, err := o.Store.RecordLoginFailure(ctx, limit.key, now, now.Add(-o.Config.LoginFailureWindow))
+		if err != nil {
+			return err
+		}
+		if failures < limit.threshold {
+			continue
+		}
+		lockout := lockoutDuration(o.Config.LoginLockout, o.Config.LoginLockoutMax, failures-limit.threshold)
+		if err := o.Store.SetLoginLock(ctx, limit.key, now.Add(lockout)); err != nil {
+			return err
+		}
+		log.Printf("Login locked for %s after %d failed attempts for %s", limit.key, failures, lockout)
+	}
+	return nil
+}
+
+func writeTooManyAttempts(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, `{"error":"Too many login attempts"}`, http.StatusTooManyRequests)
+}
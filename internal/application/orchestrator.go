@@ -3,15 +3,21 @@ package application
 import (
 	"context"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 	"yandexlyceum/internal/database"
+	"yandexlyceum/pkg/calculation"
 
 	"github.com/golang-jwt/jwt/v5"
 	_ "github.com/mattn/go-sqlite3"
@@ -19,10 +25,33 @@ import (
 
 type Config struct {
 	Addr                string
+	GRPCAddr            string
 	TimeAddition        int
 	TimeSubtraction     int
 	TimeMultiplications int
 	TimeDivisions       int
+	TimeIntDivisions    int
+	TimeModulo          int
+	TimePower           int
+	FunctionTimes       map[string]int
+	LeaseGrace          int
+	TaskBatchMax        int
+	TaskPoll            int
+	AgentTimeout        int
+	AgentSecret         string
+	DatabasePath        string
+	DatabaseDSN         string
+	JWTKeys             *KeySet
+	TokenTTL            time.Duration
+	TokenNotBefore      time.Duration
+	RefreshTTL          time.Duration
+	LoginMaxFailures    int
+	LoginMaxFailuresIP  int
+	LoginFailureWindow  time.Duration
+	LoginLockout        time.Duration
+	LoginLockoutMax     time.Duration
+	Credentials         CredentialsPolicy
+	TOTPIssuer          string
 }
 
 func ConfigFromEnv() *Config {
@@ -30,6 +59,10 @@ func ConfigFromEnv() *Config {
 	if port == "" {
 		port = "8080"
 	}
+	grpcPort := os.Getenv("GRPC_PORT")
+	if grpcPort == "" {
+		grpcPort = "9090"
+	}
 	ta, _ := strconv.Atoi(os.Getenv("TIME_ADDITION_MS"))
 	if ta == 0 {
 		ta = 100
@@ -46,12 +79,96 @@ func ConfigFromEnv() *Config {
 	if td == 0 {
 		td = 100
 	}
+	tid, _ := strconv.Atoi(os.Getenv("TIME_INT_DIVISIONS_MS"))
+	if tid == 0 {
+		tid = 100
+	}
+	tmod, _ := strconv.Atoi(os.Getenv("TIME_MODULO_MS"))
+	if tmod == 0 {
+		tmod = 100
+	}
+	tp, _ := strconv.Atoi(os.Getenv("TIME_POWER_MS"))
+	if tp == 0 {
+		tp = 100
+	}
+	ft := make(map[string]int)
+	for _, name := range calculation.Functions() {
+		t, _ := strconv.Atoi(os.Getenv("TIME_" + strings.ToUpper(name) + "_MS"))
+		if t == 0 {
+			t = 100
+		}
+		ft[name] = t
+	}
+	lg, _ := strconv.Atoi(os.Getenv("TASK_LEASE_GRACE_MS"))
+	if lg == 0 {
+		lg = 5000
+	}
+	tbm, _ := strconv.Atoi(os.Getenv("TASK_BATCH_MAX"))
+	if tbm <= 0 {
+		tbm = 64
+	}
+	tpoll, _ := strconv.Atoi(os.Getenv("TASK_POLL_MS"))
+	if tpoll <= 0 {
+		tpoll = 500
+	}
+	at, _ := strconv.Atoi(os.Getenv("AGENT_TIMEOUT_MS"))
+	if at == 0 {
+		at = 15000
+	}
+	dbPath := os.Getenv("DATABASE_PATH")
+	if dbPath == "" {
+		dbPath = "finalTask.db"
+	}
+	// DATABASE_DSN вида postgres://... подключает PostgreSQL; без него используется файл SQLite из DATABASE_PATH
+	dbDSN := os.Getenv("DATABASE_DSN")
+	if dbDSN == "" {
+		dbDSN = dbPath
+	}
+	lmf, _ := strconv.Atoi(os.Getenv("LOGIN_MAX_FAILURES"))
+	if lmf == 0 {
+		lmf = 5
+	}
+	lmfIP, _ := strconv.Atoi(os.Getenv("LOGIN_MAX_FAILURES_IP"))
+	if lmfIP == 0 {
+		lmfIP = 20
+	}
+	jwtKeys, err := LoadKeySet()
+	if err != nil {
+		log.Fatalf("Failed to load JWT keys: %v", err)
+	}
+	totpIssuer := os.Getenv("TOTP_ISSUER")
+	if totpIssuer == "" {
+		totpIssuer = "Calculator"
+	}
 	return &Config{
 		Addr:                port,
+		GRPCAddr:            grpcPort,
 		TimeAddition:        ta,
 		TimeSubtraction:     ts,
 		TimeMultiplications: tm,
 		TimeDivisions:       td,
+		TimeIntDivisions:    tid,
+		TimeModulo:          tmod,
+		TimePower:           tp,
+		FunctionTimes:       ft,
+		LeaseGrace:          lg,
+		TaskBatchMax:        tbm,
+		TaskPoll:            tpoll,
+		AgentTimeout:        at,
+		AgentSecret:         os.Getenv("AGENT_SECRET"),
+		DatabasePath:        dbPath,
+		DatabaseDSN:         dbDSN,
+		JWTKeys:             jwtKeys,
+		TokenTTL:            durationFromEnv("JWT_TTL", 10*time.Minute),
+		TokenNotBefore:      durationFromEnv("JWT_NOT_BEFORE", 5*time.Second),
+		RefreshTTL:          durationFromEnv("JWT_REFRESH_TTL", 30*24*time.Hour),
+		LoginMaxFailures:    lmf,
+		LoginMaxFailuresIP:  lmfIP,
+		LoginFailureWindow:  durationFromEnv("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+		LoginLockout:        durationFromEnv("LOGIN_LOCKOUT", time.Minute),
+		LoginLockoutMax:     durationFromEnv("LOGIN_LOCKOUT_MAX", time.Hour),
+		Credentials:         PolicyFromEnv(),
+		TOTPIssuer:          totpIssuer,
 	}
 }
 
@@ -60,41 +177,68 @@ type Registration struct {
 	Password string
 }
 
+// Orchestrator хранит выражения и очередь задач в Store, поэтому с одной базой могут работать
+// несколько экземпляров. В памяти остаются только реестр агентов и taskReady, который будит
+// агентов, ожидающих задач на этом экземпляре
 type Orchestrator struct {
-	Config      *Config
-	exprStore   map[string]*Expression
-	taskStore   map[string]*Task
-	taskQueue   []*Task
-	mu          sync.Mutex
-	exprCounter int64
-	taskCounter int64
-	Db          *sql.DB
+	Config    *Config
+	taskReady chan struct{}
+	mu        sync.Mutex
+	agents    map[string]*AgentInfo
+	Store     database.Store
+	// Now - источник времени для проверки кодов 2FA; подменяется в тестах
+	Now func() time.Time
 }
 
-func NewOrchestrator() *Orchestrator {
+// NewOrchestrator создаёт оркестратор поверх хранилища; незавершённые выражения досчитываются после RestoreState
+func NewOrchestrator(config *Config, store database.Store) *Orchestrator {
 	return &Orchestrator{
-		Config:    ConfigFromEnv(),
-		exprStore: make(map[string]*Expression),
-		taskStore: make(map[string]*Task),
-		taskQueue: make([]*Task, 0),
+		Config:    config,
+		Store:     store,
+		taskReady: make(chan struct{}),
+		agents:    make(map[string]*AgentInfo),
+		Now:       time.Now,
 	}
 }
 
-type Expression struct {
-	ID     string   `json:"id"`
-	Status string   `json:"status"`
-	Result *float64 `json:"result,omitempty"`
-	AST    *ASTNode `json:"-"`
+type TaskError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
+type TaskResult struct {
+	ID     string     `json:"id"`
+	Result float64    `json:"result"`
+	Error  *TaskError `json:"error,omitempty"`
+}
+
+func (r TaskResult) valid() bool {
+	return r.ID != "" && (r.Error == nil || r.Error.Code != "")
+}
+
+type ResultStatus struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+var (
+	ErrTaskNotFound  = errors.New("task not found")
+	ErrTaskForbidden = errors.New("task is leased to another agent")
+)
+
+// Task - задача для агента. AgentID - агент, которому задача выдана последней; после возврата
+// в очередь он не сбрасывается, чтобы поздний результат принимался только от этого агента
 type Task struct {
-	ID            string   `json:"id"`
-	ExprID        string   `json:"-"`
-	Arg1          float64  `json:"arg1"`
-	Arg2          float64  `json:"arg2"`
-	Operation     string   `json:"operation"`
-	OperationTime int      `json:"operation_time"`
-	Node          *ASTNode `json:"-"`
+	ID            string    `json:"id"`
+	ExprID        string    `json:"-"`
+	NodePath      string    `json:"-"`
+	AgentID       string    `json:"-"`
+	Arg1          float64   `json:"arg1"`
+	Arg2          float64   `json:"arg2"`
+	Args          []float64 `json:"args,omitempty"`
+	Operation     string    `json:"operation"`
+	OperationTime int       `json:"operation_time"`
+	LeaseDeadline time.Time `json:"-"`
 }
 
 func (o *Orchestrator) CalculateHandler(w http.ResponseWriter, r *http.Request) {
@@ -103,7 +247,8 @@ func (o *Orchestrator) CalculateHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	var req struct {
-		Expression string `json:"expression"`
+		Expression string             `json:"expression"`
+		Variables  map[string]float64 `json:"variables"`
 	}
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil || req.Expression == "" {
@@ -112,62 +257,89 @@ func (o *Orchestrator) CalculateHandler(w http.ResponseWriter, r *http.Request)
 	}
 	ast, err := ParseAST(req.Expression)
 	if err != nil {
+		o.audit(r, database.AuditEvent{Event: "expression_submit", Outcome: auditFailure, Details: err.Error()})
 		http.Error(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusUnprocessableEntity)
 		return
 	}
-	o.mu.Lock()
 
-	claims, ok := r.Context().Value(UserContextKey).(jwt.MapClaims)
+	userID, ok := userIDFromRequest(r)
 	if !ok {
 		http.Error(w, `{"error": "Invalid user data"}`, http.StatusInternalServerError)
 		return
 	}
 
-	userIDFloat, _ := claims["user_id"].(float64)
-	userID := int(userIDFloat)
+	variables, err := o.Store.GetVariables(context.TODO(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for name, value := range req.Variables {
+		variables[name] = value
+	}
+	if err := ResolveVariables(ast, variables); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusUnprocessableEntity)
+		return
+	}
 
-	id, err := database.AddExpression(context.TODO(), userID, req.Expression, o.Db)
+	id, err := o.Store.AddExpression(context.TODO(), userID, req.Expression)
 	if err != nil {
 		http.Error(w, `{"error":"Something went wrong"}`, http.StatusInternalServerError)
 		return
 	}
 
-	o.exprCounter = int64(id)
-	exprID := fmt.Sprintf("%d", o.exprCounter)
-	expr := &Expression{
-		ID:     exprID,
-		Status: "pending",
-		AST:    ast,
+	exprID := strconv.Itoa(id)
+	if ast.IsLeaf {
+		o.Store.AddAnswer(context.TODO(), id, ast.Value)
+	} else if err := o.startExpression(id, ast); err != nil {
+		http.Error(w, `{"error":"Something went wrong"}`, http.StatusInternalServerError)
+		return
 	}
-	o.exprStore[exprID] = expr
-	o.ScheduleTasks(expr)
-	o.mu.Unlock()
+	o.audit(r, database.AuditEvent{Event: "expression_submit", Outcome: auditSuccess, Details: "expression " + exprID})
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{"id": exprID})
 }
 
+const (
+	expressionsLimitDefault = 50
+	expressionsLimitMax     = 500
+)
+
+var expressionStatuses = []string{"pending", "in_progress", "completed", "failed"}
+
+// encodeCursor упаковывает позицию вместе с сортировкой: курсор от другой сортировки не принимается
+func encodeCursor(sort string, cursor database.ExpressionCursor) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%d:%d", sort, cursor.Key, cursor.Id)))
+}
+
+func decodeCursor(sort, value string) (*database.ExpressionCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != 3 || parts[0] != sort {
+		return nil, errors.New("cursor does not match sort")
+	}
+	var cursor database.ExpressionCursor
+	if cursor.Key, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return nil, err
+	}
+	if cursor.Id, err = strconv.Atoi(parts[2]); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+// ExpressionsHandler отдаёт выражения пользователя постранично. Параметры: status (через запятую),
+// from и to (RFC 3339, по времени создания), q (подстрока выражения), sort (id, created_at,
+// с минусом - по убыванию), limit и cursor из next_cursor предыдущей страницы
 func (o *Orchestrator) ExpressionsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, `{"error":"Wrong Method"}`, http.StatusMethodNotAllowed)
 		return
 	}
-	o.mu.Lock()
-	defer o.mu.Unlock()
-	exprs := make([]*Expression, 0, len(o.exprStore))
-	for _, expr := range o.exprStore {
-		if expr.AST != nil && expr.AST.IsLeaf {
-			expr.Status = "completed"
-			expr.Result = &expr.AST.Value
-		}
-		exprs = append(exprs, expr)
-	}
-	for _, expression := range exprs {
-		id, _ := strconv.Atoi(expression.ID)
-		database.AddAnswer(context.TODO(), id, float64(*expression.Result), o.Db)
-	}
-
 	claims, ok := r.Context().Value(UserContextKey).(jwt.MapClaims)
 	if !ok {
 		http.Error(w, `{"error": "Invalid user data"}`, http.StatusInternalServerError)
@@ -177,17 +349,77 @@ func (o *Orchestrator) ExpressionsHandler(w http.ResponseWriter, r *http.Request
 	userIDFloat, _ := claims["user_id"].(float64)
 	userID := int(userIDFloat)
 
-	answ, err := database.GetExpressions(userID, o.Db)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	query := r.URL.Query()
+	filter := database.ExpressionFilter{
+		Search: query.Get("q"),
+		SortBy: database.SortByID,
+		Limit:  expressionsLimitDefault,
+	}
+	var err error
+	if v := query.Get("status"); v != "" {
+		for _, status := range strings.Split(v, ",") {
+			if !slices.Contains(expressionStatuses, status) {
+				http.Error(w, `{"error":"Invalid status"}`, http.StatusUnprocessableEntity)
+				return
+			}
+			filter.Statuses = append(filter.Statuses, status)
+		}
+	}
+	if v := query.Get("from"); v != "" {
+		if filter.From, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, `{"error":"Invalid from"}`, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		if filter.To, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, `{"error":"Invalid to"}`, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	sort := query.Get("sort")
+	if sort == "" {
+		sort = database.SortByID
+	}
+	filter.SortBy, filter.Desc = strings.TrimPrefix(sort, "-"), strings.HasPrefix(sort, "-")
+	if filter.SortBy != database.SortByID && filter.SortBy != database.SortByCreatedAt {
+		http.Error(w, `{"error":"Invalid sort"}`, http.StatusUnprocessableEntity)
 		return
 	}
-	if len(answ) == 0 {
-		http.Error(w, `{"error":"No expressions"}`, http.StatusNotFound)
+	if v := query.Get("limit"); v != "" {
+		filter.Limit, err = strconv.Atoi(v)
+		if err != nil || filter.Limit < 1 || filter.Limit > expressionsLimitMax {
+			http.Error(w, `{"error":"Invalid limit"}`, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	if v := query.Get("cursor"); v != "" {
+		if filter.After, err = decodeCursor(sort, v); err != nil {
+			http.Error(w, `{"error":"Invalid cursor"}`, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	// лишняя строка показывает, есть ли следующая страница
+	limit := filter.Limit
+	filter.Limit++
+	answ, err := o.Store.GetExpressions(context.TODO(), userID, filter)
+	if err != nil {
+		http.Error(w, `{"error":"Something went wrong"}`, http.StatusInternalServerError)
 		return
 	}
+	if answ == nil {
+		// пустая страница - обычный ответ списка, а не ошибка
+		answ = []database.Expression{}
+	}
+	resp := map[string]interface{}{}
+	if len(answ) > limit {
+		answ = answ[:limit]
+		resp["next_cursor"] = encodeCursor(sort, filter.CursorOf(answ[limit-1]))
+	}
+	resp["expressions"] = answ
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{"expressions": answ})
+	json.NewEncoder(w).Encode(resp)
 }
 
 func (o *Orchestrator) ExpressionByIDHandler(w http.ResponseWriter, r *http.Request) {
@@ -212,7 +444,11 @@ func (o *Orchestrator) ExpressionByIDHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	res_expr, err := database.GetExpressionByID(context.TODO(), userID, intId, o.Db)
+	res_expr, err := o.Store.GetExpressionByID(context.TODO(), userID, intId)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, `{"error":"Expression not found"}`, http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -227,19 +463,37 @@ func (o *Orchestrator) GetTaskHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"error":"Wrong Method"}`, http.StatusMethodNotAllowed)
 		return
 	}
-	o.mu.Lock()
-	defer o.mu.Unlock()
-	if len(o.taskQueue) == 0 {
-		http.Error(w, `{"error":"No task available"}`, http.StatusNotFound)
+	batch := r.URL.Query().Has("max")
+	max := 1
+	if batch {
+		var err error
+		max, err = strconv.Atoi(r.URL.Query().Get("max"))
+		if err != nil || max < 1 {
+			http.Error(w, `{"error":"Invalid max"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	wait, err := parseWait(r.URL.Query().Get("wait"))
+	if err != nil {
+		http.Error(w, `{"error":"Invalid wait"}`, http.StatusBadRequest)
+		return
+	}
+	agentID, ok := resolveAgentID(r.Context(), r.URL.Query().Get("agent"))
+	if !ok {
+		http.Error(w, `{"error":"Token belongs to another agent"}`, http.StatusForbidden)
 		return
 	}
-	task := o.taskQueue[0]
-	o.taskQueue = o.taskQueue[1:]
-	if expr, exists := o.exprStore[task.ExprID]; exists {
-		expr.Status = "in_progress"
+	tasks := o.waitForTasks(r.Context(), agentID, max, wait)
+	if len(tasks) == 0 {
+		http.Error(w, `{"error":"No task available"}`, http.StatusNotFound)
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{"task": task})
+	if batch {
+		json.NewEncoder(w).Encode(map[string]interface{}{"tasks": tasks})
+	} else {
+		json.NewEncoder(w).Encode(map[string]interface{}{"task": tasks[0]})
+	}
 }
 
 func (o *Orchestrator) PostTaskHandler(w http.ResponseWriter, r *http.Request) {
@@ -248,77 +502,419 @@ func (o *Orchestrator) PostTaskHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var req struct {
-		ID     string  `json:"id"`
-		Result float64 `json:"result"`
+		TaskResult
+		Results []TaskResult `json:"results"`
 	}
 	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil || req.ID == "" {
+	if err != nil {
 		http.Error(w, `{"error":"Invalid Body"}`, http.StatusUnprocessableEntity)
 		return
 	}
+	if req.Results == nil {
+		if !req.TaskResult.valid() {
+			http.Error(w, `{"error":"Invalid Body"}`, http.StatusUnprocessableEntity)
+			return
+		}
+		err := o.submitResult(tokenAgentID(r.Context()), req.TaskResult)
+		if errors.Is(err, ErrTaskForbidden) {
+			http.Error(w, `{"error":"Task is leased to another agent"}`, http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, `{"error":"Task not found"}`, http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		if req.Error != nil {
+			w.Write([]byte(`{"status":"Failure accepted"}`))
+		} else {
+			w.Write([]byte(`{"status":"Result accepted"}`))
+		}
+		return
+	}
+
+	statuses := o.submitResults(tokenAgentID(r.Context()), req.Results)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": statuses})
+}
+
+const maxTaskWait = 60 * time.Second
+
+// parseWait разбирает параметр wait: длительность вида "30s" или целое число секунд
+func parseWait(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, convErr := strconv.Atoi(value)
+		if convErr != nil {
+			return 0, err
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+	if wait < 0 {
+		return 0, fmt.Errorf("negative wait")
+	}
+	if wait > maxTaskWait {
+		wait = maxTaskWait
+	}
+	return wait, nil
+}
+
+// notifyTasks будит агентов, ожидающих задач на этом экземпляре
+func (o *Orchestrator) notifyTasks() {
 	o.mu.Lock()
-	task, ok := o.taskStore[req.ID]
-	if !ok {
+	defer o.mu.Unlock()
+	close(o.taskReady)
+	o.taskReady = make(chan struct{})
+}
+
+// waitForTasks выдаёт до max задач, ожидая их появления не дольше wait. Задачи, поставленные
+// этим экземпляром, будят ожидание сразу, поставленные другими - находятся опросом раз в TaskPoll
+func (o *Orchestrator) waitForTasks(ctx context.Context, agentID string, max int, wait time.Duration) []*Task {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	interval := time.Duration(o.Config.TaskPoll) * time.Millisecond
+	if interval <= 0 {
+		interval = 500 * time.Millisecond
+	}
+	poll := time.NewTicker(interval)
+	defer poll.Stop()
+	for {
+		o.mu.Lock()
+		ready := o.taskReady
 		o.mu.Unlock()
-		http.Error(w, `{"error":"Task not found"}`, http.StatusNotFound)
-		return
+		tasks := o.leaseTasks(agentID, max)
+		if len(tasks) > 0 || wait == 0 {
+			return tasks
+		}
+		select {
+		case <-ready:
+		case <-poll.C:
+		case <-timer.C:
+			return o.leaseTasks(agentID, max)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// taskBatchLimit ограничивает размер выдачи сверху: не больше TaskBatchMax и не больше
+// мощности зарегистрированного агента, сколько бы задач он ни запросил; вызывается под o.mu
+func (o *Orchestrator) taskBatchLimit(agentID string, max int) int {
+	if max > o.Config.TaskBatchMax {
+		max = o.Config.TaskBatchMax
+	}
+	if agent, ok := o.agents[agentID]; ok && max > agent.ComputingPower {
+		max = agent.ComputingPower
+	}
+	return max
+}
+
+// leaseTasks выдаёт агенту до max задач из очереди, которые он умеет считать
+func (o *Orchestrator) leaseTasks(agentID string, max int) []*Task {
+	o.mu.Lock()
+	max = o.taskBatchLimit(agentID, max)
+	var operations []string
+	if agent, ok := o.agents[agentID]; ok {
+		agent.LastSeen = time.Now()
+		agent.Status = "online"
+		operations = agent.Operations
+	}
+	o.mu.Unlock()
+	deadline := time.Now().Add(time.Duration(o.Config.LeaseGrace) * time.Millisecond)
+	records, err := o.Store.LeaseTasks(context.TODO(), agentID, operations, max, deadline)
+	if err != nil {
+		log.Printf("Failed to lease tasks: %v", err)
+		return nil
+	}
+	tasks := make([]*Task, 0, len(records))
+	for _, record := range records {
+		tasks = append(tasks, newTask(record))
+	}
+	return tasks
+}
+
+// submitResults применяет результаты от агента agentID ("" - агент с общим секретом)
+func (o *Orchestrator) submitResults(agentID string, results []TaskResult) []ResultStatus {
+	statuses := make([]ResultStatus, 0, len(results))
+	for _, result := range results {
+		status := "accepted"
+		if !result.valid() {
+			status = "invalid"
+		} else if err := o.submitResult(agentID, result); errors.Is(err, ErrTaskForbidden) {
+			status = "forbidden"
+		} else if err != nil {
+			status = "not_found"
+		}
+		statuses = append(statuses, ResultStatus{ID: result.ID, Status: status})
+	}
+	return statuses
+}
+
+// submitResult применяет результат или ошибку задачи под блокировкой её выражения в Store.
+// Агент с персональным токеном может прислать результат только задачи, которая выдана ему
+func (o *Orchestrator) submitResult(agentID string, result TaskResult) error {
+	taskID, err := strconv.Atoi(result.ID)
+	if err != nil {
+		return ErrTaskNotFound
+	}
+	record, err := o.Store.GetTask(context.TODO(), taskID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrTaskNotFound
+	}
+	if err != nil {
+		log.Printf("Failed to load task %s: %v", result.ID, err)
+		return err
+	}
+	var owner string
+	var scheduled int
+	err = o.Store.UpdateExpression(context.TODO(), record.ExpressionId, func(state database.ExpressionState, tasks []database.TaskRecord) (database.ExpressionUpdate, error) {
+		i := slices.IndexFunc(tasks, func(task database.TaskRecord) bool { return task.Id == taskID })
+		if i < 0 {
+			return database.ExpressionUpdate{}, ErrTaskNotFound
+		}
+		task := tasks[i]
+		if agentID != "" && task.AgentId != agentID {
+			log.Printf("Rejected result for task %d from agent %s: task is leased to %q", task.Id, agentID, task.AgentId)
+			return database.ExpressionUpdate{}, ErrTaskForbidden
+		}
+		if task.LeaseDeadline.IsZero() {
+			// аренда истекла и задача уже снова в очереди: результат детерминирован,
+			// поэтому принимаем его, и задача удаляется, чтобы не считать её дважды
+			log.Printf("Accepted late result for task %d", task.Id)
+		}
+		owner = task.AgentId
+		if result.Error != nil {
+			message := result.Error.Message
+			if message == "" {
+				message = result.Error.Code
+			}
+			log.Printf("Expression %d failed: %s (%s)", state.Id, message, result.Error.Code)
+			return database.ExpressionUpdate{Status: "failed", Error: message}, nil
+		}
+		var ast ASTNode
+		if err := json.Unmarshal([]byte(state.AST), &ast); err != nil {
+			return database.ExpressionUpdate{}, fmt.Errorf("decode AST of expression %d: %w", state.Id, err)
+		}
+		node := ast.nodeAt(task.NodePath)
+		if node == nil {
+			return database.ExpressionUpdate{}, ErrTaskNotFound
+		}
+		node.IsLeaf = true
+		node.Value = result.Result
+		update, err := o.nextStep(state, &ast, slices.Delete(tasks, i, i+1))
+		update.DeleteTasks = []int{task.Id}
+		scheduled = len(update.AddTasks)
+		return update, err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrTaskNotFound
 	}
-	task.Node.IsLeaf = true
-	task.Node.Value = req.Result
-	delete(o.taskStore, req.ID)
-	if expr, exists := o.exprStore[task.ExprID]; exists {
-		o.ScheduleTasks(expr)
-		if expr.AST.IsLeaf {
-			expr.Status = "completed"
-			expr.Result = &expr.AST.Value
+	if err != nil {
+		if !errors.Is(err, ErrTaskNotFound) && !errors.Is(err, ErrTaskForbidden) {
+			log.Printf("Failed to apply result of task %s: %v", result.ID, err)
 		}
+		return err
+	}
+	o.mu.Lock()
+	if agent, ok := o.agents[owner]; ok {
+		agent.recordResult(result)
 	}
 	o.mu.Unlock()
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"status":"Result accepted"}`))
+	if scheduled > 0 {
+		o.notifyTasks()
+	}
+	return nil
+}
+
+// RestoreState досчитывает незавершённые выражения: сверяет их задачи с деревом и ставит
+// недостающие. Выданные агентам задачи остаются за ними до истечения аренды
+func (o *Orchestrator) RestoreState() error {
+	states, err := o.Store.GetUnfinishedExpressions(context.TODO())
+	if err != nil {
+		return err
+	}
+	for _, state := range states {
+		o.scheduleOrFail(state.Id)
+	}
+	log.Printf("Restored %d expressions", len(states))
+	return nil
+}
+
+// RequeueExpiredTasks возвращает в очередь задачи с истёкшей арендой, выданные любым экземпляром
+func (o *Orchestrator) RequeueExpiredTasks() {
+	ids, err := o.Store.RequeueExpiredTasks(context.TODO(), time.Now())
+	if err != nil {
+		log.Printf("Failed to requeue expired tasks: %v", err)
+		return
+	}
+	for _, id := range ids {
+		log.Printf("Lease for task %d expired, task requeued", id)
+	}
+	if len(ids) > 0 {
+		o.notifyTasks()
+	}
+}
+
+func (o *Orchestrator) operationTime(operation string) int {
+	switch operation {
+	case "+":
+		return o.Config.TimeAddition
+	case "-":
+		return o.Config.TimeSubtraction
+	case "*":
+		return o.Config.TimeMultiplications
+	case "/":
+		return o.Config.TimeDivisions
+	case "//":
+		return o.Config.TimeIntDivisions
+	case "%":
+		return o.Config.TimeModulo
+	case "^":
+		return o.Config.TimePower
+	}
+	if opTime, ok := o.Config.FunctionTimes[operation]; ok {
+		return opTime
+	}
+	return 100
+}
+
+func newTask(record database.TaskRecord) *Task {
+	return &Task{
+		ID:            strconv.Itoa(record.Id),
+		ExprID:        strconv.Itoa(record.ExpressionId),
+		NodePath:      record.NodePath,
+		AgentID:       record.AgentId,
+		Arg1:          record.Arg1,
+		Arg2:          record.Arg2,
+		Args:          record.Args,
+		Operation:     record.Operation,
+		OperationTime: record.OperationTime,
+		LeaseDeadline: record.LeaseDeadline,
+	}
 }
 
-func (o *Orchestrator) ScheduleTasks(expr *Expression) {
-	var traverse func(node *ASTNode)
-	traverse = func(node *ASTNode) {
-		if node == nil || node.IsLeaf {
+// planTasks возвращает задачи для готовых узлов дерева, у которых ещё нет задачи среди tasks
+func (o *Orchestrator) planTasks(exprID int, ast *ASTNode, tasks []database.TaskRecord) []database.TaskRecord {
+	scheduled := make(map[string]bool, len(tasks))
+	for _, task := range tasks {
+		scheduled[task.NodePath] = true
+	}
+	var planned []database.TaskRecord
+	var traverse func(node *ASTNode, path string)
+	traverse = func(node *ASTNode, path string) {
+		if node == nil || node.IsLeaf || node.Variable != "" {
+			return
+		}
+		ready := true
+		for i, child := range node.children() {
+			traverse(child, childPath(path, i))
+			if child == nil || !child.IsLeaf {
+				ready = false
+			}
+		}
+		if !ready || scheduled[path] {
 			return
 		}
-		traverse(node.Left)
-		traverse(node.Right)
-		if node.Left != nil && node.Right != nil && node.Left.IsLeaf && node.Right.IsLeaf {
-			if !node.TaskScheduled {
-				o.taskCounter++
-				taskID := fmt.Sprintf("%d", o.taskCounter)
-				var opTime int
-				switch node.Operator {
-				case "+":
-					opTime = o.Config.TimeAddition
-				case "-":
-					opTime = o.Config.TimeSubtraction
-				case "*":
-					opTime = o.Config.TimeMultiplications
-				case "/":
-					opTime = o.Config.TimeDivisions
-				default:
-					opTime = 100
-				}
-				task := &Task{
-					ID:            taskID,
-					ExprID:        expr.ID,
-					Arg1:          node.Left.Value,
-					Arg2:          node.Right.Value,
-					Operation:     node.Operator,
-					OperationTime: opTime,
-					Node:          node,
-				}
-				node.TaskScheduled = true
-				o.taskStore[taskID] = task
-				o.taskQueue = append(o.taskQueue, task)
+		record := database.TaskRecord{
+			ExpressionId: exprID,
+			NodePath:     path,
+		}
+		if node.Function != "" {
+			record.Operation = node.Function
+			for _, arg := range node.Args {
+				record.Args = append(record.Args, arg.Value)
+			}
+		} else {
+			record.Operation = node.Operator
+			record.Arg1 = node.Left.Value
+			record.Arg2 = node.Right.Value
+		}
+		record.OperationTime = o.operationTime(record.Operation)
+		planned = append(planned, record)
+	}
+	traverse(ast, "")
+	return planned
+}
+
+// nextStep - изменения выражения после очередного посчитанного узла: если посчитан корень,
+// выражение завершается, иначе сохраняется дерево и ставятся задачи для готовых узлов
+func (o *Orchestrator) nextStep(state database.ExpressionState, ast *ASTNode, tasks []database.TaskRecord) (database.ExpressionUpdate, error) {
+	if ast.IsLeaf {
+		return database.ExpressionUpdate{Status: "completed", Result: ast.Value}, nil
+	}
+	encoded, err := json.Marshal(ast)
+	if err != nil {
+		return database.ExpressionUpdate{}, fmt.Errorf("encode AST of expression %d: %w", state.Id, err)
+	}
+	return database.ExpressionUpdate{
+		Status:   state.Status,
+		AST:      string(encoded),
+		AddTasks: o.planTasks(state.Id, ast, tasks),
+	}, nil
+}
+
+// ScheduleTasks сверяет задачи выражения с его деревом под блокировкой выражения в Store:
+// удаляет задачи уже посчитанных узлов и ставит задачи для готовых, у которых их ещё нет.
+// Поэтому вызов с нескольких экземпляров одновременно не создаёт одну задачу дважды
+func (o *Orchestrator) ScheduleTasks(id int) error {
+	var scheduled int
+	err := o.Store.UpdateExpression(context.TODO(), id, func(state database.ExpressionState, tasks []database.TaskRecord) (database.ExpressionUpdate, error) {
+		if state.Status != "pending" && state.Status != "in_progress" {
+			return database.ExpressionUpdate{}, nil
+		}
+		var ast ASTNode
+		if err := json.Unmarshal([]byte(state.AST), &ast); err != nil {
+			return database.ExpressionUpdate{}, fmt.Errorf("decode AST of expression %d: %w", id, err)
+		}
+		var live []database.TaskRecord
+		var stale []int
+		for _, task := range tasks {
+			if node := ast.nodeAt(task.NodePath); node == nil || node.IsLeaf {
+				stale = append(stale, task.Id)
+			} else {
+				live = append(live, task)
 			}
 		}
+		update, err := o.nextStep(state, &ast, live)
+		update.DeleteTasks = stale
+		scheduled = len(update.AddTasks)
+		return update, err
+	})
+	if err != nil {
+		return fmt.Errorf("schedule tasks of expression %d: %w", id, err)
+	}
+	if scheduled > 0 {
+		o.notifyTasks()
+	}
+	return nil
+}
+
+// scheduleOrFail планирует задачи выражения, а если это не удалось, помечает выражение
+// проваленным, чтобы оно не зависло в pending
+func (o *Orchestrator) scheduleOrFail(id int) error {
+	err := o.ScheduleTasks(id)
+	if err != nil {
+		log.Printf("Failed to schedule tasks: %v", err)
+		if err := o.Store.AddError(context.TODO(), id, "failed to schedule task"); err != nil {
+			log.Printf("Failed to save error for expression %d: %v", id, err)
+		}
+	}
+	return err
+}
+
+// startExpression сохраняет дерево нового выражения и ставит задачи для его готовых узлов
+func (o *Orchestrator) startExpression(id int, ast *ASTNode) error {
+	encoded, err := json.Marshal(ast)
+	if err != nil {
+		return err
 	}
-	traverse(expr.AST)
+	if err := o.Store.SaveExpressionState(context.TODO(), id, "pending", string(encoded)); err != nil {
+		return err
+	}
+	return o.scheduleOrFail(id)
 }
 
 func (o *Orchestrator) AgentHandler(w http.ResponseWriter, r *http.Request) {
@@ -341,16 +937,29 @@ func (o *Orchestrator) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, `{"error":"Error decoding JSON"}`, http.StatusBadRequest)
 			return
 		}
+		if err := o.Config.Credentials.ValidateLogin(data.Login); err != nil {
+			o.audit(r, database.AuditEvent{Event: "register", Actor: data.Login, Outcome: auditFailure, Details: err.Error()})
+			http.Error(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusUnprocessableEntity)
+			return
+		}
+		if err := o.Config.Credentials.ValidatePassword(data.Password); err != nil {
+			o.audit(r, database.AuditEvent{Event: "register", Actor: data.Login, Outcome: auditFailure, Details: err.Error()})
+			http.Error(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusUnprocessableEntity)
+			return
+		}
 		generatedPassword, err := GeneratePassword(data.Password)
 		if err != nil {
 			http.Error(w, `{"error":"Error encoding password"}`, http.StatusInternalServerError)
+			return
 		}
-		err = database.InsertUsers(context.TODO(), data.Login, generatedPassword, o.Db)
+		err = o.Store.InsertUsers(context.TODO(), data.Login, generatedPassword)
 		if err != nil {
+			o.audit(r, database.AuditEvent{Event: "register", Actor: data.Login, Outcome: auditFailure})
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		} else {
 			log.Printf("User with login '%s' successfully added\n", data.Login)
+			o.audit(r, database.AuditEvent{Event: "register", ActorId: o.Store.GetUserID(context.TODO(), data.Login), Actor: data.Login, Outcome: auditSuccess})
 			http.Error(w, "successful registration", http.StatusOK)
 		}
 	}
@@ -366,57 +975,119 @@ func (o *Orchestrator) LoginHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, `{"error":"Error decoding JSON"}`, http.StatusBadRequest)
 			return
 		}
-		id := database.GetUserID(context.TODO(), data.Login, o.Db)
-		authentificated := database.IsAuth(context.TODO(), data.Login, data.Password, o.Db)
+		ip := clientIP(r)
+		retryAfter, err := o.loginRetryAfter(context.TODO(), data.Login, ip)
+		if err != nil {
+			http.Error(w, `{"error":"Something went wrong"}`, http.StatusInternalServerError)
+			return
+		}
+		if retryAfter > 0 {
+			o.audit(r, database.AuditEvent{Event: "login", Actor: data.Login, Outcome: auditFailure, Details: "locked"})
+			writeTooManyAttempts(w, retryAfter)
+			return
+		}
+		authentificated := o.Store.IsAuth(context.TODO(), data.Login, data.Password)
 		if !authentificated {
+			if err := o.recordLoginFailure(context.TODO(), data.Login, ip); err != nil {
+				log.Printf("Failed to record login failure: %v", err)
+			}
+			o.audit(r, database.AuditEvent{Event: "login", Actor: data.Login, Outcome: auditFailure, Details: "invalid credentials"})
 			http.Error(w, `{"error":"Invalid credentials"}`, http.StatusUnauthorized)
 			return
 		}
+		user, err := o.Store.GetUserByLogin(context.TODO(), data.Login)
+		if err != nil {
+			http.Error(w, `{"error":"Something went wrong"}`, http.StatusInternalServerError)
+			return
+		}
+		if user.Disabled {
+			o.audit(r, database.AuditEvent{Event: "login", ActorId: user.Id, Actor: user.Login, Outcome: auditFailure, Details: "account disabled"})
+			http.Error(w, `{"error":"Account disabled"}`, http.StatusForbidden)
+			return
+		}
+		if user.TOTPEnabled {
+			// счётчик неудачных попыток сбрасывается только после проверки второго фактора
+			o.audit(r, database.AuditEvent{Event: "login", ActorId: user.Id, Actor: user.Login, Outcome: auditPending, Details: "2fa required"})
+			o.startLoginChallenge(w, user)
+			return
+		}
+		if _, err := o.Store.ResetLoginAttempts(context.TODO(), loginKey(data.Login)); err != nil {
+			log.Printf("Failed to reset login attempts: %v", err)
+		}
 		log.Printf("Successfull login for %s\n", data.Login)
-		generatedToken, err := GenerateJWT(id, data.Login)
+		o.audit(r, database.AuditEvent{Event: "login", ActorId: user.Id, Actor: user.Login, Outcome: auditSuccess})
+		pair, err := o.startSession(context.TODO(), user)
 		if err != nil {
 			http.Error(w, `{"error":"Error generating jwt"}`, http.StatusInternalServerError)
 			return
 		}
-
-		http.SetCookie(w, &http.Cookie{
-			Name:     "auth_token",
-			Value:    generatedToken,
-			HttpOnly: true,
-			Secure:   true,
-			SameSite: http.SameSiteStrictMode,
-			Path:     "/",
-			MaxAge:   86400,
-		})
-
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"token": generatedToken,
-		})
+		o.writeTokens(w, pair)
 	}
 }
-func (o *Orchestrator) RunServer() error {
+func (o *Orchestrator) Routes() http.Handler {
 	mux := http.NewServeMux()
-	db, err := database.InitDB("finalTask.db")
-	o.Db = db
-	defer db.Close()
-	if err != nil {
-		log.Println("Error opening database")
-	}
 	mux.HandleFunc("/api/v1/register", o.RegisterHandler)
 	mux.HandleFunc("/api/v1/login", o.LoginHandler)
-	mux.HandleFunc("/api/v1/calculate", AuthMiddleware(o.CalculateHandler))
-	mux.HandleFunc("/api/v1/expressions", AuthMiddleware(o.ExpressionsHandler))
-	mux.HandleFunc("/api/v1/expressions/", AuthMiddleware(o.ExpressionByIDHandler))
-	mux.HandleFunc("/internal/task", o.AgentHandler)
+	mux.HandleFunc("/api/v1/login/2fa", o.Login2FAHandler)
+	mux.HandleFunc("/api/v1/refresh", o.RefreshHandler)
+	mux.HandleFunc("/api/v1/logout", o.LogoutHandler)
+	mux.HandleFunc("/api/v1/calculate", o.AuthMiddleware(o.CalculateHandler, ScopeSubmit))
+	mux.HandleFunc("/api/v1/expressions", o.AuthMiddleware(o.ExpressionsHandler, ScopeRead))
+	mux.HandleFunc("/api/v1/expressions/", o.AuthMiddleware(o.ExpressionByIDHandler, ScopeRead))
+	mux.HandleFunc("/api/v1/variables", o.AuthMiddleware(o.VariablesHandler, ScopeRead))
+	mux.HandleFunc("/api/v1/variables/", o.AuthMiddleware(o.VariableHandler))
+	mux.HandleFunc("/api/v1/password", o.AuthMiddleware(o.PasswordHandler))
+	mux.HandleFunc("/api/v1/account", o.AuthMiddleware(o.AccountHandler))
+	mux.HandleFunc("/api/v1/2fa/setup", o.AuthMiddleware(o.TwoFactorSetupHandler))
+	mux.HandleFunc("/api/v1/2fa/verify", o.AuthMiddleware(o.TwoFactorVerifyHandler))
+	mux.HandleFunc("/api/v1/2fa/disable", o.AuthMiddleware(o.TwoFactorDisableHandler))
+	mux.HandleFunc("/api/v1/apikeys", o.AuthMiddleware(o.APIKeysHandler))
+	mux.HandleFunc("/api/v1/apikeys/", o.AuthMiddleware(o.APIKeyHandler))
+	mux.HandleFunc("/api/v1/admin/users", o.AuthMiddleware(RequireRole(RoleAdmin, o.AdminUsersHandler)))
+	mux.HandleFunc("/api/v1/admin/users/", o.AuthMiddleware(RequireRole(RoleAdmin, o.AdminUserHandler)))
+	mux.HandleFunc("/api/v1/admin/expressions", o.AuthMiddleware(RequireRole(RoleAdmin, o.AdminExpressionsHandler)))
+	mux.HandleFunc("/api/v1/admin/queue", o.AuthMiddleware(RequireRole(RoleAdmin, o.AdminQueueHandler)))
+	mux.HandleFunc("/api/v1/admin/agents", o.AuthMiddleware(RequireRole(RoleAdmin, o.ListAgentsHandler)))
+	mux.HandleFunc("/api/v1/admin/audit", o.AuthMiddleware(RequireRole(RoleAdmin, o.AdminAuditHandler)))
+	mux.HandleFunc("/internal/task", o.AgentAuthMiddleware(o.AgentHandler))
+	mux.HandleFunc("/internal/agents", o.AgentAuthMiddleware(o.RegisterAgentHandler))
+	mux.HandleFunc("/internal/agents/heartbeat", o.AgentAuthMiddleware(o.HeartbeatHandler))
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"error":"Not Found"}`, http.StatusNotFound)
 	})
+	return mux
+}
+
+func (o *Orchestrator) RunServer() error {
+	if err := o.RestoreState(); err != nil {
+		log.Printf("Failed to restore pending expressions: %v", err)
+	}
+	go func() {
+		for {
+			time.Sleep(1 * time.Second)
+			o.RequeueExpiredTasks()
+			o.RequeueLostAgents()
+		}
+	}()
 	go func() {
 		for {
-			time.Sleep(2 * time.Second)
+			if err := o.Store.PurgeExpiredTokens(context.TODO(), time.Now()); err != nil {
+				log.Printf("Failed to purge expired tokens: %v", err)
+			}
+			time.Sleep(10 * time.Minute)
+		}
+	}()
+	lis, err := net.Listen("tcp", ":"+o.Config.GRPCAddr)
+	if err != nil {
+		return err
+	}
+	grpcServer := NewGRPCServer(o)
+	go func() {
+		log.Println("Starting gRPC server on port", o.Config.GRPCAddr)
+		if err := grpcServer.Serve(lis); err != nil {
+			log.Printf("gRPC server stopped: %v", err)
 		}
 	}()
-	return http.ListenAndServe(":"+o.Config.Addr, mux)
+	defer grpcServer.Stop()
+	return http.ListenAndServe(":"+o.Config.Addr, o.Routes())
 }
@@ -0,0 +1,78 @@
+package application
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// bcrypt учитывает только первые 72 байта пароля
+const maxPasswordBytes = 72
+
+var (
+	ErrEmptyPassword   = errors.New("password is empty")
+	ErrPasswordTooLong = fmt.Errorf("password is longer than %d bytes", maxPasswordBytes)
+)
+
+type CredentialsPolicy struct {
+	LoginMinLength       int
+	LoginMaxLength       int
+	PasswordMinLength    int
+	PasswordRequireMixed bool
+}
+
+func PolicyFromEnv() CredentialsPolicy {
+	policy := CredentialsPolicy{
+		LoginMinLength:    3,
+		LoginMaxLength:    32,
+		PasswordMinLength: 8,
+	}
+	if v, err := strconv.Atoi(os.Getenv("LOGIN_MIN_LENGTH")); err == nil && v > 0 {
+		policy.LoginMinLength = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("LOGIN_MAX_LENGTH")); err == nil && v > 0 {
+		policy.LoginMaxLength = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil && v > 0 {
+		policy.PasswordMinLength = v
+	}
+	policy.PasswordRequireMixed, _ = strconv.ParseBool(os.Getenv("PASSWORD_REQUIRE_MIXED"))
+	return policy
+}
+
+// ValidateLogin допускает буквы, цифры и символы "_", "-", "."
+func (p CredentialsPolicy) ValidateLogin(login string) error {
+	length := utf8.RuneCountInString(login)
+	if length < p.LoginMinLength || length > p.LoginMaxLength {
+		return fmt.Errorf("login must be from %d to %d characters long", p.LoginMinLength, p.LoginMaxLength)
+	}
+	for _, ch := range login {
+		if !unicode.IsLetter(ch) && !unicode.IsDigit(ch) && ch != '_' && ch != '-' && ch != '.' {
+			return fmt.Errorf("login may contain only letters, digits, '_', '-' and '.'")
+		}
+	}
+	return nil
+}
+
+func (p CredentialsPolicy) ValidatePassword(password string) error {
+	if utf8.RuneCountInString(password) < p.PasswordMinLength {
+		return fmt.Errorf("password must be at least %d characters long", p.PasswordMinLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return ErrPasswordTooLong
+	}
+	if p.PasswordRequireMixed {
+		var letter, digit bool
+		for _, ch := range password {
+			letter = letter || unicode.IsLetter(ch)
+			digit = digit || unicode.IsDigit(ch)
+		}
+		if !letter || !digit {
+			return fmt.Errorf("password must contain both letters and digits")
+		}
+	}
+	return nil
+}
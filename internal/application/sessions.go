@@ -0,0 +1,189 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+	"yandexlyceum/internal/database"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const refreshCookie = "refresh_token"
+
+type tokenPair struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// issueTokens выпускает JWT и новый refresh-токен в рамках сессии
+func (o *Orchestrator) issueTokens(ctx context.Context, user database.User, session_id string) (tokenPair, error) {
+	var pair tokenPair
+	access, err := o.GenerateJWT(user, session_id)
+	if err != nil {
+		return pair, err
+	}
+	refresh, err := generateToken()
+	if err != nil {
+		return pair, err
+	}
+	expires := time.Now().Add(o.Config.RefreshTTL)
+	if err := o.Store.AddRefreshToken(ctx, hashToken(refresh), session_id, expires); err != nil {
+		return pair, err
+	}
+	return tokenPair{Token: access, RefreshToken: refresh}, nil
+}
+
+// startSession создаёт сессию пользователя после успешного входа
+func (o *Orchestrator) startSession(ctx context.Context, user database.User) (tokenPair, error) {
+	sessionID, err := generateToken()
+	if err != nil {
+		return tokenPair{}, err
+	}
+	if err := o.Store.CreateSession(ctx, sessionID, user.Id, time.Now().Add(o.Config.RefreshTTL)); err != nil {
+		return tokenPair{}, err
+	}
+	return o.issueTokens(ctx, user, sessionID)
+}
+
+func (o *Orchestrator) writeTokens(w http.ResponseWriter, pair tokenPair) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "auth_token",
+		Value:    pair.Token,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+		Path:     "/",
+		MaxAge:   int(o.Config.TokenTTL.Seconds()),
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookie,
+		Value:    pair.RefreshToken,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+		Path:     "/api/v1",
+		MaxAge:   int(o.Config.RefreshTTL.Seconds()),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(pair)
+}
+
+func clearAuthCookies(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: "auth_token", Path: "/", MaxAge: -1, HttpOnly: true, Secure: true})
+	http.SetCookie(w, &http.Cookie{Name: refreshCookie, Path: "/api/v1", MaxAge: -1, HttpOnly: true, Secure: true})
+}
+
+// refreshTokenFromRequest берёт refresh-токен из cookie или из тела запроса
+func refreshTokenFromRequest(r *http.Request) string {
+	if cookie, err := r.Cookie(refreshCookie); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	return body.RefreshToken
+}
+
+func (o *Orchestrator) RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error":"Wrong Method"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	token := refreshTokenFromRequest(r)
+	if token == "" {
+		http.Error(w, `{"error":"Missing refresh token"}`, http.StatusUnauthorized)
+		return
+	}
+	session, err := o.Store.UseRefreshToken(r.Context(), hashToken(token), time.Now())
+	if errors.Is(err, database.ErrRefreshTokenReused) {
+		log.Printf("Refresh token reuse detected for user %d, session revoked", session.UserId)
+		o.audit(r, database.AuditEvent{Event: "refresh", ActorId: session.UserId, Outcome: auditFailure, Details: "token reuse, session revoked"})
+		clearAuthCookies(w)
+		http.Error(w, `{"error":"Invalid refresh token"}`, http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, database.ErrRefreshTokenInvalid) {
+		o.audit(r, database.AuditEvent{Event: "refresh", Outcome: auditFailure, Details: "invalid token"})
+		clearAuthCookies(w)
+		http.Error(w, `{"error":"Invalid refresh token"}`, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Something went wrong"}`, http.StatusInternalServerError)
+		return
+	}
+	user := database.User{Id: session.UserId, Login: session.Login, Role: session.Role}
+	pair, err := o.issueTokens(r.Context(), user, session.Id)
+	if err != nil {
+		http.Error(w, `{"error":"Error generating jwt"}`, http.StatusInternalServerError)
+		return
+	}
+	o.audit(r, database.AuditEvent{Event: "refresh", ActorId: user.Id, Actor: user.Login, Outcome: auditSuccess})
+	o.writeTokens(w, pair)
+}
+
+// LogoutHandler отзывает сессию и текущий JWT; достаточно любого из двух токенов
+func (o *Orchestrator) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error":"Wrong Method"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	now := time.Now()
+	var sessionID string
+	var actor database.AuditEvent
+	found := false
+	if tokenString, err := accessToken(r); err == nil {
+		token, err := o.Config.JWTKeys.Parse(tokenString)
+		if claims, ok := tokenClaims(token); err == nil && ok {
+			found = true
+			sessionID, _ = claims["sid"].(string)
+			userID, _ := claims["user_id"].(float64)
+			actor.ActorId = int(userID)
+			actor.Actor, _ = claims["login"].(string)
+			jti, _ := claims["jti"].(string)
+			exp, _ := claims.GetExpirationTime()
+			if jti != "" && exp != nil {
+				if err := o.Store.RevokeToken(r.Context(), jti, exp.Time); err != nil {
+					http.Error(w, `{"error":"Something went wrong"}`, http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+	}
+	if token := refreshTokenFromRequest(r); token != "" {
+		if id, err := o.Store.GetSessionByRefreshToken(r.Context(), hashToken(token)); err == nil {
+			found = true
+			sessionID = id
+		}
+	}
+	if !found {
+		http.Error(w, `{"error":"Missing token"}`, http.StatusUnauthorized)
+		return
+	}
+	if sessionID != "" {
+		if err := o.Store.RevokeSession(r.Context(), sessionID, now); err != nil {
+			http.Error(w, `{"error":"Something went wrong"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+	actor.Event, actor.Outcome = "logout", auditSuccess
+	o.audit(r, actor)
+	clearAuthCookies(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"Logged out"}`))
+}
+
+func tokenClaims(token *jwt.Token) (jwt.MapClaims, bool) {
+	if token == nil || !token.Valid {
+		return nil, false
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	return claims, ok
+}
@@ -0,0 +1,396 @@
+package application
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+	"yandexlyceum/internal/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// taskTransport - способ общения агента с оркестратором (HTTP или gRPC)
+type taskTransport interface {
+	Register(ctx context.Context, reg AgentRegistration) error
+	Heartbeat(ctx context.Context, agentID string) error
+	FetchTasks(ctx context.Context, agentID string, max int, wait time.Duration) ([]*Task, error)
+	SubmitResults(ctx context.Context, results []TaskResult) ([]ResultStatus, error)
+	Close() error
+}
+
+var ErrAgentNotRegistered = errors.New("agent not registered")
+
+type httpTransport struct {
+	url   string
+	token string
+}
+
+func (t *httpTransport) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return http.DefaultClient.Do(req)
+}
+
+func (t *httpTransport) post(ctx context.Context, path string, payload interface{}) (*http.Response, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url+path, bytes.NewReader(payloadBytes))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return t.do(req)
+}
+
+func (t *httpTransport) Register(ctx context.Context, reg AgentRegistration) error {
+	resp, err := t.post(ctx, "/internal/agents", reg)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+func (t *httpTransport) Heartbeat(ctx context.Context, agentID string) error {
+	resp, err := t.post(ctx, "/internal/agents/heartbeat", map[string]string{"id": agentID})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrAgentNotRegistered
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+func (t *httpTransport) FetchTasks(ctx context.Context, agentID string, max int, wait time.Duration) ([]*Task, error) {
+	query := url.Values{}
+	query.Set("agent", agentID)
+	query.Set("max", strconv.Itoa(max))
+	query.Set("wait", wait.String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.url+"/internal/task?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(body))
+	}
+	var tasksResp struct {
+		Tasks []*Task `json:"tasks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tasksResp); err != nil {
+		return nil, err
+	}
+	return tasksResp.Tasks, nil
+}
+
+func (t *httpTransport) SubmitResults(ctx context.Context, results []TaskResult) ([]ResultStatus, error) {
+	resp, err := t.post(ctx, "/internal/task", map[string]interface{}{"results": results})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(body))
+	}
+	var statusResp struct {
+		Results []ResultStatus `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&statusResp); err != nil {
+		return nil, err
+	}
+	return statusResp.Results, nil
+}
+
+func (t *httpTransport) Close() error {
+	return nil
+}
+
+type grpcTransport struct {
+	conn   *grpc.ClientConn
+	client pb.TaskServiceClient
+}
+
+func newGRPCTransport(addr, token string) (*grpcTransport, error) {
+	conn, err := grpc.NewClient(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithPerRPCCredentials(agentCredentials{token: token}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcTransport{conn: conn, client: pb.NewTaskServiceClient(conn)}, nil
+}
+
+func (t *grpcTransport) Register(ctx context.Context, reg AgentRegistration) error {
+	_, err := t.client.Register(ctx, &pb.RegisterRequest{
+		Id:             reg.ID,
+		ComputingPower: int32(reg.ComputingPower),
+		Operations:     reg.Operations,
+	})
+	return err
+}
+
+func (t *grpcTransport) Heartbeat(ctx context.Context, agentID string) error {
+	_, err := t.client.Heartbeat(ctx, &pb.HeartbeatRequest{Id: agentID})
+	if status.Code(err) == codes.NotFound {
+		return ErrAgentNotRegistered
+	}
+	return err
+}
+
+func (t *grpcTransport) FetchTasks(ctx context.Context, agentID string, max int, wait time.Duration) ([]*Task, error) {
+	resp, err := t.client.GetTask(ctx, &pb.GetTaskRequest{
+		AgentId: agentID,
+		Max:     int32(max),
+		WaitMs:  int32(wait.Milliseconds()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	tasks := make([]*Task, 0, len(resp.GetTasks()))
+	for _, task := range resp.GetTasks() {
+		tasks = append(tasks, taskFromProto(task))
+	}
+	return tasks, nil
+}
+
+func (t *grpcTransport) SubmitResults(ctx context.Context, results []TaskResult) ([]ResultStatus, error) {
+	req := &pb.SubmitResultRequest{Results: make([]*pb.TaskResult, 0, len(results))}
+	for _, result := range results {
+		req.Results = append(req.Results, resultToProto(result))
+	}
+	resp, err := t.client.SubmitResult(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]ResultStatus, 0, len(resp.GetStatuses()))
+	for _, status := range resp.GetStatuses() {
+		statuses = append(statuses, ResultStatus{ID: status.GetId(), Status: status.GetStatus()})
+	}
+	return statuses, nil
+}
+
+func (t *grpcTransport) Close() error {
+	return t.conn.Close()
+}
+
+// grpcStreamTransport получает задачи и отправляет результаты через двунаправленный поток Stream,
+// а регистрация и heartbeat'ы идут унарными вызовами. Поток открывается при первом обращении
+// и переоткрывается после обрыва (например, после перезапуска оркестратора)
+type grpcStreamTransport struct {
+	*grpcTransport
+	mu       sync.Mutex
+	current  *taskStream
+	submitMu sync.Mutex
+}
+
+// taskStream - один открытый поток Stream
+type taskStream struct {
+	stream   pb.TaskService_StreamClient
+	cancel   context.CancelFunc
+	sendMu   sync.Mutex
+	mu       sync.Mutex
+	queued   []*Task
+	credits  int
+	arrived  chan struct{}
+	statuses chan ResultStatus
+	done     chan struct{}
+	err      error
+}
+
+func newGRPCStreamTransport(addr, token string) (*grpcStreamTransport, error) {
+	base, err := newGRPCTransport(addr, token)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcStreamTransport{grpcTransport: base}, nil
+}
+
+func (t *grpcStreamTransport) open() (*taskStream, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current != nil {
+		return t.current, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := t.client.Stream(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	s := &taskStream{
+		stream:   stream,
+		cancel:   cancel,
+		arrived:  make(chan struct{}, 1),
+		statuses: make(chan ResultStatus),
+		done:     make(chan struct{}),
+	}
+	go s.receive(ctx)
+	t.current = s
+	return s, nil
+}
+
+// reset закрывает оборвавшийся поток, чтобы следующий вызов открыл новый
+func (t *grpcStreamTransport) reset(s *taskStream) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s.cancel()
+	if t.current == s {
+		t.current = nil
+	}
+}
+
+func (s *taskStream) receive(ctx context.Context) {
+	defer close(s.done)
+	for {
+		msg, err := s.stream.Recv()
+		if err != nil {
+			s.err = err
+			return
+		}
+		switch payload := msg.GetPayload().(type) {
+		case *pb.OrchestratorMessage_Task:
+			s.mu.Lock()
+			s.queued = append(s.queued, taskFromProto(payload.Task))
+			s.mu.Unlock()
+			select {
+			case s.arrived <- struct{}{}:
+			default:
+			}
+		case *pb.OrchestratorMessage_Status:
+			select {
+			case s.statuses <- ResultStatus{ID: payload.Status.GetId(), Status: payload.Status.GetStatus()}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func (s *taskStream) send(msg *pb.AgentMessage) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	return s.stream.Send(msg)
+}
+
+// take забирает из пришедших задач не больше max
+func (s *taskStream) take(max int) []*Task {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := min(max, len(s.queued))
+	tasks := s.queued[:n:n]
+	s.queued = s.queued[n:]
+	s.credits -= n
+	return tasks
+}
+
+// FetchTasks сообщает оркестратору о свободных воркерах, на которые ещё не запрошены задачи,
+// и ждёт задачи не дольше wait. Запрошенные, но не пришедшие задачи остаются за потоком
+// и выдаются следующими вызовами
+func (t *grpcStreamTransport) FetchTasks(ctx context.Context, agentID string, max int, wait time.Duration) ([]*Task, error) {
+	s, err := t.open()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	need := max - s.credits
+	if need > 0 {
+		s.credits += need
+	}
+	s.mu.Unlock()
+	if need > 0 {
+		if err := s.send(&pb.AgentMessage{AgentId: agentID, Payload: &pb.AgentMessage_Ready{Ready: int32(need)}}); err != nil {
+			t.reset(s)
+			return nil, err
+		}
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		if tasks := s.take(max); len(tasks) > 0 {
+			return tasks, nil
+		}
+		select {
+		case <-s.arrived:
+		case <-timer.C:
+			return nil, nil
+		case <-s.done:
+			t.reset(s)
+			return nil, s.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// SubmitResults отправляет результаты в поток и ждёт статус каждого из них
+func (t *grpcStreamTransport) SubmitResults(ctx context.Context, results []TaskResult) ([]ResultStatus, error) {
+	t.submitMu.Lock()
+	defer t.submitMu.Unlock()
+	s, err := t.open()
+	if err != nil {
+		return nil, err
+	}
+	for _, result := range results {
+		if err := s.send(&pb.AgentMessage{Payload: &pb.AgentMessage_Result{Result: resultToProto(result)}}); err != nil {
+			t.reset(s)
+			return nil, err
+		}
+	}
+	statuses := make([]ResultStatus, 0, len(results))
+	for range results {
+		select {
+		case status := <-s.statuses:
+			statuses = append(statuses, status)
+		case <-s.done:
+			t.reset(s)
+			return nil, s.err
+		case <-ctx.Done():
+			// статусы оставшихся результатов уже не дождаться: начинаем с нового потока
+			t.reset(s)
+			return nil, ctx.Err()
+		}
+	}
+	return statuses, nil
+}
+
+func (t *grpcStreamTransport) Close() error {
+	t.mu.Lock()
+	if t.current != nil {
+		t.current.cancel()
+		t.current = nil
+	}
+	t.mu.Unlock()
+	return t.grpcTransport.Close()
+}
@@ -0,0 +1,263 @@
+package application
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"yandexlyceum/internal/database"
+	"yandexlyceum/pkg/totp"
+)
+
+const (
+	recoveryCodesCount = 10
+	loginChallengeTTL  = 5 * time.Minute
+)
+
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodesCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(b)
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// verifySecondFactor принимает код TOTP или одноразовый код восстановления
+func (o *Orchestrator) verifySecondFactor(ctx context.Context, user_id int, code string) (bool, error) {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if len(code) != totp.Digits {
+		return o.Store.UseRecoveryCode(ctx, user_id, hashToken(code))
+	}
+	encoded, enabled, err := o.Store.GetTOTPSecret(ctx, user_id)
+	if err != nil || !enabled {
+		return false, err
+	}
+	secret, err := totp.DecodeSecret(encoded)
+	if err != nil {
+		return false, err
+	}
+	step, ok := totp.Validate(secret, code, o.Now(), 1)
+	if !ok {
+		return false, nil
+	}
+	// код нельзя использовать повторно
+	return o.Store.UseTOTPStep(ctx, user_id, step)
+}
+
+func decodeCode(r *http.Request) (string, bool) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		return "", false
+	}
+	return req.Code, true
+}
+
+func (o *Orchestrator) TwoFactorSetupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error":"Wrong Method"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	userID, ok := userIDFromRequest(r)
+	if !ok {
+		http.Error(w, `{"error": "Invalid user data"}`, http.StatusInternalServerError)
+		return
+	}
+	user, err := o.Store.GetUserByID(context.TODO(), userID)
+	if err != nil {
+		http.Error(w, `{"error": "Invalid user data"}`, http.StatusInternalServerError)
+		return
+	}
+	if user.TOTPEnabled {
+		http.Error(w, `{"error":"2FA already enabled"}`, http.StatusConflict)
+		return
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		http.Error(w, `{"error":"Something went wrong"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := o.Store.SetTOTPSecret(context.TODO(), userID, totp.EncodeSecret(secret)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"secret":      totp.EncodeSecret(secret),
+		"otpauth_uri": totp.URI(o.Config.TOTPIssuer, user.Login, secret),
+	})
+}
+
+// TwoFactorVerifyHandler подтверждает настройку 2FA первым кодом и выдаёт коды восстановления
+func (o *Orchestrator) TwoFactorVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error":"Wrong Method"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	code, ok := decodeCode(r)
+	if !ok {
+		http.Error(w, `{"error":"Invalid Body"}`, http.StatusUnprocessableEntity)
+		return
+	}
+	userID, ok := userIDFromRequest(r)
+	if !ok {
+		http.Error(w, `{"error": "Invalid user data"}`, http.StatusInternalServerError)
+		return
+	}
+	encoded, enabled, err := o.Store.GetTOTPSecret(context.TODO(), userID)
+	if err != nil {
+		http.Error(w, `{"error": "Invalid user data"}`, http.StatusInternalServerError)
+		return
+	}
+	if enabled || encoded == "" {
+		http.Error(w, `{"error":"2FA setup not started"}`, http.StatusConflict)
+		return
+	}
+	secret, _ := totp.DecodeSecret(encoded)
+	step, ok := totp.Validate(secret, strings.TrimSpace(code), o.Now(), 1)
+	if !ok {
+		o.audit(r, database.AuditEvent{Event: "2fa_enable", Outcome: auditFailure, Details: "invalid code"})
+		http.Error(w, `{"error":"Invalid code"}`, http.StatusForbidden)
+		return
+	}
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		http.Error(w, `{"error":"Something went wrong"}`, http.StatusInternalServerError)
+		return
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = hashToken(code)
+	}
+	if err := o.Store.EnableTOTP(context.TODO(), userID, step, hashes); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("2FA enabled for user %d", userID)
+	o.audit(r, database.AuditEvent{Event: "2fa_enable", Outcome: auditSuccess})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"recovery_codes": codes})
+}
+
+func (o *Orchestrator) TwoFactorDisableHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error":"Wrong Method"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	code, ok := decodeCode(r)
+	if !ok {
+		http.Error(w, `{"error":"Invalid Body"}`, http.StatusUnprocessableEntity)
+		return
+	}
+	userID, ok := userIDFromRequest(r)
+	if !ok {
+		http.Error(w, `{"error": "Invalid user data"}`, http.StatusInternalServerError)
+		return
+	}
+	verified, err := o.verifySecondFactor(context.TODO(), userID, code)
+	if err != nil {
+		http.Error(w, `{"error":"Something went wrong"}`, http.StatusInternalServerError)
+		return
+	}
+	if !verified {
+		o.audit(r, database.AuditEvent{Event: "2fa_disable", Outcome: auditFailure, Details: "invalid code"})
+		http.Error(w, `{"error":"Invalid code"}`, http.StatusForbidden)
+		return
+	}
+	if err := o.Store.DisableTOTP(context.TODO(), userID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("2FA disabled for user %d", userID)
+	o.audit(r, database.AuditEvent{Event: "2fa_disable", Outcome: auditSuccess})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"2FA disabled"}`))
+}
+
+// startLoginChallenge завершает первый шаг входа для пользователя с 2FA: токены выдаются только после кода
+func (o *Orchestrator) startLoginChallenge(w http.ResponseWriter, user database.User) {
+	challenge, err := generateToken()
+	if err != nil {
+		http.Error(w, `{"error":"Something went wrong"}`, http.StatusInternalServerError)
+		return
+	}
+	err = o.Store.CreateLoginChallenge(context.TODO(), hashToken(challenge), user.Id, o.Now().Add(loginChallengeTTL))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"2fa_required": true,
+		"challenge":    challenge,
+	})
+}
+
+// Login2FAHandler - второй шаг входа: проверка кода TOTP или кода восстановления
+func (o *Orchestrator) Login2FAHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error":"Wrong Method"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Challenge == "" || req.Code == "" {
+		http.Error(w, `{"error":"Invalid Body"}`, http.StatusUnprocessableEntity)
+		return
+	}
+	user, err := o.Store.GetLoginChallenge(context.TODO(), hashToken(req.Challenge), o.Now())
+	if err != nil || user.Disabled {
+		http.Error(w, `{"error":"Invalid or expired challenge"}`, http.StatusUnauthorized)
+		return
+	}
+	ip := clientIP(r)
+	retryAfter, err := o.loginRetryAfter(context.TODO(), user.Login, ip)
+	if err != nil {
+		http.Error(w, `{"error":"Something went wrong"}`, http.StatusInternalServerError)
+		return
+	}
+	if retryAfter > 0 {
+		o.audit(r, database.AuditEvent{Event: "login_2fa", ActorId: user.Id, Actor: user.Login, Outcome: auditFailure, Details: "locked"})
+		writeTooManyAttempts(w, retryAfter)
+		return
+	}
+	verified, err := o.verifySecondFactor(context.TODO(), user.Id, req.Code)
+	if err != nil {
+		http.Error(w, `{"error":"Something went wrong"}`, http.StatusInternalServerError)
+		return
+	}
+	if !verified {
+		if err := o.recordLoginFailure(context.TODO(), user.Login, ip); err != nil {
+			log.Printf("Failed to record login failure: %v", err)
+		}
+		o.audit(r, database.AuditEvent{Event: "login_2fa", ActorId: user.Id, Actor: user.Login, Outcome: auditFailure, Details: "invalid code"})
+		http.Error(w, `{"error":"Invalid code"}`, http.StatusUnauthorized)
+		return
+	}
+	o.Store.DeleteLoginChallenge(context.TODO(), hashToken(req.Challenge))
+	if _, err := o.Store.ResetLoginAttempts(context.TODO(), loginKey(user.Login)); err != nil {
+		log.Printf("Failed to reset login attempts: %v", err)
+	}
+	log.Printf("Successfull login for %s\n", user.Login)
+	o.audit(r, database.AuditEvent{Event: "login_2fa", ActorId: user.Id, Actor: user.Login, Outcome: auditSuccess})
+	pair, err := o.startSession(context.TODO(), user)
+	if err != nil {
+		http.Error(w, `{"error":"Error generating jwt"}`, http.StatusInternalServerError)
+		return
+	}
+	o.writeTokens(w, pair)
+}
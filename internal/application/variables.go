@@ -0,0 +1,72 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+func (o *Orchestrator) VariablesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error":"Wrong Method"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	userID, ok := userIDFromRequest(r)
+	if !ok {
+		http.Error(w, `{"error": "Invalid user data"}`, http.StatusInternalServerError)
+		return
+	}
+	variables, err := o.Store.GetVariables(context.TODO(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"variables": variables})
+}
+
+func (o *Orchestrator) VariableHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		http.Error(w, `{"error":"Wrong Method"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Path[len("/api/v1/variables/"):]
+	if !IsIdentifier(name) {
+		http.Error(w, `{"error":"Invalid variable name"}`, http.StatusUnprocessableEntity)
+		return
+	}
+	userID, ok := userIDFromRequest(r)
+	if !ok {
+		http.Error(w, `{"error": "Invalid user data"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		deleted, err := o.Store.DeleteVariable(context.TODO(), userID, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.Error(w, `{"error":"Variable not found"}`, http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var req struct {
+		Value *float64 `json:"value"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Value == nil {
+		http.Error(w, `{"error":"Invalid Body"}`, http.StatusUnprocessableEntity)
+		return
+	}
+	if err := o.Store.SetVariable(context.TODO(), userID, name, *req.Value); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "value": *req.Value})
+}
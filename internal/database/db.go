@@ -3,61 +3,110 @@ package database
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// Expression - выражение пользователя. Status: pending, in_progress, completed или failed;
+// Result есть только у completed, Error - только у failed
 type Expression struct {
-	Id     int     `json:"id"`
-	Result float64 `json:"result"`
+	Id          int        `json:"id"`
+	UserId      int        `json:"user_id,omitempty"`
+	Expression  string     `json:"expression"`
+	Status      string     `json:"status"`
+	Result      *float64   `json:"result,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
 }
 
-func InitDB(dataSourceName string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", dataSourceName)
+type ExpressionState struct {
+	Id     int
+	Status string
+	AST    string
+}
+
+// TaskRecord - задача узла выражения. AgentId - агент, которому задача выдана последней,
+// LeaseDeadline - срок аренды; нулевой срок - задача ждёт в очереди
+type TaskRecord struct {
+	Id            int
+	ExpressionId  int
+	Arg1          float64
+	Arg2          float64
+	Args          []float64
+	Operation     string
+	OperationTime int
+	NodePath      string
+	AgentId       string
+	LeaseDeadline time.Time
+}
+
+// ExpressionUpdate - изменения выражения, которые возвращает функция из UpdateExpression.
+// Status completed или failed завершает выражение с Result или Error и удаляет все его задачи,
+// иначе сохраняются Status и AST и добавляются AddTasks. Пустой Status - ничего не менять
+type ExpressionUpdate struct {
+	Status      string
+	AST         string
+	Result      float64
+	Error       string
+	AddTasks    []TaskRecord
+	DeleteTasks []int
+}
+
+// Open подключается к базе без применения миграций. DSN вида postgres://... открывает PostgreSQL,
+// любой другой считается путём к файлу SQLite
+func Open(dataSourceName string) (*sql.DB, error) {
+	driver := driverName(dataSourceName)
+	if driver == "sqlite3" && !strings.Contains(dataSourceName, "_txlock=") {
+		// транзакции сразу берут блокировку записи: иначе две транзакции, начавшие с чтения,
+		// не могут обе перейти к записи, и одна из них сразу получает "database is locked"
+		separator := "?"
+		if strings.Contains(dataSourceName, "?") {
+			separator = "&"
+		}
+		dataSourceName += separator + "_txlock=immediate"
+	}
+	db, err := sql.Open(driver, dataSourceName)
 	if err != nil {
 		return nil, err
 	}
 	if err = db.Ping(); err != nil {
-		log.Fatal("Failed to ping database:", err)
+		db.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+	if driver == "postgres" {
+		log.Println("Successfully connected to PostgreSQL database")
+	} else {
+		log.Println("Successfully connected to SQLite database")
 	}
-	log.Println("Successfully connected to SQLite database")
-	createTables(context.TODO(), db)
 	return db, nil
 }
 
-func createTables(ctx context.Context, db *sql.DB) error {
-	const usersTable = `
-	CREATE TABLE IF NOT EXISTS users(
-		id INTEGER PRIMARY KEY AUTOINCREMENT, 
-		login TEXT UNIQUE,
-		password TEXT
-	);`
-
-	const expressionsTable = `
-	CREATE TABLE IF NOT EXISTS expressions(
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		user_id INTEGER NOT NULL,
-		expression TEXT NOT NULL,
-		result FLOAT,
-		FOREIGN KEY (user_id) REFERENCES users(id)
-	);`
-	if _, err := db.ExecContext(ctx, usersTable); err != nil {
-		return err
+// InitDB подключается к базе и доводит её схему до последней версии
+func InitDB(dataSourceName string) (*sql.DB, error) {
+	db, err := Open(dataSourceName)
+	if err != nil {
+		return nil, err
 	}
-	if _, err := db.ExecContext(ctx, expressionsTable); err != nil {
-		return err
+	if err := Migrate(context.TODO(), LatestVersion(), db); err != nil {
+		db.Close()
+		return nil, err
 	}
-	log.Println("Successfully added a tables to SQlite database")
-	return nil
+	return db, nil
 }
 
-func InsertUsers(ctx context.Context, login, password string, db *sql.DB) error {
+func (s *SQLStore) InsertUsers(ctx context.Context, login, password string) error {
 	var exists bool
-	err := db.QueryRowContext(
+	err := s.db.QueryRowContext(
 		ctx,
 		"SELECT EXISTS(SELECT 1 FROM users WHERE login = $1)",
 		login,
@@ -73,27 +122,27 @@ func InsertUsers(ctx context.Context, login, password string, db *sql.DB) error
 	var q = `
 	INSERT INTO users (login, password) values ($1, $2)
 	`
-	_, err = db.ExecContext(ctx, q, login, password)
+	_, err = s.db.ExecContext(ctx, q, login, password)
 	if err != nil {
 		return errors.New(`{"error": "Something went wrong"}`)
 	}
 	return nil
 }
 
-func GetUserID(ctx context.Context, login string, db *sql.DB) int {
+func (s *SQLStore) GetUserID(ctx context.Context, login string) int {
 	var id int
 	var q = `SELECT id FROM users WHERE login = $1`
-	err := db.QueryRowContext(ctx, q, login).Scan(&id)
+	err := s.db.QueryRowContext(ctx, q, login).Scan(&id)
 	if err != nil {
 		return 0
 	}
 	return id
 }
 
-func IsAuth(ctx context.Context, login, password string, db *sql.DB) bool {
+func (s *SQLStore) IsAuth(ctx context.Context, login, password string) bool {
 	var storedPassword string
 	var q = `SELECT password FROM users WHERE login = $1`
-	err := db.QueryRowContext(ctx, q, login).Scan(&storedPassword)
+	err := s.db.QueryRowContext(ctx, q, login).Scan(&storedPassword)
 	if err != nil {
 		return false
 	}
@@ -101,63 +150,1178 @@ func IsAuth(ctx context.Context, login, password string, db *sql.DB) bool {
 	return err == nil
 }
 
-func AddExpression(ctx context.Context, user_id int, expression string, db *sql.DB) (int, error) {
-	var q = `INSERT INTO expressions (user_id, expression) values ($1, $2)`
-	result, err := db.ExecContext(ctx, q, user_id, expression)
+func (s *SQLStore) AddExpression(ctx context.Context, user_id int, expression string) (int, error) {
+	var id int
+	var q = `INSERT INTO expressions (user_id, expression, created_at) values ($1, $2, $3) RETURNING id`
+	err := s.db.QueryRowContext(ctx, q, user_id, expression, time.Now().Unix()).Scan(&id)
 	if err != nil {
 		return 0, errors.New(`{"error": "Something went wrong"}`)
 	}
-	id, _ := result.LastInsertId()
 	log.Printf("Expression '%s' successfully added", expression)
-	return int(id), nil
+	return id, nil
 }
 
-func AddAnswer(ctx context.Context, id int, result float64, db *sql.DB) error {
+func (s *SQLStore) AddAnswer(ctx context.Context, id int, result float64) error {
 	var q = `UPDATE expressions
-	SET result = $1
-	WHERE id = $2`
-	_, err := db.ExecContext(ctx, q, result, id)
+	SET result = $1, status = 'completed', started_at = COALESCE(started_at, $2), completed_at = $2
+	WHERE id = $3`
+	_, err := s.db.ExecContext(ctx, q, result, time.Now().Unix(), id)
 	if err != nil {
 		return errors.New(`{"error": "Something went wrong"}`)
 	}
 	return nil
 }
 
-func GetExpressions(user_id int, db *sql.DB) ([]Expression, error) {
-	var answ []Expression
-	var q = `SELECT id, result FROM expressions
-	WHERE user_id = $1`
-	rows, err := db.Query(q, user_id)
+func (s *SQLStore) AddError(ctx context.Context, id int, message string) error {
+	var q = `UPDATE expressions
+	SET error = $1, status = 'failed', started_at = COALESCE(started_at, $2), completed_at = $2
+	WHERE id = $3`
+	_, err := s.db.ExecContext(ctx, q, message, time.Now().Unix(), id)
+	if err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	return nil
+}
+
+// SaveExpressionState сохраняет статус и дерево выражения; при переходе в in_progress запоминается начало вычисления
+func (s *SQLStore) SaveExpressionState(ctx context.Context, id int, status, ast string) error {
+	var q = `UPDATE expressions
+	SET status = $1, ast = $2, started_at = CASE WHEN $1 = 'in_progress' THEN COALESCE(started_at, $3) ELSE started_at END
+	WHERE id = $4`
+	_, err := s.db.ExecContext(ctx, q, status, ast, time.Now().Unix(), id)
+	if err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	return nil
+}
+
+func (s *SQLStore) GetUnfinishedExpressions(ctx context.Context) ([]ExpressionState, error) {
+	var answ []ExpressionState
+	var q = `SELECT id, status, ast FROM expressions
+	WHERE status IN ('pending', 'in_progress') AND ast IS NOT NULL
+	ORDER BY id`
+	rows, err := s.db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, errors.New(`{"error": "Something went wrong"}`)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var state ExpressionState
+		if err := rows.Scan(&state.Id, &state.Status, &state.AST); err != nil {
+			return nil, errors.New(`{"error": "Something went wrong"}`)
+		}
+		answ = append(answ, state)
+	}
+	return answ, nil
+}
+
+func (s *SQLStore) AddTask(ctx context.Context, task TaskRecord) (int, error) {
+	return insertTask(ctx, s.db, task)
+}
+
+// querier - общее у *sql.DB и *sql.Tx, чтобы одни и те же запросы выполнялись и в транзакции
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func insertTask(ctx context.Context, db querier, task TaskRecord) (int, error) {
+	var args sql.NullString
+	if len(task.Args) > 0 {
+		encoded, err := json.Marshal(task.Args)
+		if err != nil {
+			return 0, err
+		}
+		args = sql.NullString{String: string(encoded), Valid: true}
+	}
+	var id int
+	var q = `INSERT INTO tasks (expression_id, arg1, arg2, args, operation, operation_time, node_path)
+	values ($1, $2, $3, $4, $5, $6, $7) RETURNING id`
+	err := db.QueryRowContext(ctx, q, task.ExpressionId, task.Arg1, task.Arg2, args, task.Operation, task.OperationTime, task.NodePath).Scan(&id)
+	if err != nil {
+		return 0, errors.New(`{"error": "Something went wrong"}`)
+	}
+	return id, nil
+}
+
+func (s *SQLStore) DeleteTask(ctx context.Context, id int) error {
+	var q = `DELETE FROM tasks WHERE id = $1`
+	_, err := s.db.ExecContext(ctx, q, id)
+	if err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	return nil
+}
+
+func (s *SQLStore) DeleteExpressionTasks(ctx context.Context, expression_id int) error {
+	var q = `DELETE FROM tasks WHERE expression_id = $1`
+	_, err := s.db.ExecContext(ctx, q, expression_id)
+	if err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	return nil
+}
+
+const taskColumns = `id, expression_id, arg1, arg2, args, operation, operation_time, node_path, agent_id, lease_deadline`
+
+func scanTask(row rowScanner) (TaskRecord, error) {
+	var task TaskRecord
+	var args, agentID sql.NullString
+	var deadline sql.NullInt64
+	err := row.Scan(&task.Id, &task.ExpressionId, &task.Arg1, &task.Arg2, &args, &task.Operation, &task.OperationTime, &task.NodePath, &agentID, &deadline)
+	if err != nil {
+		return task, err
+	}
+	if args.Valid {
+		if err := json.Unmarshal([]byte(args.String), &task.Args); err != nil {
+			return task, err
+		}
+	}
+	task.AgentId = agentID.String
+	if deadline.Valid {
+		task.LeaseDeadline = time.UnixMilli(deadline.Int64)
+	}
+	return task, nil
+}
+
+func queryTasks(ctx context.Context, db querier, q string, args ...interface{}) ([]TaskRecord, error) {
+	var answ []TaskRecord
+	rows, err := db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, errors.New(`{"error": "Something went wrong"}`)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, errors.New(`{"error": "Something went wrong"}`)
+		}
+		answ = append(answ, task)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.New(`{"error": "Something went wrong"}`)
+	}
+	return answ, nil
+}
+
+func (s *SQLStore) GetTasks(ctx context.Context) ([]TaskRecord, error) {
+	return queryTasks(ctx, s.db, `SELECT `+taskColumns+` FROM tasks ORDER BY id`)
+}
+
+func (s *SQLStore) GetTask(ctx context.Context, id int) (TaskRecord, error) {
+	return scanTask(s.db.QueryRowContext(ctx, `SELECT `+taskColumns+` FROM tasks WHERE id = $1`, id))
+}
+
+// LeaseTasks выдаёт агенту до max задач из очереди, операции которых есть в operations (пустой
+// список - любые). Срок аренды задачи - deadline плюс её operation_time. Задачи выбираются одним
+// UPDATE с SKIP LOCKED, поэтому одновременно работающие оркестраторы не выдают одну задачу дважды.
+// Выражения выданных задач переходят из pending в in_progress
+func (s *SQLStore) LeaseTasks(ctx context.Context, agent_id string, operations []string, max int, deadline time.Time) ([]TaskRecord, error) {
+	if max < 1 {
+		return nil, nil
+	}
+	// SQLite нумерует параметры в порядке первого появления в запросе, поэтому номера идут по возрастанию
+	args := []interface{}{agent_id, deadline.UnixMilli()}
+	filter := ""
+	if len(operations) > 0 {
+		placeholders := make([]string, len(operations))
+		for i, op := range operations {
+			args = append(args, op)
+			placeholders[i] = fmt.Sprintf("$%d", len(args))
+		}
+		filter = " AND operation IN (" + strings.Join(placeholders, ", ") + ")"
+	}
+	args = append(args, max)
+	var q = `UPDATE tasks SET agent_id = $1, lease_deadline = $2 + operation_time
+	WHERE id IN (SELECT id FROM tasks WHERE lease_deadline IS NULL` + filter + ` ORDER BY id LIMIT ` + fmt.Sprintf("$%d", len(args)) + s.skipLocked() + `)
+	RETURNING ` + taskColumns
+	tasks, err := queryTasks(ctx, s.db, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Id < tasks[j].Id })
+	// статус меняется отдельным запросом после выдачи: строку выражения блокирует UpdateExpression
+	// до блокировки задач, и обратный порядок здесь приводил бы к взаимной блокировке
+	q = `UPDATE expressions SET status = 'in_progress', started_at = COALESCE(started_at, $1)
+	WHERE id = $2 AND status = 'pending'`
+	for i, task := range tasks {
+		if i > 0 && tasks[i-1].ExpressionId == task.ExpressionId {
+			continue
+		}
+		if _, err := s.db.ExecContext(ctx, q, time.Now().Unix(), task.ExpressionId); err != nil {
+			return nil, errors.New(`{"error": "Something went wrong"}`)
+		}
+	}
+	return tasks, nil
+}
+
+// RequeueExpiredTasks возвращает в очередь задачи с истёкшим сроком аренды и возвращает их id.
+// Агент задачи сохраняется, чтобы поздний результат принимался только от него
+func (s *SQLStore) RequeueExpiredTasks(ctx context.Context, now time.Time) ([]int, error) {
+	var ids []int
+	var q = `UPDATE tasks SET lease_deadline = NULL WHERE lease_deadline < $1 RETURNING id`
+	rows, err := s.db.QueryContext(ctx, q, now.UnixMilli())
 	if err != nil {
 		return nil, errors.New(`{"error": "Something went wrong"}`)
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var id int
-		var result sql.NullFloat64
-		if err := rows.Scan(&id, &result); err != nil {
+		if err := rows.Scan(&id); err != nil {
+			return nil, errors.New(`{"error": "Something went wrong"}`)
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// RequeueAgentTasks возвращает в очередь задачи, выданные агенту, и возвращает их число
+func (s *SQLStore) RequeueAgentTasks(ctx context.Context, agent_id string) (int, error) {
+	var q = `UPDATE tasks SET lease_deadline = NULL WHERE agent_id = $1 AND lease_deadline IS NOT NULL`
+	result, err := s.db.ExecContext(ctx, q, agent_id)
+	if err != nil {
+		return 0, errors.New(`{"error": "Something went wrong"}`)
+	}
+	affected, _ := result.RowsAffected()
+	return int(affected), nil
+}
+
+// UpdateExpression меняет выражение и его задачи в одной транзакции: строка выражения блокируется,
+// update получает его состояние и задачи и возвращает изменения (см. ExpressionUpdate). Так
+// результаты задач одного выражения, пришедшие на разные оркестраторы, применяются по очереди.
+// Ошибка update отменяет транзакцию и возвращается как есть; нет выражения - sql.ErrNoRows
+func (s *SQLStore) UpdateExpression(ctx context.Context, id int, update func(state ExpressionState, tasks []TaskRecord) (ExpressionUpdate, error)) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	defer tx.Rollback()
+	var state ExpressionState
+	var ast sql.NullString
+	err = tx.QueryRowContext(ctx, `SELECT id, status, ast FROM expressions WHERE id = $1`+s.lockRows(), id).Scan(&state.Id, &state.Status, &ast)
+	if err == sql.ErrNoRows {
+		return err
+	}
+	if err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	state.AST = ast.String
+	tasks, err := queryTasks(ctx, tx, `SELECT `+taskColumns+` FROM tasks WHERE expression_id = $1 ORDER BY id`, id)
+	if err != nil {
+		return err
+	}
+	changes, err := update(state, tasks)
+	if err != nil {
+		return err
+	}
+	if changes.Status == "" {
+		return tx.Commit()
+	}
+	for _, taskID := range changes.DeleteTasks {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM tasks WHERE id = $1 AND expression_id = $2`, taskID, id); err != nil {
+			return errors.New(`{"error": "Something went wrong"}`)
+		}
+	}
+	now := time.Now().Unix()
+	switch changes.Status {
+	case "completed":
+		_, err = tx.ExecContext(ctx, `UPDATE expressions
+		SET result = $1, status = 'completed', started_at = COALESCE(started_at, $2), completed_at = $2
+		WHERE id = $3`, changes.Result, now, id)
+	case "failed":
+		_, err = tx.ExecContext(ctx, `UPDATE expressions
+		SET error = $1, status = 'failed', started_at = COALESCE(started_at, $2), completed_at = $2
+		WHERE id = $3`, changes.Error, now, id)
+	default:
+		_, err = tx.ExecContext(ctx, `UPDATE expressions
+		SET status = $1, ast = $2, started_at = CASE WHEN $1 = 'in_progress' THEN COALESCE(started_at, $3) ELSE started_at END
+		WHERE id = $4`, changes.Status, changes.AST, now, id)
+	}
+	if err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	if changes.Status == "completed" || changes.Status == "failed" {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM tasks WHERE expression_id = $1`, id); err != nil {
+			return errors.New(`{"error": "Something went wrong"}`)
+		}
+	} else {
+		for _, task := range changes.AddTasks {
+			task.ExpressionId = id
+			if _, err := insertTask(ctx, tx, task); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	return nil
+}
+
+const expressionColumns = `id, user_id, expression, status, result, error, created_at, started_at, completed_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanExpression(row rowScanner) (Expression, error) {
+	var expr Expression
+	var result sql.NullFloat64
+	var exprErr sql.NullString
+	var createdAt int64
+	var startedAt, completedAt sql.NullInt64
+	err := row.Scan(&expr.Id, &expr.UserId, &expr.Expression, &expr.Status, &result, &exprErr, &createdAt, &startedAt, &completedAt)
+	if err != nil {
+		return expr, err
+	}
+	if result.Valid {
+		expr.Result = &result.Float64
+	}
+	expr.Error = exprErr.String
+	expr.CreatedAt = unixTime(createdAt)
+	expr.StartedAt = unixTime(startedAt.Int64)
+	expr.CompletedAt = unixTime(completedAt.Int64)
+	return expr, nil
+}
+
+// unixTime переводит unix-секунды в время; 0 - время неизвестно
+func unixTime(sec int64) *time.Time {
+	if sec == 0 {
+		return nil
+	}
+	t := time.Unix(sec, 0).UTC()
+	return &t
+}
+
+// ExpressionFilter - условия выборки выражений пользователя; пустые поля не учитываются.
+// Выражения упорядочены по SortBy (id или created_at), при равных значениях - по id.
+// After - ключ последнего выражения предыдущей страницы, Limit 0 - без ограничения
+type ExpressionFilter struct {
+	Statuses []string
+	From     time.Time
+	To       time.Time
+	Search   string
+	SortBy   string
+	Desc     bool
+	After    *ExpressionCursor
+	Limit    int
+}
+
+// ExpressionCursor - позиция в выборке: значение поля сортировки и id выражения
+type ExpressionCursor struct {
+	Key int64
+	Id  int
+}
+
+const (
+	SortByID        = "id"
+	SortByCreatedAt = "created_at"
+)
+
+// CursorOf возвращает позицию выражения в выборке с этой сортировкой
+func (f ExpressionFilter) CursorOf(expr Expression) ExpressionCursor {
+	cursor := ExpressionCursor{Key: int64(expr.Id), Id: expr.Id}
+	if f.SortBy == SortByCreatedAt {
+		cursor.Key = 0
+		if expr.CreatedAt != nil {
+			cursor.Key = expr.CreatedAt.Unix()
+		}
+	}
+	return cursor
+}
+
+// escapeLike экранирует спецсимволы шаблона LIKE, чтобы поиск был по подстроке как она есть
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func (s *SQLStore) GetExpressions(ctx context.Context, user_id int, filter ExpressionFilter) ([]Expression, error) {
+	q := `SELECT ` + expressionColumns + ` FROM expressions WHERE user_id = $1`
+	args := []interface{}{user_id}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if len(filter.Statuses) > 0 {
+		placeholders := make([]string, len(filter.Statuses))
+		for i, status := range filter.Statuses {
+			placeholders[i] = arg(status)
+		}
+		q += " AND status IN (" + strings.Join(placeholders, ", ") + ")"
+	}
+	if !filter.From.IsZero() {
+		q += " AND created_at >= " + arg(filter.From.Unix())
+	}
+	if !filter.To.IsZero() {
+		q += " AND created_at <= " + arg(filter.To.Unix())
+	}
+	if filter.Search != "" {
+		q += " AND LOWER(expression) LIKE " + arg("%"+escapeLike(strings.ToLower(filter.Search))+"%") + ` ESCAPE '\'`
+	}
+	op, dir := ">", "ASC"
+	if filter.Desc {
+		op, dir = "<", "DESC"
+	}
+	order := "id " + dir
+	if filter.SortBy == SortByCreatedAt {
+		order = "created_at " + dir + ", " + order
+	}
+	if filter.After != nil {
+		if filter.SortBy == SortByCreatedAt {
+			key, id := arg(filter.After.Key), arg(filter.After.Id)
+			q += fmt.Sprintf(" AND (created_at %s %s OR created_at = %s AND id %s %s)", op, key, key, op, id)
+		} else {
+			q += fmt.Sprintf(" AND id %s %s", op, arg(filter.After.Id))
+		}
+	}
+	q += " ORDER BY " + order
+	if filter.Limit > 0 {
+		q += " LIMIT " + arg(filter.Limit)
+	}
+
+	var answ []Expression
+	rows, err := s.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, errors.New(`{"error": "Something went wrong"}`)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		expr, err := scanExpression(rows)
+		if err != nil {
+			return nil, errors.New(`{"error": "Something went wrong"}`)
+		}
+		answ = append(answ, expr)
+	}
+	return answ, nil
+}
+
+// GetExpressionByID возвращает выражение пользователя в любом состоянии; sql.ErrNoRows - такого выражения нет
+func (s *SQLStore) GetExpressionByID(ctx context.Context, user_id, id int) (Expression, error) {
+	var q = `SELECT ` + expressionColumns + ` FROM expressions WHERE user_id = $1 AND id = $2`
+	expr, err := scanExpression(s.db.QueryRowContext(ctx, q, user_id, id))
+	if err == sql.ErrNoRows {
+		return expr, err
+	}
+	if err != nil {
+		return expr, errors.New(`{"error": "Something went wrong"}`)
+	}
+	return expr, nil
+}
+
+func (s *SQLStore) SetVariable(ctx context.Context, user_id int, name string, value float64) error {
+	var q = `INSERT INTO variables (user_id, name, value) values ($1, $2, $3)
+	ON CONFLICT (user_id, name) DO UPDATE SET value = excluded.value`
+	_, err := s.db.ExecContext(ctx, q, user_id, name, value)
+	if err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	return nil
+}
+
+func (s *SQLStore) DeleteVariable(ctx context.Context, user_id int, name string) (bool, error) {
+	var q = `DELETE FROM variables WHERE user_id = $1 AND name = $2`
+	result, err := s.db.ExecContext(ctx, q, user_id, name)
+	if err != nil {
+		return false, errors.New(`{"error": "Something went wrong"}`)
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+func (s *SQLStore) GetVariables(ctx context.Context, user_id int) (map[string]float64, error) {
+	answ := make(map[string]float64)
+	var q = `SELECT name, value FROM variables WHERE user_id = $1`
+	rows, err := s.db.QueryContext(ctx, q, user_id)
+	if err != nil {
+		return nil, errors.New(`{"error": "Something went wrong"}`)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var value float64
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, errors.New(`{"error": "Something went wrong"}`)
+		}
+		answ[name] = value
+	}
+	return answ, nil
+}
+
+type AgentToken struct {
+	AgentId   string
+	CreatedAt time.Time
+}
+
+func (s *SQLStore) SetAgentToken(ctx context.Context, agent_id, token_hash string) error {
+	var q = `INSERT INTO agent_tokens (agent_id, token_hash, created_at) values ($1, $2, CURRENT_TIMESTAMP)
+	ON CONFLICT (agent_id) DO UPDATE SET token_hash = excluded.token_hash, created_at = excluded.created_at`
+	_, err := s.db.ExecContext(ctx, q, agent_id, token_hash)
+	if err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	return nil
+}
+
+func (s *SQLStore) DeleteAgentToken(ctx context.Context, agent_id string) (bool, error) {
+	var q = `DELETE FROM agent_tokens WHERE agent_id = $1`
+	result, err := s.db.ExecContext(ctx, q, agent_id)
+	if err != nil {
+		return false, errors.New(`{"error": "Something went wrong"}`)
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+func (s *SQLStore) GetAgentByToken(ctx context.Context, token_hash string) (string, error) {
+	var agentID string
+	var q = `SELECT agent_id FROM agent_tokens WHERE token_hash = $1`
+	err := s.db.QueryRowContext(ctx, q, token_hash).Scan(&agentID)
+	if err != nil {
+		return "", err
+	}
+	return agentID, nil
+}
+
+func (s *SQLStore) GetAgentTokens(ctx context.Context) ([]AgentToken, error) {
+	var answ []AgentToken
+	var q = `SELECT agent_id, created_at FROM agent_tokens ORDER BY agent_id`
+	rows, err := s.db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, errors.New(`{"error": "Something went wrong"}`)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var token AgentToken
+		if err := rows.Scan(&token.AgentId, &token.CreatedAt); err != nil {
+			return nil, errors.New(`{"error": "Something went wrong"}`)
+		}
+		answ = append(answ, token)
+	}
+	return answ, nil
+}
+
+var (
+	ErrRefreshTokenInvalid = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+type Session struct {
+	Id     string
+	UserId int
+	Login  string
+	Role   string
+}
+
+func (s *SQLStore) CreateSession(ctx context.Context, id string, user_id int, expires_at time.Time) error {
+	var q = `INSERT INTO sessions (id, user_id, expires_at) values ($1, $2, $3)`
+	_, err := s.db.ExecContext(ctx, q, id, user_id, expires_at.Unix())
+	if err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	return nil
+}
+
+// AddRefreshToken сохраняет хеш нового refresh-токена и продлевает сессию до его истечения
+func (s *SQLStore) AddRefreshToken(ctx context.Context, token_hash, session_id string, expires_at time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	defer tx.Rollback()
+	var q = `INSERT INTO refresh_tokens (token_hash, session_id, expires_at) values ($1, $2, $3)`
+	if _, err := tx.ExecContext(ctx, q, token_hash, session_id, expires_at.Unix()); err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	q = `UPDATE sessions SET expires_at = CASE WHEN expires_at < $1 THEN $1 ELSE expires_at END WHERE id = $2`
+	if _, err := tx.ExecContext(ctx, q, expires_at.Unix(), session_id); err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	return nil
+}
+
+// UseRefreshToken помечает refresh-токен использованным и возвращает его сессию.
+// Повторное предъявление уже использованного токена означает кражу: сессия отзывается целиком
+func (s *SQLStore) UseRefreshToken(ctx context.Context, token_hash string, now time.Time) (Session, error) {
+	var session Session
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return session, errors.New(`{"error": "Something went wrong"}`)
+	}
+	defer tx.Rollback()
+	var expiresAt int64
+	var usedAt, revokedAt sql.NullInt64
+	var disabled bool
+	var q = `SELECT s.id, s.user_id, u.login, u.role, u.disabled, r.expires_at, r.used_at, s.revoked_at
+	FROM refresh_tokens r JOIN sessions s ON s.id = r.session_id JOIN users u ON u.id = s.user_id
+	WHERE r.token_hash = $1`
+	err = tx.QueryRowContext(ctx, q, token_hash).Scan(&session.Id, &session.UserId, &session.Login, &session.Role, &disabled, &expiresAt, &usedAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return session, ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return session, errors.New(`{"error": "Something went wrong"}`)
+	}
+	if revokedAt.Valid || disabled || expiresAt <= now.Unix() {
+		return session, ErrRefreshTokenInvalid
+	}
+	if !usedAt.Valid {
+		q = `UPDATE refresh_tokens SET used_at = $1 WHERE token_hash = $2 AND used_at IS NULL`
+		result, err := tx.ExecContext(ctx, q, now.Unix(), token_hash)
+		if err != nil {
+			return session, errors.New(`{"error": "Something went wrong"}`)
+		}
+		if affected, _ := result.RowsAffected(); affected == 1 {
+			if err := tx.Commit(); err != nil {
+				return session, errors.New(`{"error": "Something went wrong"}`)
+			}
+			return session, nil
+		}
+	}
+	q = `UPDATE sessions SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL`
+	if _, err := tx.ExecContext(ctx, q, now.Unix(), session.Id); err != nil {
+		return session, errors.New(`{"error": "Something went wrong"}`)
+	}
+	if err := tx.Commit(); err != nil {
+		return session, errors.New(`{"error": "Something went wrong"}`)
+	}
+	return session, ErrRefreshTokenReused
+}
+
+func (s *SQLStore) RevokeSession(ctx context.Context, id string, now time.Time) error {
+	var q = `UPDATE sessions SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL`
+	_, err := s.db.ExecContext(ctx, q, now.Unix(), id)
+	if err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	return nil
+}
+
+// GetSessionByRefreshToken находит сессию refresh-токена без его использования
+func (s *SQLStore) GetSessionByRefreshToken(ctx context.Context, token_hash string) (string, error) {
+	var sessionID string
+	var q = `SELECT session_id FROM refresh_tokens WHERE token_hash = $1`
+	err := s.db.QueryRowContext(ctx, q, token_hash).Scan(&sessionID)
+	if err != nil {
+		return "", err
+	}
+	return sessionID, nil
+}
+
+func (s *SQLStore) RevokeToken(ctx context.Context, jti string, expires_at time.Time) error {
+	var q = `INSERT INTO revoked_tokens (jti, expires_at) values ($1, $2) ON CONFLICT (jti) DO NOTHING`
+	_, err := s.db.ExecContext(ctx, q, jti, expires_at.Unix())
+	if err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	return nil
+}
+
+// IsTokenRevoked проверяет, отозван ли сам JWT или сессия, в которой он выпущен.
+// Удалённая сессия (например, вместе с учётной записью) и токен без сессии тоже считаются отозванными
+func (s *SQLStore) IsTokenRevoked(ctx context.Context, jti, session_id string) (bool, error) {
+	var revoked bool
+	var q = `SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE jti = $1)
+	OR NOT EXISTS(SELECT 1 FROM sessions WHERE id = $2 AND revoked_at IS NULL)`
+	err := s.db.QueryRowContext(ctx, q, jti, session_id).Scan(&revoked)
+	if err != nil {
+		return false, errors.New(`{"error": "Something went wrong"}`)
+	}
+	return revoked, nil
+}
+
+func (s *SQLStore) PurgeExpiredTokens(ctx context.Context, now time.Time) error {
+	queries := []string{
+		`DELETE FROM revoked_tokens WHERE expires_at <= $1`,
+		`DELETE FROM login_challenges WHERE expires_at <= $1`,
+		`DELETE FROM refresh_tokens WHERE session_id IN (SELECT id FROM sessions WHERE expires_at <= $1)`,
+		`DELETE FROM sessions WHERE expires_at <= $1`,
+	}
+	for _, q := range queries {
+		if _, err := s.db.ExecContext(ctx, q, now.Unix()); err != nil {
+			return errors.New(`{"error": "Something went wrong"}`)
+		}
+	}
+	return nil
+}
+
+type APIKey struct {
+	Id         int        `json:"id"`
+	UserId     int        `json:"-"`
+	Login      string     `json:"-"`
+	Name       string     `json:"name"`
+	Scope      string     `json:"scope"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+func (s *SQLStore) AddAPIKey(ctx context.Context, user_id int, name, scope, key_hash string) (APIKey, error) {
+	var key APIKey
+	var q = `INSERT INTO api_keys (user_id, name, scope, key_hash) values ($1, $2, $3, $4)
+	RETURNING id, created_at`
+	err := s.db.QueryRowContext(ctx, q, user_id, name, scope, key_hash).Scan(&key.Id, &key.CreatedAt)
+	if err != nil {
+		return key, errors.New(`{"error": "Something went wrong"}`)
+	}
+	key.UserId = user_id
+	key.Name = name
+	key.Scope = scope
+	return key, nil
+}
+
+func (s *SQLStore) GetAPIKeys(ctx context.Context, user_id int) ([]APIKey, error) {
+	answ := []APIKey{}
+	var q = `SELECT id, name, scope, created_at, last_used_at FROM api_keys WHERE user_id = $1 ORDER BY id`
+	rows, err := s.db.QueryContext(ctx, q, user_id)
+	if err != nil {
+		return nil, errors.New(`{"error": "Something went wrong"}`)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		key := APIKey{UserId: user_id}
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&key.Id, &key.Name, &key.Scope, &key.CreatedAt, &lastUsed); err != nil {
 			return nil, errors.New(`{"error": "Something went wrong"}`)
 		}
-		expr := Expression{Id: id}
-		if result.Valid {
-			expr.Result = result.Float64
-			answ = append(answ, expr)
+		if lastUsed.Valid {
+			key.LastUsedAt = &lastUsed.Time
+		}
+		answ = append(answ, key)
+	}
+	return answ, nil
+}
+
+func (s *SQLStore) DeleteAPIKey(ctx context.Context, user_id, id int) (bool, error) {
+	var q = `DELETE FROM api_keys WHERE user_id = $1 AND id = $2`
+	result, err := s.db.ExecContext(ctx, q, user_id, id)
+	if err != nil {
+		return false, errors.New(`{"error": "Something went wrong"}`)
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+// UseAPIKey находит ключ по хешу и отмечает время его использования
+func (s *SQLStore) UseAPIKey(ctx context.Context, key_hash string) (APIKey, error) {
+	var key APIKey
+	var q = `SELECT k.id, k.user_id, u.login, k.name, k.scope, k.created_at
+	FROM api_keys k JOIN users u ON u.id = k.user_id WHERE k.key_hash = $1 AND u.disabled = 0`
+	err := s.db.QueryRowContext(ctx, q, key_hash).Scan(&key.Id, &key.UserId, &key.Login, &key.Name, &key.Scope, &key.CreatedAt)
+	if err != nil {
+		return key, err
+	}
+	q = `UPDATE api_keys SET last_used_at = CURRENT_TIMESTAMP WHERE id = $1`
+	if _, err := s.db.ExecContext(ctx, q, key.Id); err != nil {
+		return key, errors.New(`{"error": "Something went wrong"}`)
+	}
+	return key, nil
+}
+
+type User struct {
+	Id          int    `json:"id"`
+	Login       string `json:"login"`
+	Role        string `json:"role"`
+	Disabled    bool   `json:"disabled"`
+	TOTPEnabled bool   `json:"totp_enabled"`
+}
+
+func (s *SQLStore) GetUserByLogin(ctx context.Context, login string) (User, error) {
+	var user User
+	var q = `SELECT id, login, role, disabled, totp_enabled FROM users WHERE login = $1`
+	err := s.db.QueryRowContext(ctx, q, login).Scan(&user.Id, &user.Login, &user.Role, &user.Disabled, &user.TOTPEnabled)
+	if err != nil {
+		return user, err
+	}
+	return user, nil
+}
+
+func (s *SQLStore) GetUsers(ctx context.Context) ([]User, error) {
+	answ := []User{}
+	var q = `SELECT id, login, role, disabled, totp_enabled FROM users ORDER BY id`
+	rows, err := s.db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, errors.New(`{"error": "Something went wrong"}`)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.Id, &user.Login, &user.Role, &user.Disabled, &user.TOTPEnabled); err != nil {
+			return nil, errors.New(`{"error": "Something went wrong"}`)
 		}
+		answ = append(answ, user)
 	}
 	return answ, nil
 }
 
-func GetExpressionByID(ctx context.Context, user_id, id int, db *sql.DB) (Expression, error) {
-	var answ_id int
-	var answ_result sql.NullFloat64
-	var q = `SELECT id, result FROM expressions
-	WHERE user_id = $1 AND id = $2`
-	err := db.QueryRowContext(ctx, q, user_id, id).Scan(&answ_id, &answ_result)
+func (s *SQLStore) SetUserRole(ctx context.Context, login, role string) (bool, error) {
+	var q = `UPDATE users SET role = $1 WHERE login = $2`
+	result, err := s.db.ExecContext(ctx, q, role, login)
 	if err != nil {
-		return Expression{}, errors.New(`{"error": "Empty answer"}`)
+		return false, errors.New(`{"error": "Something went wrong"}`)
 	}
-	if answ_result.Valid {
-		return Expression{Id: answ_id, Result: answ_result.Float64}, nil
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+// UpdateUser меняет роль и/или блокировку пользователя; nil - поле не меняется
+func (s *SQLStore) UpdateUser(ctx context.Context, id int, role *string, disabled *bool) (bool, error) {
+	var flag *int
+	if disabled != nil {
+		flag = new(int)
+		if *disabled {
+			*flag = 1
+		}
 	}
-	return Expression{}, errors.New(`{"error": "No expression"}`)
+	var q = `UPDATE users SET role = COALESCE($1, role), disabled = COALESCE($2, disabled) WHERE id = $3`
+	result, err := s.db.ExecContext(ctx, q, role, flag, id)
+	if err != nil {
+		return false, errors.New(`{"error": "Something went wrong"}`)
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+// RevokeUserSessions отзывает все сессии пользователя, а вместе с ними и выданные в них JWT
+func (s *SQLStore) RevokeUserSessions(ctx context.Context, user_id int, now time.Time) error {
+	var q = `UPDATE sessions SET revoked_at = $1 WHERE user_id = $2 AND revoked_at IS NULL`
+	_, err := s.db.ExecContext(ctx, q, now.Unix(), user_id)
+	if err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	return nil
+}
+
+func (s *SQLStore) GetAllExpressions(ctx context.Context) ([]Expression, error) {
+	answ := []Expression{}
+	var q = `SELECT ` + expressionColumns + ` FROM expressions ORDER BY id`
+	rows, err := s.db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, errors.New(`{"error": "Something went wrong"}`)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		expr, err := scanExpression(rows)
+		if err != nil {
+			return nil, errors.New(`{"error": "Something went wrong"}`)
+		}
+		answ = append(answ, expr)
+	}
+	return answ, nil
+}
+
+// GetLoginLock возвращает самый поздний срок блокировки среди ключей
+func (s *SQLStore) GetLoginLock(ctx context.Context, keys []string) (time.Time, error) {
+	var lockedUntil int64
+	for _, key := range keys {
+		var until int64
+		var q = `SELECT locked_until FROM login_attempts WHERE key = $1`
+		err := s.db.QueryRowContext(ctx, q, key).Scan(&until)
+		if err != nil && err != sql.ErrNoRows {
+			return time.Time{}, errors.New(`{"error": "Something went wrong"}`)
+		}
+		lockedUntil = max(lockedUntil, until)
+	}
+	return time.Unix(lockedUntil, 0), nil
+}
+
+// RecordLoginFailure увеличивает счётчик неудачных попыток; попытки старше window_start не учитываются
+func (s *SQLStore) RecordLoginFailure(ctx context.Context, key string, now, window_start time.Time) (int, error) {
+	var failures int
+	var q = `INSERT INTO login_attempts (key, failures, updated_at) values ($1, 1, $2)
+	ON CONFLICT (key) DO UPDATE SET
+		failures = CASE WHEN login_attempts.updated_at < $3 THEN 1 ELSE login_attempts.failures + 1 END,
+		updated_at = excluded.updated_at
+	RETURNING failures`
+	err := s.db.QueryRowContext(ctx, q, key, now.Unix(), window_start.Unix()).Scan(&failures)
+	if err != nil {
+		return 0, errors.New(`{"error": "Something went wrong"}`)
+	}
+	return failures, nil
+}
+
+func (s *SQLStore) SetLoginLock(ctx context.Context, key string, until time.Time) error {
+	var q = `UPDATE login_attempts SET locked_until = $1 WHERE key = $2`
+	_, err := s.db.ExecContext(ctx, q, until.Unix(), key)
+	if err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	return nil
+}
+
+func (s *SQLStore) ResetLoginAttempts(ctx context.Context, key string) (bool, error) {
+	var q = `DELETE FROM login_attempts WHERE key = $1`
+	result, err := s.db.ExecContext(ctx, q, key)
+	if err != nil {
+		return false, errors.New(`{"error": "Something went wrong"}`)
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+func (s *SQLStore) GetUserByID(ctx context.Context, id int) (User, error) {
+	var user User
+	var q = `SELECT id, login, role, disabled, totp_enabled FROM users WHERE id = $1`
+	err := s.db.QueryRowContext(ctx, q, id).Scan(&user.Id, &user.Login, &user.Role, &user.Disabled, &user.TOTPEnabled)
+	if err != nil {
+		return user, err
+	}
+	return user, nil
+}
+
+func (s *SQLStore) UpdatePassword(ctx context.Context, user_id int, password string) error {
+	var q = `UPDATE users SET password = $1 WHERE id = $2`
+	_, err := s.db.ExecContext(ctx, q, password, user_id)
+	if err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	return nil
+}
+
+// DeleteUser удаляет пользователя вместе с выражениями, задачами, переменными, ключами и сессиями.
+// Возвращает идентификаторы удалённых выражений
+func (s *SQLStore) DeleteUser(ctx context.Context, user_id int) ([]int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.New(`{"error": "Something went wrong"}`)
+	}
+	defer tx.Rollback()
+	var login string
+	if err := tx.QueryRowContext(ctx, `SELECT login FROM users WHERE id = $1`, user_id).Scan(&login); err != nil {
+		return nil, err
+	}
+	var ids []int
+	// выражения блокируются раньше задач, в том же порядке, что и в UpdateExpression
+	rows, err := tx.QueryContext(ctx, `SELECT id FROM expressions WHERE user_id = $1`+s.lockRows(), user_id)
+	if err != nil {
+		return nil, errors.New(`{"error": "Something went wrong"}`)
+	}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, errors.New(`{"error": "Something went wrong"}`)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	queries := []string{
+		`DELETE FROM tasks WHERE expression_id IN (SELECT id FROM expressions WHERE user_id = $1)`,
+		`DELETE FROM expressions WHERE user_id = $1`,
+		`DELETE FROM variables WHERE user_id = $1`,
+		`DELETE FROM api_keys WHERE user_id = $1`,
+		`DELETE FROM recovery_codes WHERE user_id = $1`,
+		`DELETE FROM login_challenges WHERE user_id = $1`,
+		`DELETE FROM refresh_tokens WHERE session_id IN (SELECT id FROM sessions WHERE user_id = $1)`,
+		// JWT удалённых сессий перестают действовать, см. IsTokenRevoked
+		`DELETE FROM sessions WHERE user_id = $1`,
+		`DELETE FROM users WHERE id = $1`,
+	}
+	for _, q := range queries {
+		if _, err := tx.ExecContext(ctx, q, user_id); err != nil {
+			return nil, errors.New(`{"error": "Something went wrong"}`)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM login_attempts WHERE key = $1`, "login:"+login); err != nil {
+		return nil, errors.New(`{"error": "Something went wrong"}`)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.New(`{"error": "Something went wrong"}`)
+	}
+	return ids, nil
+}
+
+// SetTOTPSecret сохраняет секрет, который начнёт действовать после подтверждения кодом
+func (s *SQLStore) SetTOTPSecret(ctx context.Context, user_id int, secret string) error {
+	var q = `UPDATE users SET totp_secret = $1, totp_enabled = 0, totp_last_step = 0 WHERE id = $2`
+	_, err := s.db.ExecContext(ctx, q, secret, user_id)
+	if err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	return nil
+}
+
+func (s *SQLStore) GetTOTPSecret(ctx context.Context, user_id int) (string, bool, error) {
+	var secret sql.NullString
+	var enabled bool
+	var q = `SELECT totp_secret, totp_enabled FROM users WHERE id = $1`
+	err := s.db.QueryRowContext(ctx, q, user_id).Scan(&secret, &enabled)
+	if err != nil {
+		return "", false, err
+	}
+	return secret.String, enabled, nil
+}
+
+// EnableTOTP включает 2FA и заменяет коды восстановления
+func (s *SQLStore) EnableTOTP(ctx context.Context, user_id int, step int64, code_hashes []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	defer tx.Rollback()
+	var q = `UPDATE users SET totp_enabled = 1, totp_last_step = $1 WHERE id = $2`
+	if _, err := tx.ExecContext(ctx, q, step, user_id); err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, user_id); err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	for _, hash := range code_hashes {
+		q = `INSERT INTO recovery_codes (user_id, code_hash) values ($1, $2)`
+		if _, err := tx.ExecContext(ctx, q, user_id, hash); err != nil {
+			return errors.New(`{"error": "Something went wrong"}`)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	return nil
+}
+
+func (s *SQLStore) DisableTOTP(ctx context.Context, user_id int) error {
+	var q = `UPDATE users SET totp_secret = NULL, totp_enabled = 0, totp_last_step = 0 WHERE id = $1`
+	if _, err := s.db.ExecContext(ctx, q, user_id); err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, user_id); err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	return nil
+}
+
+// UseTOTPStep запоминает использованный интервал; false - код этого или более позднего интервала уже принимался
+func (s *SQLStore) UseTOTPStep(ctx context.Context, user_id int, step int64) (bool, error) {
+	var q = `UPDATE users SET totp_last_step = $1 WHERE id = $2 AND totp_last_step < $1`
+	result, err := s.db.ExecContext(ctx, q, step, user_id)
+	if err != nil {
+		return false, errors.New(`{"error": "Something went wrong"}`)
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+func (s *SQLStore) UseRecoveryCode(ctx context.Context, user_id int, code_hash string) (bool, error) {
+	var q = `DELETE FROM recovery_codes WHERE user_id = $1 AND code_hash = $2`
+	result, err := s.db.ExecContext(ctx, q, user_id, code_hash)
+	if err != nil {
+		return false, errors.New(`{"error": "Something went wrong"}`)
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+func (s *SQLStore) CreateLoginChallenge(ctx context.Context, token_hash string, user_id int, expires_at time.Time) error {
+	var q = `INSERT INTO login_challenges (token_hash, user_id, expires_at) values ($1, $2, $3)`
+	_, err := s.db.ExecContext(ctx, q, token_hash, user_id, expires_at.Unix())
+	if err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	return nil
+}
+
+// GetLoginChallenge возвращает пользователя, прошедшего первый шаг входа
+func (s *SQLStore) GetLoginChallenge(ctx context.Context, token_hash string, now time.Time) (User, error) {
+	var user User
+	var q = `SELECT u.id, u.login, u.role, u.disabled, u.totp_enabled
+	FROM login_challenges c JOIN users u ON u.id = c.user_id
+	WHERE c.token_hash = $1 AND c.expires_at > $2`
+	err := s.db.QueryRowContext(ctx, q, token_hash, now.Unix()).Scan(&user.Id, &user.Login, &user.Role, &user.Disabled, &user.TOTPEnabled)
+	if err != nil {
+		return user, err
+	}
+	return user, nil
+}
+
+func (s *SQLStore) DeleteLoginChallenge(ctx context.Context, token_hash string) error {
+	var q = `DELETE FROM login_challenges WHERE token_hash = $1`
+	_, err := s.db.ExecContext(ctx, q, token_hash)
+	if err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	return nil
+}
+
+type AuditEvent struct {
+	Id        int       `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Event     string    `json:"event"`
+	ActorId   int       `json:"actor_id,omitempty"`
+	Actor     string    `json:"actor,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Details   string    `json:"details,omitempty"`
+}
+
+// AuditFilter - условия выборки журнала аудита; пустые поля не учитываются
+type AuditFilter struct {
+	Event   string
+	Actor   string
+	ActorId int
+	IP      string
+	Outcome string
+	From    time.Time
+	To      time.Time
+	Limit   int
+}
+
+func (s *SQLStore) AddAuditEvent(ctx context.Context, event AuditEvent) error {
+	var q = `INSERT INTO audit_log (created_at, event, actor_id, actor, ip, outcome, details) values ($1, $2, $3, $4, $5, $6, $7)`
+	_, err := s.db.ExecContext(ctx, q, event.CreatedAt.Unix(), event.Event, event.ActorId, event.Actor, event.IP, event.Outcome, event.Details)
+	if err != nil {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	return nil
+}
+
+// GetAuditEvents возвращает записи журнала от новых к старым
+func (s *SQLStore) GetAuditEvents(ctx context.Context, filter AuditFilter) ([]AuditEvent, error) {
+	q := `SELECT id, created_at, event, actor_id, actor, ip, outcome, details FROM audit_log WHERE 1 = 1`
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		q += fmt.Sprintf(" AND %s $%d", cond, len(args))
+	}
+	if filter.Event != "" {
+		add("event =", filter.Event)
+	}
+	if filter.Actor != "" {
+		add("actor =", filter.Actor)
+	}
+	if filter.ActorId != 0 {
+		add("actor_id =", filter.ActorId)
+	}
+	if filter.IP != "" {
+		add("ip =", filter.IP)
+	}
+	if filter.Outcome != "" {
+		add("outcome =", filter.Outcome)
+	}
+	if !filter.From.IsZero() {
+		add("created_at >=", filter.From.Unix())
+	}
+	if !filter.To.IsZero() {
+		add("created_at <=", filter.To.Unix())
+	}
+	args = append(args, filter.Limit)
+	q += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d", len(args))
+
+	answ := []AuditEvent{}
+	rows, err := s.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, errors.New(`{"error": "Something went wrong"}`)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event AuditEvent
+		var createdAt int64
+		if err := rows.Scan(&event.Id, &createdAt, &event.Event, &event.ActorId, &event.Actor, &event.IP, &event.Outcome, &event.Details); err != nil {
+			return nil, errors.New(`{"error": "Something went wrong"}`)
+		}
+		event.CreatedAt = time.Unix(createdAt, 0).UTC()
+		answ = append(answ, event)
+	}
+	return answ, nil
 }
@@ -0,0 +1,996 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type memUser struct {
+	User
+	password     string
+	totpSecret   string
+	totpLastStep int64
+}
+
+type memExpression struct {
+	Expression
+	ast *string
+}
+
+type memSession struct {
+	userID    int
+	expiresAt int64
+	revoked   bool
+}
+
+type memRefreshToken struct {
+	sessionID string
+	expiresAt int64
+	used      bool
+}
+
+type memAPIKey struct {
+	APIKey
+	hash string
+}
+
+type memLoginAttempt struct {
+	failures    int
+	lockedUntil int64
+	updatedAt   int64
+}
+
+type memChallenge struct {
+	userID    int
+	expiresAt int64
+}
+
+type memAgentToken struct {
+	hash      string
+	createdAt time.Time
+}
+
+// MemoryStore хранит данные в памяти процесса. Поведение совпадает с SQLStore, поэтому
+// обработчики можно тестировать без файла базы данных
+type MemoryStore struct {
+	mu            sync.Mutex
+	users         map[int]*memUser
+	expressions   map[int]*memExpression
+	tasks         map[int]TaskRecord
+	variables     map[int]map[string]float64
+	agentTokens   map[string]memAgentToken
+	sessions      map[string]*memSession
+	refreshTokens map[string]*memRefreshToken
+	revokedTokens map[string]int64
+	apiKeys       map[int]*memAPIKey
+	loginAttempts map[string]*memLoginAttempt
+	recoveryCodes map[int]map[string]bool
+	challenges    map[string]memChallenge
+	audit         []AuditEvent
+	lastID        map[string]int
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:         make(map[int]*memUser),
+		expressions:   make(map[int]*memExpression),
+		tasks:         make(map[int]TaskRecord),
+		variables:     make(map[int]map[string]float64),
+		agentTokens:   make(map[string]memAgentToken),
+		sessions:      make(map[string]*memSession),
+		refreshTokens: make(map[string]*memRefreshToken),
+		revokedTokens: make(map[string]int64),
+		apiKeys:       make(map[int]*memAPIKey),
+		loginAttempts: make(map[string]*memLoginAttempt),
+		recoveryCodes: make(map[int]map[string]bool),
+		challenges:    make(map[string]memChallenge),
+		lastID:        make(map[string]int),
+	}
+}
+
+// nextID выдаёт идентификаторы как AUTOINCREMENT: без повторного использования удалённых
+func (s *MemoryStore) nextID(table string) int {
+	s.lastID[table]++
+	return s.lastID[table]
+}
+
+// now - текущее время с точностью до секунды, как CURRENT_TIMESTAMP в SQLite
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+func (s *MemoryStore) userByLogin(login string) *memUser {
+	for _, user := range s.users {
+		if user.Login == login {
+			return user
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) InsertUsers(ctx context.Context, login, password string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.userByLogin(login) != nil {
+		return fmt.Errorf("user '%s' already exists", login)
+	}
+	id := s.nextID("users")
+	s.users[id] = &memUser{User: User{Id: id, Login: login, Role: "user"}, password: password}
+	return nil
+}
+
+func (s *MemoryStore) GetUserID(ctx context.Context, login string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user := s.userByLogin(login); user != nil {
+		return user.Id
+	}
+	return 0
+}
+
+func (s *MemoryStore) IsAuth(ctx context.Context, login, password string) bool {
+	s.mu.Lock()
+	user := s.userByLogin(login)
+	s.mu.Unlock()
+	if user == nil {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(user.password), []byte(password)) == nil
+}
+
+func (s *MemoryStore) GetUserByLogin(ctx context.Context, login string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user := s.userByLogin(login)
+	if user == nil {
+		return User{}, sql.ErrNoRows
+	}
+	return user.User, nil
+}
+
+func (s *MemoryStore) GetUserByID(ctx context.Context, id int) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[id]
+	if !ok {
+		return User{}, sql.ErrNoRows
+	}
+	return user.User, nil
+}
+
+func (s *MemoryStore) GetUsers(ctx context.Context) ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	answ := []User{}
+	for _, user := range s.users {
+		answ = append(answ, user.User)
+	}
+	sort.Slice(answ, func(i, j int) bool { return answ[i].Id < answ[j].Id })
+	return answ, nil
+}
+
+func (s *MemoryStore) SetUserRole(ctx context.Context, login, role string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user := s.userByLogin(login)
+	if user == nil {
+		return false, nil
+	}
+	user.Role = role
+	return true, nil
+}
+
+func (s *MemoryStore) UpdateUser(ctx context.Context, id int, role *string, disabled *bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[id]
+	if !ok {
+		return false, nil
+	}
+	if role != nil {
+		user.Role = *role
+	}
+	if disabled != nil {
+		user.Disabled = *disabled
+	}
+	return true, nil
+}
+
+func (s *MemoryStore) UpdatePassword(ctx context.Context, user_id int, password string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user, ok := s.users[user_id]; ok {
+		user.password = password
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteUser(ctx context.Context, user_id int) ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[user_id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	var ids []int
+	for id, expr := range s.expressions {
+		if expr.UserId == user_id {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		s.deleteExpressionTasks(id)
+		delete(s.expressions, id)
+	}
+	delete(s.variables, user_id)
+	for id, key := range s.apiKeys {
+		if key.UserId == user_id {
+			delete(s.apiKeys, id)
+		}
+	}
+	delete(s.recoveryCodes, user_id)
+	for hash, challenge := range s.challenges {
+		if challenge.userID == user_id {
+			delete(s.challenges, hash)
+		}
+	}
+	for hash, token := range s.refreshTokens {
+		if session, ok := s.sessions[token.sessionID]; ok && session.userID == user_id {
+			delete(s.refreshTokens, hash)
+		}
+	}
+	for id, session := range s.sessions {
+		if session.userID == user_id {
+			delete(s.sessions, id)
+		}
+	}
+	delete(s.users, user_id)
+	delete(s.loginAttempts, "login:"+user.Login)
+	return ids, nil
+}
+
+func (s *MemoryStore) AddExpression(ctx context.Context, user_id int, expression string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.nextID("expressions")
+	s.expressions[id] = &memExpression{Expression: Expression{
+		Id:         id,
+		UserId:     user_id,
+		Expression: expression,
+		Status:     "pending",
+		CreatedAt:  unixTime(time.Now().Unix()),
+	}}
+	return id, nil
+}
+
+// finish завершает выражение с указанным статусом; вызывается под s.mu
+func (e *memExpression) finish(status string) {
+	e.Status = status
+	e.CompletedAt = unixTime(time.Now().Unix())
+	if e.StartedAt == nil {
+		e.StartedAt = e.CompletedAt
+	}
+}
+
+func (s *MemoryStore) AddAnswer(ctx context.Context, id int, result float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if expr, ok := s.expressions[id]; ok {
+		expr.Result = &result
+		expr.finish("completed")
+	}
+	return nil
+}
+
+func (s *MemoryStore) AddError(ctx context.Context, id int, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if expr, ok := s.expressions[id]; ok {
+		expr.Error = message
+		expr.finish("failed")
+	}
+	return nil
+}
+
+func (s *MemoryStore) SaveExpressionState(ctx context.Context, id int, status, ast string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if expr, ok := s.expressions[id]; ok {
+		expr.Status = status
+		expr.ast = &ast
+		if status == "in_progress" && expr.StartedAt == nil {
+			expr.StartedAt = unixTime(time.Now().Unix())
+		}
+	}
+	return nil
+}
+
+// sortedExpressions возвращает выражения по возрастанию id; вызывается под s.mu
+func (s *MemoryStore) sortedExpressions() []*memExpression {
+	answ := make([]*memExpression, 0, len(s.expressions))
+	for _, expr := range s.expressions {
+		answ = append(answ, expr)
+	}
+	sort.Slice(answ, func(i, j int) bool { return answ[i].Id < answ[j].Id })
+	return answ
+}
+
+func (s *MemoryStore) GetUnfinishedExpressions(ctx context.Context) ([]ExpressionState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var answ []ExpressionState
+	for _, expr := range s.sortedExpressions() {
+		if (expr.Status == "pending" || expr.Status == "in_progress") && expr.ast != nil {
+			answ = append(answ, ExpressionState{Id: expr.Id, Status: expr.Status, AST: *expr.ast})
+		}
+	}
+	return answ, nil
+}
+
+func (s *MemoryStore) GetExpressions(ctx context.Context, user_id int, filter ExpressionFilter) ([]Expression, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var answ []Expression
+	for _, expr := range s.sortedExpressions() {
+		if expr.UserId == user_id && filter.matches(expr.Expression) {
+			answ = append(answ, expr.Expression)
+		}
+	}
+	// less - строгий порядок выборки по ключу сортировки, затем по id
+	less := func(a, b ExpressionCursor) bool {
+		if a.Key != b.Key {
+			return a.Key < b.Key != filter.Desc
+		}
+		return a.Id != b.Id && a.Id < b.Id != filter.Desc
+	}
+	sort.SliceStable(answ, func(i, j int) bool { return less(filter.CursorOf(answ[i]), filter.CursorOf(answ[j])) })
+	if filter.After != nil {
+		start := sort.Search(len(answ), func(i int) bool { return less(*filter.After, filter.CursorOf(answ[i])) })
+		answ = answ[start:]
+	}
+	if filter.Limit > 0 && len(answ) > filter.Limit {
+		answ = answ[:filter.Limit]
+	}
+	return answ, nil
+}
+
+// matches проверяет условия фильтра, кроме позиции и количества
+func (f ExpressionFilter) matches(expr Expression) bool {
+	if len(f.Statuses) > 0 && !slices.Contains(f.Statuses, expr.Status) {
+		return false
+	}
+	var created int64
+	if expr.CreatedAt != nil {
+		created = expr.CreatedAt.Unix()
+	}
+	switch {
+	case !f.From.IsZero() && created < f.From.Unix(),
+		!f.To.IsZero() && created > f.To.Unix(),
+		f.Search != "" && !strings.Contains(strings.ToLower(expr.Expression), strings.ToLower(f.Search)):
+		return false
+	}
+	return true
+}
+
+func (s *MemoryStore) GetExpressionByID(ctx context.Context, user_id, id int) (Expression, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expr, ok := s.expressions[id]
+	if !ok || expr.UserId != user_id {
+		return Expression{}, sql.ErrNoRows
+	}
+	return expr.Expression, nil
+}
+
+func (s *MemoryStore) GetAllExpressions(ctx context.Context) ([]Expression, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	answ := []Expression{}
+	for _, expr := range s.sortedExpressions() {
+		answ = append(answ, expr.Expression)
+	}
+	return answ, nil
+}
+
+func (s *MemoryStore) AddTask(ctx context.Context, task TaskRecord) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task.Id = s.nextID("tasks")
+	task.Args = append([]float64(nil), task.Args...)
+	s.tasks[task.Id] = task
+	return task.Id, nil
+}
+
+func (s *MemoryStore) DeleteTask(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tasks, id)
+	return nil
+}
+
+// deleteExpressionTasks вызывается под s.mu
+func (s *MemoryStore) deleteExpressionTasks(expression_id int) {
+	for id, task := range s.tasks {
+		if task.ExpressionId == expression_id {
+			delete(s.tasks, id)
+		}
+	}
+}
+
+func (s *MemoryStore) DeleteExpressionTasks(ctx context.Context, expression_id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleteExpressionTasks(expression_id)
+	return nil
+}
+
+func (s *MemoryStore) GetTasks(ctx context.Context) ([]TaskRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var answ []TaskRecord
+	for _, task := range s.sortedTasks() {
+		answ = append(answ, task)
+	}
+	return answ, nil
+}
+
+func (s *MemoryStore) GetTask(ctx context.Context, id int) (TaskRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task, ok := s.tasks[id]
+	if !ok {
+		return TaskRecord{}, sql.ErrNoRows
+	}
+	task.Args = append([]float64(nil), task.Args...)
+	return task, nil
+}
+
+// sortedTasks возвращает задачи по возрастанию id; вызывается под s.mu
+func (s *MemoryStore) sortedTasks() []TaskRecord {
+	answ := make([]TaskRecord, 0, len(s.tasks))
+	for _, task := range s.tasks {
+		task.Args = append([]float64(nil), task.Args...)
+		answ = append(answ, task)
+	}
+	sort.Slice(answ, func(i, j int) bool { return answ[i].Id < answ[j].Id })
+	return answ
+}
+
+func (s *MemoryStore) LeaseTasks(ctx context.Context, agent_id string, operations []string, max int, deadline time.Time) ([]TaskRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var answ []TaskRecord
+	for _, task := range s.sortedTasks() {
+		if len(answ) >= max {
+			break
+		}
+		if !task.LeaseDeadline.IsZero() || len(operations) > 0 && !slices.Contains(operations, task.Operation) {
+			continue
+		}
+		task.AgentId = agent_id
+		task.LeaseDeadline = time.UnixMilli(deadline.UnixMilli() + int64(task.OperationTime))
+		s.tasks[task.Id] = task
+		answ = append(answ, task)
+		if expr, ok := s.expressions[task.ExpressionId]; ok && expr.Status == "pending" {
+			expr.Status = "in_progress"
+			if expr.StartedAt == nil {
+				expr.StartedAt = unixTime(time.Now().Unix())
+			}
+		}
+	}
+	return answ, nil
+}
+
+func (s *MemoryStore) RequeueExpiredTasks(ctx context.Context, now time.Time) ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []int
+	for _, task := range s.sortedTasks() {
+		if !task.LeaseDeadline.IsZero() && task.LeaseDeadline.UnixMilli() < now.UnixMilli() {
+			task.LeaseDeadline = time.Time{}
+			s.tasks[task.Id] = task
+			ids = append(ids, task.Id)
+		}
+	}
+	return ids, nil
+}
+
+func (s *MemoryStore) RequeueAgentTasks(ctx context.Context, agent_id string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requeued := 0
+	for id, task := range s.tasks {
+		if task.AgentId == agent_id && !task.LeaseDeadline.IsZero() {
+			task.LeaseDeadline = time.Time{}
+			s.tasks[id] = task
+			requeued++
+		}
+	}
+	return requeued, nil
+}
+
+// UpdateExpression вызывает update под s.mu, поэтому update не должна обращаться к хранилищу
+func (s *MemoryStore) UpdateExpression(ctx context.Context, id int, update func(state ExpressionState, tasks []TaskRecord) (ExpressionUpdate, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expr, ok := s.expressions[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	state := ExpressionState{Id: id, Status: expr.Status}
+	if expr.ast != nil {
+		state.AST = *expr.ast
+	}
+	var tasks []TaskRecord
+	for _, task := range s.sortedTasks() {
+		if task.ExpressionId == id {
+			tasks = append(tasks, task)
+		}
+	}
+	changes, err := update(state, tasks)
+	if err != nil || changes.Status == "" {
+		return err
+	}
+	for _, taskID := range changes.DeleteTasks {
+		if task, ok := s.tasks[taskID]; ok && task.ExpressionId == id {
+			delete(s.tasks, taskID)
+		}
+	}
+	switch changes.Status {
+	case "completed":
+		expr.Result = &changes.Result
+		expr.finish("completed")
+		s.deleteExpressionTasks(id)
+	case "failed":
+		expr.Error = changes.Error
+		expr.finish("failed")
+		s.deleteExpressionTasks(id)
+	default:
+		expr.Status = changes.Status
+		expr.ast = &changes.AST
+		if changes.Status == "in_progress" && expr.StartedAt == nil {
+			expr.StartedAt = unixTime(time.Now().Unix())
+		}
+		for _, task := range changes.AddTasks {
+			task.Id = s.nextID("tasks")
+			task.ExpressionId = id
+			task.Args = append([]float64(nil), task.Args...)
+			s.tasks[task.Id] = task
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) SetVariable(ctx context.Context, user_id int, name string, value float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.variables[user_id] == nil {
+		s.variables[user_id] = make(map[string]float64)
+	}
+	s.variables[user_id][name] = value
+	return nil
+}
+
+func (s *MemoryStore) DeleteVariable(ctx context.Context, user_id int, name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.variables[user_id][name]
+	delete(s.variables[user_id], name)
+	return ok, nil
+}
+
+func (s *MemoryStore) GetVariables(ctx context.Context, user_id int) (map[string]float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	answ := make(map[string]float64)
+	for name, value := range s.variables[user_id] {
+		answ[name] = value
+	}
+	return answ, nil
+}
+
+func (s *MemoryStore) SetAgentToken(ctx context.Context, agent_id, token_hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.agentTokens[agent_id] = memAgentToken{hash: token_hash, createdAt: now()}
+	return nil
+}
+
+func (s *MemoryStore) DeleteAgentToken(ctx context.Context, agent_id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.agentTokens[agent_id]
+	delete(s.agentTokens, agent_id)
+	return ok, nil
+}
+
+func (s *MemoryStore) GetAgentByToken(ctx context.Context, token_hash string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for agentID, token := range s.agentTokens {
+		if token.hash == token_hash {
+			return agentID, nil
+		}
+	}
+	return "", sql.ErrNoRows
+}
+
+func (s *MemoryStore) GetAgentTokens(ctx context.Context) ([]AgentToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var answ []AgentToken
+	for agentID, token := range s.agentTokens {
+		answ = append(answ, AgentToken{AgentId: agentID, CreatedAt: token.createdAt})
+	}
+	sort.Slice(answ, func(i, j int) bool { return answ[i].AgentId < answ[j].AgentId })
+	return answ, nil
+}
+
+func (s *MemoryStore) CreateSession(ctx context.Context, id string, user_id int, expires_at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[id]; ok {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	s.sessions[id] = &memSession{userID: user_id, expiresAt: expires_at.Unix()}
+	return nil
+}
+
+func (s *MemoryStore) AddRefreshToken(ctx context.Context, token_hash, session_id string, expires_at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.refreshTokens[token_hash]; ok {
+		return errors.New(`{"error": "Something went wrong"}`)
+	}
+	s.refreshTokens[token_hash] = &memRefreshToken{sessionID: session_id, expiresAt: expires_at.Unix()}
+	if session, ok := s.sessions[session_id]; ok {
+		session.expiresAt = max(session.expiresAt, expires_at.Unix())
+	}
+	return nil
+}
+
+func (s *MemoryStore) UseRefreshToken(ctx context.Context, token_hash string, now time.Time) (Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var session Session
+	token, ok := s.refreshTokens[token_hash]
+	if !ok {
+		return session, ErrRefreshTokenInvalid
+	}
+	stored, ok := s.sessions[token.sessionID]
+	if !ok {
+		return session, ErrRefreshTokenInvalid
+	}
+	user, ok := s.users[stored.userID]
+	if !ok {
+		return session, ErrRefreshTokenInvalid
+	}
+	session = Session{Id: token.sessionID, UserId: user.Id, Login: user.Login, Role: user.Role}
+	if stored.revoked || user.Disabled || token.expiresAt <= now.Unix() {
+		return session, ErrRefreshTokenInvalid
+	}
+	if !token.used {
+		token.used = true
+		return session, nil
+	}
+	stored.revoked = true
+	return session, ErrRefreshTokenReused
+}
+
+func (s *MemoryStore) RevokeSession(ctx context.Context, id string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, ok := s.sessions[id]; ok {
+		session.revoked = true
+	}
+	return nil
+}
+
+func (s *MemoryStore) RevokeUserSessions(ctx context.Context, user_id int, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, session := range s.sessions {
+		if session.userID == user_id {
+			session.revoked = true
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetSessionByRefreshToken(ctx context.Context, token_hash string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.refreshTokens[token_hash]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return token.sessionID, nil
+}
+
+func (s *MemoryStore) RevokeToken(ctx context.Context, jti string, expires_at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.revokedTokens[jti]; !ok {
+		s.revokedTokens[jti] = expires_at.Unix()
+	}
+	return nil
+}
+
+func (s *MemoryStore) IsTokenRevoked(ctx context.Context, jti, session_id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.revokedTokens[jti]; ok {
+		return true, nil
+	}
+	session, ok := s.sessions[session_id]
+	return !ok || session.revoked, nil
+}
+
+func (s *MemoryStore) PurgeExpiredTokens(ctx context.Context, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for jti, expiresAt := range s.revokedTokens {
+		if expiresAt <= now.Unix() {
+			delete(s.revokedTokens, jti)
+		}
+	}
+	for hash, challenge := range s.challenges {
+		if challenge.expiresAt <= now.Unix() {
+			delete(s.challenges, hash)
+		}
+	}
+	for hash, token := range s.refreshTokens {
+		if session, ok := s.sessions[token.sessionID]; ok && session.expiresAt <= now.Unix() {
+			delete(s.refreshTokens, hash)
+		}
+	}
+	for id, session := range s.sessions {
+		if session.expiresAt <= now.Unix() {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) AddAPIKey(ctx context.Context, user_id int, name, scope, key_hash string) (APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range s.apiKeys {
+		if key.hash == key_hash {
+			return APIKey{}, errors.New(`{"error": "Something went wrong"}`)
+		}
+	}
+	key := APIKey{Id: s.nextID("api_keys"), UserId: user_id, Name: name, Scope: scope, CreatedAt: now()}
+	s.apiKeys[key.Id] = &memAPIKey{APIKey: key, hash: key_hash}
+	return key, nil
+}
+
+func (s *MemoryStore) GetAPIKeys(ctx context.Context, user_id int) ([]APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	answ := []APIKey{}
+	for _, key := range s.apiKeys {
+		if key.UserId == user_id {
+			item := key.APIKey
+			item.Login = ""
+			answ = append(answ, item)
+		}
+	}
+	sort.Slice(answ, func(i, j int) bool { return answ[i].Id < answ[j].Id })
+	return answ, nil
+}
+
+func (s *MemoryStore) DeleteAPIKey(ctx context.Context, user_id, id int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.apiKeys[id]
+	if !ok || key.UserId != user_id {
+		return false, nil
+	}
+	delete(s.apiKeys, id)
+	return true, nil
+}
+
+func (s *MemoryStore) UseAPIKey(ctx context.Context, key_hash string) (APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range s.apiKeys {
+		user, ok := s.users[key.UserId]
+		if key.hash != key_hash || !ok || user.Disabled {
+			continue
+		}
+		answ := key.APIKey
+		answ.Login = user.Login
+		answ.LastUsedAt = nil
+		used := now()
+		key.LastUsedAt = &used
+		return answ, nil
+	}
+	return APIKey{}, sql.ErrNoRows
+}
+
+func (s *MemoryStore) GetLoginLock(ctx context.Context, keys []string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var lockedUntil int64
+	for _, key := range keys {
+		if attempt, ok := s.loginAttempts[key]; ok {
+			lockedUntil = max(lockedUntil, attempt.lockedUntil)
+		}
+	}
+	return time.Unix(lockedUntil, 0), nil
+}
+
+func (s *MemoryStore) RecordLoginFailure(ctx context.Context, key string, now, window_start time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempt, ok := s.loginAttempts[key]
+	if !ok {
+		attempt = &memLoginAttempt{}
+		s.loginAttempts[key] = attempt
+	}
+	if attempt.updatedAt < window_start.Unix() {
+		attempt.failures = 0
+	}
+	attempt.failures++
+	attempt.updatedAt = now.Unix()
+	return attempt.failures, nil
+}
+
+func (s *MemoryStore) SetLoginLock(ctx context.Context, key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if attempt, ok := s.loginAttempts[key]; ok {
+		attempt.lockedUntil = until.Unix()
+	}
+	return nil
+}
+
+func (s *MemoryStore) ResetLoginAttempts(ctx context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.loginAttempts[key]
+	delete(s.loginAttempts, key)
+	return ok, nil
+}
+
+func (s *MemoryStore) SetTOTPSecret(ctx context.Context, user_id int, secret string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user, ok := s.users[user_id]; ok {
+		user.totpSecret = secret
+		user.TOTPEnabled = false
+		user.totpLastStep = 0
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetTOTPSecret(ctx context.Context, user_id int) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[user_id]
+	if !ok {
+		return "", false, sql.ErrNoRows
+	}
+	return user.totpSecret, user.TOTPEnabled, nil
+}
+
+func (s *MemoryStore) EnableTOTP(ctx context.Context, user_id int, step int64, code_hashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user, ok := s.users[user_id]; ok {
+		user.TOTPEnabled = true
+		user.totpLastStep = step
+	}
+	codes := make(map[string]bool, len(code_hashes))
+	for _, hash := range code_hashes {
+		codes[hash] = true
+	}
+	s.recoveryCodes[user_id] = codes
+	return nil
+}
+
+func (s *MemoryStore) DisableTOTP(ctx context.Context, user_id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user, ok := s.users[user_id]; ok {
+		user.totpSecret = ""
+		user.TOTPEnabled = false
+		user.totpLastStep = 0
+	}
+	delete(s.recoveryCodes, user_id)
+	return nil
+}
+
+func (s *MemoryStore) UseTOTPStep(ctx context.Context, user_id int, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[user_id]
+	if !ok || user.totpLastStep >= step {
+		return false, nil
+	}
+	user.totpLastStep = step
+	return true, nil
+}
+
+func (s *MemoryStore) UseRecoveryCode(ctx context.Context, user_id int, code_hash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ok := s.recoveryCodes[user_id][code_hash]
+	delete(s.recoveryCodes[user_id], code_hash)
+	return ok, nil
+}
+
+func (s *MemoryStore) CreateLoginChallenge(ctx context.Context, token_hash string, user_id int, expires_at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.challenges[token_hash] = memChallenge{userID: user_id, expiresAt: expires_at.Unix()}
+	return nil
+}
+
+func (s *MemoryStore) GetLoginChallenge(ctx context.Context, token_hash string, now time.Time) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	challenge, ok := s.challenges[token_hash]
+	if !ok || challenge.expiresAt <= now.Unix() {
+		return User{}, sql.ErrNoRows
+	}
+	user, ok := s.users[challenge.userID]
+	if !ok {
+		return User{}, sql.ErrNoRows
+	}
+	return user.User, nil
+}
+
+func (s *MemoryStore) DeleteLoginChallenge(ctx context.Context, token_hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.challenges, token_hash)
+	return nil
+}
+
+func (s *MemoryStore) AddAuditEvent(ctx context.Context, event AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	event.Id = len(s.audit) + 1
+	event.CreatedAt = time.Unix(event.CreatedAt.Unix(), 0).UTC()
+	s.audit = append(s.audit, event)
+	return nil
+}
+
+func (s *MemoryStore) GetAuditEvents(ctx context.Context, filter AuditFilter) ([]AuditEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	answ := []AuditEvent{}
+	for i := len(s.audit) - 1; i >= 0 && len(answ) < filter.Limit; i-- {
+		event := s.audit[i]
+		switch {
+		case filter.Event != "" && event.Event != filter.Event,
+			filter.Actor != "" && event.Actor != filter.Actor,
+			filter.ActorId != 0 && event.ActorId != filter.ActorId,
+			filter.IP != "" && event.IP != filter.IP,
+			filter.Outcome != "" && event.Outcome != filter.Outcome,
+			!filter.From.IsZero() && event.CreatedAt.Unix() < filter.From.Unix(),
+			!filter.To.IsZero() && event.CreatedAt.Unix() > filter.To.Unix():
+			continue
+		}
+		answ = append(answ, event)
+	}
+	return answ, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,267 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Миграции лежат в migrations/NNNN_name.sql и применяются по возрастанию номера, каждая в своей транзакции.
+// Операторы в файле разделяются точкой с запятой в конце строки, поэтому тело триггера пишется в одну строку.
+// ALTER TABLE ... ADD COLUMN пропускается, если столбец уже есть: так обновляются и базы, созданные
+// до появления миграций, когда все таблицы создавались сразу в актуальном виде.
+// Для PostgreSQL рядом может лежать NNNN_name.postgres.sql, который заменяет общий файл
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+	// Postgres - SQL для PostgreSQL, если он отличается от общего
+	Postgres string
+}
+
+type MigrationState struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+var (
+	migrationName   = regexp.MustCompile(`^(\d+)_(\w+)(\.postgres)?\.sql$`)
+	statementEnd    = regexp.MustCompile(`;[ \t]*\r?\n`)
+	addColumnClause = regexp.MustCompile(`(?is)^ALTER\s+TABLE\s+(\w+)\s+ADD\s+COLUMN\s+(\w+)`)
+)
+
+func Migrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	var postgres []Migration
+	for _, entry := range entries {
+		match := migrationName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %s", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		content, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if match[3] != "" {
+			postgres = append(postgres, Migration{Version: version, Name: match[2], Postgres: string(content)})
+			continue
+		}
+		if byVersion[version] != nil {
+			return nil, fmt.Errorf("duplicate migration version %d", version)
+		}
+		byVersion[version] = &Migration{Version: version, Name: match[2], SQL: string(content)}
+	}
+	for _, p := range postgres {
+		m := byVersion[p.Version]
+		if m == nil || m.Name != p.Name {
+			return nil, fmt.Errorf("migration %04d_%s.postgres.sql has no common version", p.Version, p.Name)
+		}
+		m.Postgres = p.Postgres
+	}
+	var migrations []Migration
+	for _, m := range byVersion {
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// LatestVersion возвращает номер последней встроенной миграции
+func LatestVersion() int {
+	migrations, err := Migrations()
+	if err != nil || len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+func createMigrationsTable(ctx context.Context, db *sql.DB) error {
+	q := `
+	CREATE TABLE IF NOT EXISTS schema_migrations(
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at INTEGER NOT NULL
+	);`
+	if isPostgres(db) {
+		q = postgresStatement(q)
+	}
+	_, err := db.ExecContext(ctx, q)
+	return err
+}
+
+func appliedMigrations(ctx context.Context, db *sql.DB) (map[int]time.Time, error) {
+	if err := createMigrationsTable(ctx, db); err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = time.Unix(appliedAt, 0)
+	}
+	return applied, rows.Err()
+}
+
+// SchemaVersion возвращает номер последней применённой миграции; 0 - база ещё не мигрирована
+func SchemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	version := 0
+	for v := range applied {
+		version = max(version, v)
+	}
+	return version, nil
+}
+
+func MigrationStatus(ctx context.Context, db *sql.DB) ([]MigrationState, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	states := make([]MigrationState, 0, len(migrations))
+	for _, m := range migrations {
+		state := MigrationState{Version: m.Version, Name: m.Name}
+		if at, ok := applied[m.Version]; ok {
+			state.AppliedAt = &at
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// Migrate применяет все неприменённые миграции с номером не больше version.
+// Откат не поддерживается: если база новее version, возвращается ошибка
+func Migrate(ctx context.Context, version int, db *sql.DB) error {
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+	if version < 0 || version > LatestVersion() {
+		return fmt.Errorf("unknown schema version %d, latest is %d", version, LatestVersion())
+	}
+	current, err := SchemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	if current > version {
+		return fmt.Errorf("database schema version %d is newer than %d, downgrade is not supported", current, version)
+	}
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.Version > version {
+			break
+		}
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		ok, err := applyMigration(ctx, m, db)
+		if err != nil {
+			return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		if ok {
+			log.Printf("Applied migration %04d_%s", m.Version, m.Name)
+		}
+	}
+	return nil
+}
+
+// migrationLock - ключ advisory-блокировки PostgreSQL: несколько оркестраторов, запущенных
+// одновременно на одной базе, применяют миграции по очереди
+const migrationLock = 20240301
+
+// applyMigration применяет миграцию; false - её уже применил другой процесс
+func applyMigration(ctx context.Context, m Migration, db *sql.DB) (bool, error) {
+	postgres := isPostgres(db)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	text := m.SQL
+	if postgres {
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLock); err != nil {
+			return false, err
+		}
+		var applied bool
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM schema_migrations WHERE version = $1)`, m.Version).Scan(&applied); err != nil {
+			return false, err
+		}
+		if applied {
+			return false, nil
+		}
+		if m.Postgres != "" {
+			text = m.Postgres
+		}
+	}
+	for _, stmt := range statementEnd.Split(text, -1) {
+		if strings.TrimSpace(stripComments(stmt)) == "" {
+			continue
+		}
+		if postgres {
+			stmt = postgresStatement(stmt)
+		}
+		if match := addColumnClause.FindStringSubmatch(strings.TrimSpace(stripComments(stmt))); match != nil {
+			exists, err := columnExists(ctx, tx, postgres, match[1], match[2])
+			if err != nil {
+				return false, err
+			}
+			if exists {
+				continue
+			}
+		}
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return false, err
+		}
+	}
+	q := `INSERT INTO schema_migrations (version, name, applied_at) values ($1, $2, $3)`
+	if _, err := tx.ExecContext(ctx, q, m.Version, m.Name, time.Now().Unix()); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func stripComments(stmt string) string {
+	lines := strings.Split(stmt, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
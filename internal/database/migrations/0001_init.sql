@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS users(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	login TEXT UNIQUE,
+	password TEXT
+);
+
+CREATE TABLE IF NOT EXISTS expressions(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	expression TEXT NOT NULL,
+	result FLOAT,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
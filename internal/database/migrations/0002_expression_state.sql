@@ -0,0 +1,16 @@
+-- состояние выражений и очередь задач для восстановления после перезапуска
+ALTER TABLE expressions ADD COLUMN error TEXT;
+ALTER TABLE expressions ADD COLUMN status TEXT NOT NULL DEFAULT 'pending';
+ALTER TABLE expressions ADD COLUMN ast TEXT;
+UPDATE expressions SET status = 'completed' WHERE result IS NOT NULL AND status = 'pending';
+
+CREATE TABLE IF NOT EXISTS tasks(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	expression_id INTEGER NOT NULL,
+	arg1 FLOAT NOT NULL,
+	arg2 FLOAT NOT NULL,
+	operation TEXT NOT NULL,
+	operation_time INTEGER NOT NULL,
+	node_path TEXT NOT NULL,
+	FOREIGN KEY (expression_id) REFERENCES expressions(id)
+);
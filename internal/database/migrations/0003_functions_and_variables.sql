@@ -0,0 +1,10 @@
+-- аргументы функций (sqrt, min, max, ...) хранятся в JSON
+ALTER TABLE tasks ADD COLUMN args TEXT;
+
+CREATE TABLE IF NOT EXISTS variables(
+	user_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	value FLOAT NOT NULL,
+	PRIMARY KEY (user_id, name),
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
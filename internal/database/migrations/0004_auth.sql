@@ -0,0 +1,50 @@
+CREATE TABLE IF NOT EXISTS agent_tokens(
+	agent_id TEXT PRIMARY KEY,
+	token_hash TEXT UNIQUE NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- сроки в sessions, refresh_tokens и revoked_tokens хранятся в unix-секундах
+CREATE TABLE IF NOT EXISTS sessions(
+	id TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	expires_at INTEGER NOT NULL,
+	revoked_at INTEGER,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens(
+	token_hash TEXT PRIMARY KEY,
+	session_id TEXT NOT NULL,
+	expires_at INTEGER NOT NULL,
+	used_at INTEGER,
+	FOREIGN KEY (session_id) REFERENCES sessions(id)
+);
+
+CREATE TABLE IF NOT EXISTS revoked_tokens(
+	jti TEXT PRIMARY KEY,
+	expires_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS api_keys(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	scope TEXT NOT NULL,
+	key_hash TEXT UNIQUE NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	last_used_at TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';
+ALTER TABLE users ADD COLUMN disabled INTEGER NOT NULL DEFAULT 0;
+
+-- key - "login:<login>" или "ip:<адрес>"
+CREATE TABLE IF NOT EXISTS login_attempts(
+	key TEXT PRIMARY KEY,
+	failures INTEGER NOT NULL,
+	locked_until INTEGER NOT NULL DEFAULT 0,
+	updated_at INTEGER NOT NULL
+);
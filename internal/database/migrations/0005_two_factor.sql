@@ -0,0 +1,17 @@
+ALTER TABLE users ADD COLUMN totp_secret TEXT;
+ALTER TABLE users ADD COLUMN totp_enabled INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS recovery_codes(
+	user_id INTEGER NOT NULL,
+	code_hash TEXT NOT NULL,
+	PRIMARY KEY (user_id, code_hash),
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS login_challenges(
+	token_hash TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
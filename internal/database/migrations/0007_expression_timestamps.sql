@@ -0,0 +1,4 @@
+-- время создания, начала и завершения вычисления в unix-секундах; у выражений, созданных раньше, created_at = 0
+ALTER TABLE expressions ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE expressions ADD COLUMN started_at INTEGER;
+ALTER TABLE expressions ADD COLUMN completed_at INTEGER;
@@ -0,0 +1,5 @@
+-- индексы для постраничной выдачи выражений пользователя: по id, по времени создания и по статусу.
+-- Поиск по подстроке выражения (LIKE '%...%') индексом не ускоряется и идёт по строкам пользователя
+CREATE INDEX IF NOT EXISTS expressions_user_id ON expressions(user_id, id);
+CREATE INDEX IF NOT EXISTS expressions_user_created_at ON expressions(user_id, created_at, id);
+CREATE INDEX IF NOT EXISTS expressions_user_status ON expressions(user_id, status, id);
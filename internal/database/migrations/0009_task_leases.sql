@@ -0,0 +1,9 @@
+-- аренда задач хранится в базе, чтобы с одной базой работали несколько оркестраторов:
+-- agent_id - агент, которому задача выдана последней, lease_deadline - срок аренды в unix-миллисекундах
+-- (NULL - задача ждёт в очереди)
+ALTER TABLE tasks ADD COLUMN agent_id TEXT;
+ALTER TABLE tasks ADD COLUMN lease_deadline INTEGER;
+CREATE INDEX IF NOT EXISTS tasks_lease_deadline ON tasks(lease_deadline);
+-- у узла выражения не больше одной задачи: оставляем первую из повторов
+DELETE FROM tasks WHERE id NOT IN (SELECT MIN(id) FROM tasks GROUP BY expression_id, node_path);
+CREATE UNIQUE INDEX IF NOT EXISTS tasks_expression_node ON tasks(expression_id, node_path);
@@ -0,0 +1,71 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Запросы хранилища написаны так, чтобы выполняться и в SQLite, и в PostgreSQL: параметры $1, $2, ...,
+// новые идентификаторы через RETURNING, флаги - целые 0/1. Различается только DDL миграций:
+// перед применением в PostgreSQL он переписывается функцией postgresStatement, а то, что так не
+// переводится (например, триггеры), лежит в отдельном файле NNNN_name.postgres.sql
+
+var (
+	autoincrementColumn = regexp.MustCompile(`(?i)\bINTEGER\s+PRIMARY\s+KEY\s+AUTOINCREMENT\b`)
+	integerType         = regexp.MustCompile(`(?i)\bINTEGER\b`)
+)
+
+// driverName выбирает драйвер по DSN: postgres://... и postgresql://... - PostgreSQL, остальное - путь к файлу SQLite
+func driverName(dsn string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return "postgres"
+	}
+	return "sqlite3"
+}
+
+func isPostgres(db *sql.DB) bool {
+	_, ok := db.Driver().(*pq.Driver)
+	return ok
+}
+
+// postgresStatement переводит DDL миграции на диалект PostgreSQL. Сроки хранятся в unix-секундах,
+// поэтому INTEGER становится BIGINT
+func postgresStatement(stmt string) string {
+	stmt = autoincrementColumn.ReplaceAllString(stmt, "BIGSERIAL PRIMARY KEY")
+	return integerType.ReplaceAllString(stmt, "BIGINT")
+}
+
+func columnExists(ctx context.Context, tx *sql.Tx, postgres bool, table, column string) (bool, error) {
+	q := `SELECT COUNT(*) FROM pragma_table_info($1) WHERE name = $2`
+	if postgres {
+		q = `SELECT COUNT(*) FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2`
+	}
+	var exists int
+	if err := tx.QueryRowContext(ctx, q, table, column).Scan(&exists); err != nil {
+		return false, err
+	}
+	return exists > 0, nil
+}
+
+// lockRows дописывает к SELECT блокировку выбранных строк до конца транзакции. В SQLite не нужна:
+// транзакции там начинаются сразу с блокировки записи (см. Open)
+func (s *SQLStore) lockRows() string {
+	if s.postgres {
+		return " FOR UPDATE"
+	}
+	return ""
+}
+
+// skipLocked дописывает к SELECT блокировку строк с пропуском уже заблокированных: несколько
+// оркестраторов разбирают очередь задач, не выдавая одну задачу дважды и не дожидаясь друг друга
+func (s *SQLStore) skipLocked() string {
+	if s.postgres {
+		return " FOR UPDATE SKIP LOCKED"
+	}
+	return ""
+}
@@ -0,0 +1,111 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Store - хранилище оркестратора: пользователи, выражения, задачи, токены и журнал аудита.
+// SQLStore хранит данные в SQLite или PostgreSQL, MemoryStore - в памяти процесса (для тестов)
+type Store interface {
+	// пользователи
+	InsertUsers(ctx context.Context, login, password string) error
+	GetUserID(ctx context.Context, login string) int
+	IsAuth(ctx context.Context, login, password string) bool
+	GetUserByLogin(ctx context.Context, login string) (User, error)
+	GetUserByID(ctx context.Context, id int) (User, error)
+	GetUsers(ctx context.Context) ([]User, error)
+	SetUserRole(ctx context.Context, login, role string) (bool, error)
+	UpdateUser(ctx context.Context, id int, role *string, disabled *bool) (bool, error)
+	UpdatePassword(ctx context.Context, user_id int, password string) error
+	DeleteUser(ctx context.Context, user_id int) ([]int, error)
+
+	// выражения, задачи и переменные
+	AddExpression(ctx context.Context, user_id int, expression string) (int, error)
+	AddAnswer(ctx context.Context, id int, result float64) error
+	AddError(ctx context.Context, id int, message string) error
+	SaveExpressionState(ctx context.Context, id int, status, ast string) error
+	GetUnfinishedExpressions(ctx context.Context) ([]ExpressionState, error)
+	GetExpressions(ctx context.Context, user_id int, filter ExpressionFilter) ([]Expression, error)
+	GetExpressionByID(ctx context.Context, user_id, id int) (Expression, error)
+	GetAllExpressions(ctx context.Context) ([]Expression, error)
+	AddTask(ctx context.Context, task TaskRecord) (int, error)
+	DeleteTask(ctx context.Context, id int) error
+	DeleteExpressionTasks(ctx context.Context, expression_id int) error
+	GetTasks(ctx context.Context) ([]TaskRecord, error)
+	GetTask(ctx context.Context, id int) (TaskRecord, error)
+	LeaseTasks(ctx context.Context, agent_id string, operations []string, max int, deadline time.Time) ([]TaskRecord, error)
+	RequeueExpiredTasks(ctx context.Context, now time.Time) ([]int, error)
+	RequeueAgentTasks(ctx context.Context, agent_id string) (int, error)
+	UpdateExpression(ctx context.Context, id int, update func(state ExpressionState, tasks []TaskRecord) (ExpressionUpdate, error)) error
+	SetVariable(ctx context.Context, user_id int, name string, value float64) error
+	DeleteVariable(ctx context.Context, user_id int, name string) (bool, error)
+	GetVariables(ctx context.Context, user_id int) (map[string]float64, error)
+
+	// токены агентов
+	SetAgentToken(ctx context.Context, agent_id, token_hash string) error
+	DeleteAgentToken(ctx context.Context, agent_id string) (bool, error)
+	GetAgentByToken(ctx context.Context, token_hash string) (string, error)
+	GetAgentTokens(ctx context.Context) ([]AgentToken, error)
+
+	// сессии, refresh-токены и отозванные JWT
+	CreateSession(ctx context.Context, id string, user_id int, expires_at time.Time) error
+	AddRefreshToken(ctx context.Context, token_hash, session_id string, expires_at time.Time) error
+	UseRefreshToken(ctx context.Context, token_hash string, now time.Time) (Session, error)
+	RevokeSession(ctx context.Context, id string, now time.Time) error
+	RevokeUserSessions(ctx context.Context, user_id int, now time.Time) error
+	GetSessionByRefreshToken(ctx context.Context, token_hash string) (string, error)
+	RevokeToken(ctx context.Context, jti string, expires_at time.Time) error
+	IsTokenRevoked(ctx context.Context, jti, session_id string) (bool, error)
+	PurgeExpiredTokens(ctx context.Context, now time.Time) error
+
+	// API-ключи
+	AddAPIKey(ctx context.Context, user_id int, name, scope, key_hash string) (APIKey, error)
+	GetAPIKeys(ctx context.Context, user_id int) ([]APIKey, error)
+	DeleteAPIKey(ctx context.Context, user_id, id int) (bool, error)
+	UseAPIKey(ctx context.Context, key_hash string) (APIKey, error)
+
+	// блокировка входа
+	GetLoginLock(ctx context.Context, keys []string) (time.Time, error)
+	RecordLoginFailure(ctx context.Context, key string, now, window_start time.Time) (int, error)
+	SetLoginLock(ctx context.Context, key string, until time.Time) error
+	ResetLoginAttempts(ctx context.Context, key string) (bool, error)
+
+	// двухфакторная аутентификация
+	SetTOTPSecret(ctx context.Context, user_id int, secret string) error
+	GetTOTPSecret(ctx context.Context, user_id int) (string, bool, error)
+	EnableTOTP(ctx context.Context, user_id int, step int64, code_hashes []string) error
+	DisableTOTP(ctx context.Context, user_id int) error
+	UseTOTPStep(ctx context.Context, user_id int, step int64) (bool, error)
+	UseRecoveryCode(ctx context.Context, user_id int, code_hash string) (bool, error)
+	CreateLoginChallenge(ctx context.Context, token_hash string, user_id int, expires_at time.Time) error
+	GetLoginChallenge(ctx context.Context, token_hash string, now time.Time) (User, error)
+	DeleteLoginChallenge(ctx context.Context, token_hash string) error
+
+	// журнал аудита
+	AddAuditEvent(ctx context.Context, event AuditEvent) error
+	GetAuditEvents(ctx context.Context, filter AuditFilter) ([]AuditEvent, error)
+
+	Close() error
+}
+
+type SQLStore struct {
+	db       *sql.DB
+	postgres bool
+}
+
+func NewSQLStore(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db, postgres: isPostgres(db)}
+}
+
+// DB возвращает подключение к базе для миграций и обслуживания
+func (s *SQLStore) DB() *sql.DB {
+	return s.db
+}
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+var _ Store = (*SQLStore)(nil)
@@ -2,13 +2,26 @@ package calculation
 
 import (
 	"fmt"
+	"math"
 )
 
 func Calc(expression string) (float64, error) {
 	return 0, fmt.Errorf("not implemented")
 }
 
+// Compute выполняет операцию; бесконечный или неопределённый результат (например, 2^10000) - ошибка ErrOverflow
 func Compute(operation string, a, b float64) (float64, error) {
+	res, err := compute(operation, a, b)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsInf(res, 0) || math.IsNaN(res) {
+		return 0, ErrOverflow
+	}
+	return res, nil
+}
+
+func compute(operation string, a, b float64) (float64, error) {
 	switch operation {
 	case "+":
 		return a + b, nil
@@ -21,7 +34,30 @@ func Compute(operation string, a, b float64) (float64, error) {
 			return 0, ErrDivisionByZero
 		}
 		return a / b, nil
+	case "//":
+		if b == 0 {
+			return 0, ErrDivisionByZero
+		}
+		return math.Floor(a / b), nil
+	case "%":
+		if b == 0 {
+			return 0, ErrDivisionByZero
+		}
+		// остаток со знаком делителя, согласованный с //: (a//b)*b + a%b == a
+		mod := math.Mod(a, b)
+		if mod != 0 && (mod < 0) != (b < 0) {
+			mod += b
+		}
+		return mod, nil
+	case "^":
+		if a < 0 && b != math.Trunc(b) {
+			return 0, ErrNegativeBase
+		}
+		if a == 0 && b < 0 {
+			return 0, ErrDivisionByZero
+		}
+		return math.Pow(a, b), nil
 	default:
-		return 0, fmt.Errorf("invalid operator: %s", operation)
+		return 0, fmt.Errorf("%w: %s", ErrInvalidOperator, operation)
 	}
 }
@@ -5,4 +5,30 @@ import "errors"
 var (
 	ErrDivisionByZero  = errors.New("division by zero")
 	ErrInvalidOperator = errors.New("invalid operator")
+	ErrNegativeBase    = errors.New("negative base with fractional exponent")
+	ErrDomain          = errors.New("argument out of domain")
+	ErrUnknownFunction = errors.New("unknown function")
+	ErrArgumentCount   = errors.New("wrong number of arguments")
+	ErrOverflow        = errors.New("result is out of range")
 )
+
+func ErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrDivisionByZero):
+		return "division_by_zero"
+	case errors.Is(err, ErrNegativeBase):
+		return "negative_base"
+	case errors.Is(err, ErrDomain):
+		return "domain_error"
+	case errors.Is(err, ErrUnknownFunction):
+		return "unknown_function"
+	case errors.Is(err, ErrArgumentCount):
+		return "argument_count"
+	case errors.Is(err, ErrOverflow):
+		return "overflow"
+	case errors.Is(err, ErrInvalidOperator):
+		return "invalid_operator"
+	default:
+		return "computation_error"
+	}
+}
@@ -0,0 +1,91 @@
+package calculation
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+type function struct {
+	minArgs int
+	maxArgs int // -1 - без ограничения
+	call    func(args []float64) (float64, error)
+}
+
+var functions = map[string]function{
+	"sqrt": {1, 1, func(args []float64) (float64, error) {
+		if args[0] < 0 {
+			return 0, fmt.Errorf("%w: sqrt of negative number", ErrDomain)
+		}
+		return math.Sqrt(args[0]), nil
+	}},
+	"sin": {1, 1, func(args []float64) (float64, error) {
+		return math.Sin(args[0]), nil
+	}},
+	"cos": {1, 1, func(args []float64) (float64, error) {
+		return math.Cos(args[0]), nil
+	}},
+	"log": {1, 1, func(args []float64) (float64, error) {
+		if args[0] <= 0 {
+			return 0, fmt.Errorf("%w: log of non-positive number", ErrDomain)
+		}
+		return math.Log(args[0]), nil
+	}},
+	"abs": {1, 1, func(args []float64) (float64, error) {
+		return math.Abs(args[0]), nil
+	}},
+	"min": {1, -1, func(args []float64) (float64, error) {
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Min(result, arg)
+		}
+		return result, nil
+	}},
+	"max": {1, -1, func(args []float64) (float64, error) {
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Max(result, arg)
+		}
+		return result, nil
+	}},
+}
+
+func Functions() []string {
+	names := make([]string, 0, len(functions))
+	for name := range functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Operations возвращает все операции и функции, которые умеет считать агент
+func Operations() []string {
+	return append([]string{"+", "-", "*", "/", "//", "%", "^"}, Functions()...)
+}
+
+func IsFunction(name string) bool {
+	_, ok := functions[name]
+	return ok
+}
+
+func CheckArity(name string, count int) error {
+	fn, ok := functions[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownFunction, name)
+	}
+	if count < fn.minArgs || (fn.maxArgs >= 0 && count > fn.maxArgs) {
+		if fn.minArgs == fn.maxArgs {
+			return fmt.Errorf("%w: %s expects %d argument(s), got %d", ErrArgumentCount, name, fn.minArgs, count)
+		}
+		return fmt.Errorf("%w: %s expects at least %d argument(s), got %d", ErrArgumentCount, name, fn.minArgs, count)
+	}
+	return nil
+}
+
+func Call(name string, args []float64) (float64, error) {
+	if err := CheckArity(name, len(args)); err != nil {
+		return 0, err
+	}
+	return functions[name].call(args)
+}
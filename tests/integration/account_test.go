@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestRegistrationPolicy(t *testing.T) {
+	o := newTestOrchestrator(t, "test_policy.db")
+	testCases := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"Пустой логин", `{"login": "", "password": "secret-password"}`, http.StatusUnprocessableEntity},
+		{"Пустой пароль", `{"login": "alice", "password": ""}`, http.StatusUnprocessableEntity},
+		{"Короткий пароль", `{"login": "alice", "password": "123"}`, http.StatusUnprocessableEntity},
+		{"Недопустимые символы", `{"login": "al ice", "password": "secret-password"}`, http.StatusUnprocessableEntity},
+		{"Корректные данные", `{"login": "alice", "password": "secret-password"}`, http.StatusOK},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if w := postJSON(o, "/api/v1/register", tc.body); w.Code != tc.code {
+				t.Errorf("Expected %d, got %d: %s", tc.code, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	o := newTestOrchestrator(t, "test_change_password.db")
+	o.Config.TokenNotBefore = 0
+	access, _ := login(t, o, "alice", "old-password")
+
+	if w := bearerRequest(o, "POST", "/api/v1/password", access, `{"old_password": "wrong-password", "new_password": "new-password"}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for wrong old password, got %d", w.Code)
+	}
+	if w := bearerRequest(o, "POST", "/api/v1/password", access, `{"old_password": "old-password", "new_password": "short"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for weak new password, got %d", w.Code)
+	}
+	w := bearerRequest(o, "POST", "/api/v1/password", access, `{"old_password": "old-password", "new_password": "new-password"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on password change, got %d: %s", w.Code, w.Body.String())
+	}
+	if code := authStatus(o, access); code != http.StatusUnauthorized {
+		t.Errorf("Expected old sessions to be revoked, got %d", code)
+	}
+	if w := postJSON(o, "/api/v1/login", `{"login": "alice", "password": "old-password"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for old password, got %d", w.Code)
+	}
+	if w := postJSON(o, "/api/v1/login", `{"login": "alice", "password": "new-password"}`); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 for new password, got %d", w.Code)
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	o := newTestOrchestrator(t, "test_delete_account.db")
+	o.Config.TokenNotBefore = 0
+	access, _ := login(t, o, "alice", "secret-password")
+	other, _ := login(t, o, "bob", "secret-password")
+	bearerRequest(o, "POST", "/api/v1/calculate", access, `{"expression": "2+2"}`)
+	bearerRequest(o, "POST", "/api/v1/calculate", other, `{"expression": "3+3"}`)
+
+	if w := bearerRequest(o, "DELETE", "/api/v1/account", access, `{"password": "wrong-password"}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for wrong password, got %d", w.Code)
+	}
+	if w := bearerRequest(o, "DELETE", "/api/v1/account", access, `{"password": "secret-password"}`); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 on account deletion, got %d: %s", w.Code, w.Body.String())
+	}
+	if code := authStatus(o, access); code != http.StatusUnauthorized {
+		t.Errorf("Expected token of deleted account to be rejected, got %d", code)
+	}
+	if w := postJSON(o, "/api/v1/login", `{"login": "alice", "password": "secret-password"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for deleted account, got %d", w.Code)
+	}
+	expressions, _ := o.Store.GetAllExpressions(context.TODO())
+	if len(expressions) != 1 {
+		t.Errorf("Expected only expressions of other user to remain, got %+v", expressions)
+	}
+	if state, err := o.QueueState(); err != nil || state.Expressions != 1 || state.Queued != 1 {
+		t.Errorf("Expected deleted expressions to leave the queue, got %+v", state)
+	}
+}
@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"yandexlyceum/internal/application"
+	"yandexlyceum/internal/database"
+)
+
+func TestAdminRole(t *testing.T) {
+	o := newTestOrchestrator(t, "test_admin.db")
+	o.Config.TokenNotBefore = 0
+	userToken, _ := login(t, o, "user", "secret-password")
+	login(t, o, "root", "secret-password")
+	if _, err := o.Store.SetUserRole(context.TODO(), "root", application.RoleAdmin); err != nil {
+		t.Fatalf("Failed to set role: %v", err)
+	}
+	adminToken, _ := login(t, o, "root", "secret-password")
+
+	for _, path := range []string{"/api/v1/admin/users", "/api/v1/admin/expressions", "/api/v1/admin/queue", "/api/v1/admin/agents"} {
+		if w := bearerRequest(o, "GET", path, userToken, ""); w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 for user on %s, got %d", path, w.Code)
+		}
+		if w := bearerRequest(o, "GET", path, adminToken, ""); w.Code != http.StatusOK {
+			t.Errorf("Expected 200 for admin on %s, got %d", path, w.Code)
+		}
+	}
+
+	_, readKey := createAPIKey(t, o, userToken, "reports", application.ScopeRead)
+	if w := bearerRequest(o, "GET", "/api/v1/admin/agents", readKey, ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for read API key on agents list, got %d", w.Code)
+	}
+
+	if w := bearerRequest(o, "POST", "/api/v1/calculate", userToken, `{"expression": "2*3+1"}`); w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", w.Code)
+	}
+	var queue application.QueueState
+	json.NewDecoder(bearerRequest(o, "GET", "/api/v1/admin/queue", adminToken, "").Body).Decode(&queue)
+	if queue.Expressions != 1 || queue.Queued != 1 || len(queue.Tasks) != 1 {
+		t.Errorf("Unexpected queue state: %+v", queue)
+	}
+	var all struct {
+		Expressions []database.Expression `json:"expressions"`
+	}
+	json.NewDecoder(bearerRequest(o, "GET", "/api/v1/admin/expressions", adminToken, "").Body).Decode(&all)
+	if len(all.Expressions) != 1 || all.Expressions[0].Status != "pending" || all.Expressions[0].UserId == 0 {
+		t.Errorf("Unexpected expressions: %+v", all.Expressions)
+	}
+
+	var users struct {
+		Users []database.User `json:"users"`
+	}
+	json.NewDecoder(bearerRequest(o, "GET", "/api/v1/admin/users", adminToken, "").Body).Decode(&users)
+	if len(users.Users) != 2 || users.Users[1].Role != application.RoleAdmin {
+		t.Fatalf("Unexpected users: %+v", users.Users)
+	}
+	userID := strconv.Itoa(users.Users[0].Id)
+	adminID := strconv.Itoa(users.Users[1].Id)
+
+	if w := bearerRequest(o, "PATCH", "/api/v1/admin/users/"+adminID, adminToken, `{"disabled": true}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 when disabling own account, got %d", w.Code)
+	}
+	if w := bearerRequest(o, "PATCH", "/api/v1/admin/users/"+userID, adminToken, `{"role": "root"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for unknown role, got %d", w.Code)
+	}
+
+	login(t, o, "ops", "secret-password")
+	o.Store.SetUserRole(context.TODO(), "ops", application.RoleAdmin)
+	opsToken, _ := login(t, o, "ops", "secret-password")
+	opsID := strconv.Itoa(o.Store.GetUserID(context.TODO(), "ops"))
+	if w := bearerRequest(o, "PATCH", "/api/v1/admin/users/"+opsID, adminToken, `{"role": "user"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on demotion, got %d", w.Code)
+	}
+	if w := bearerRequest(o, "GET", "/api/v1/admin/users", opsToken, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for admin token issued before demotion, got %d", w.Code)
+	}
+	opsToken, _ = login(t, o, "ops", "secret-password")
+	if w := bearerRequest(o, "GET", "/api/v1/admin/users", opsToken, ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for demoted admin after new login, got %d", w.Code)
+	}
+
+	if w := bearerRequest(o, "PATCH", "/api/v1/admin/users/"+userID, adminToken, `{"disabled": true}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on disable, got %d", w.Code)
+	}
+	if w := bearerRequest(o, "GET", "/api/v1/variables", userToken, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for token of disabled user, got %d", w.Code)
+	}
+	if w := postJSON(o, "/api/v1/login", `{"login": "user", "password": "secret-password"}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 on login of disabled user, got %d", w.Code)
+	}
+}
@@ -0,0 +1,146 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+	"yandexlyceum/internal/application"
+	"yandexlyceum/internal/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func agentRequest(t *testing.T, method, url, token, body string) int {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAgentAuthHTTP(t *testing.T) {
+	o := newTestOrchestrator(t, "test_agent_auth.db")
+	o.Config.AgentSecret = "test-secret"
+	httpURL, _ := startServers(t, o)
+	submitExpression(t, o, "2+3")
+
+	if code := agentRequest(t, "GET", httpURL+"/internal/task", "", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without token, got %d", code)
+	}
+	if code := agentRequest(t, "POST", httpURL+"/internal/task", "wrong", `{"id": "1", "result": 5}`); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with wrong token, got %d", code)
+	}
+
+	token, err := application.IssueAgentToken(context.TODO(), "agent-1", o.Store)
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+	if code := agentRequest(t, "POST", httpURL+"/internal/agents", token, `{"id": "agent-2", "computing_power": 1}`); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for token of another agent, got %d", code)
+	}
+	if code := agentRequest(t, "POST", httpURL+"/internal/agents", token, `{"id": "agent-1", "computing_power": 1}`); code != http.StatusOK {
+		t.Errorf("Expected 200 for own token, got %d", code)
+	}
+	if code := agentRequest(t, "GET", httpURL+"/internal/task", token, ""); code != http.StatusOK {
+		t.Errorf("Expected task for agent token, got %d", code)
+	}
+	if code := agentRequest(t, "GET", httpURL+"/internal/task", "test-secret", ""); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for empty queue with shared secret, got %d", code)
+	}
+
+	if _, err := o.Store.DeleteAgentToken(context.TODO(), "agent-1"); err != nil {
+		t.Fatalf("Failed to revoke token: %v", err)
+	}
+	if code := agentRequest(t, "GET", httpURL+"/internal/task", token, ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for revoked token, got %d", code)
+	}
+}
+
+func TestAgentAuthGRPC(t *testing.T) {
+	o := newTestOrchestrator(t, "test_agent_auth_grpc.db")
+	o.Config.AgentSecret = "test-secret"
+	_, grpcAddr := startServers(t, o)
+
+	conn, err := grpc.NewClient(grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewTaskServiceClient(conn)
+
+	_, err = client.GetTask(context.Background(), &pb.GetTaskRequest{})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected Unauthenticated without token, got %v", err)
+	}
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer test-secret")
+	if _, err := client.GetTask(ctx, &pb.GetTaskRequest{}); err != nil {
+		t.Errorf("Expected call with shared secret to succeed, got %v", err)
+	}
+}
+
+func TestAgentResultOwnership(t *testing.T) {
+	o := newTestOrchestrator(t, "test_agent_results.db")
+	o.Config.AgentSecret = "test-secret"
+	o.Config.TimeAddition = 1
+	o.Config.LeaseGrace = 1
+	httpURL, _ := startServers(t, o)
+	submitExpression(t, o, "2+3")
+
+	first, _ := application.IssueAgentToken(context.TODO(), "agent-1", o.Store)
+	second, _ := application.IssueAgentToken(context.TODO(), "agent-2", o.Store)
+	req, _ := http.NewRequest("GET", httpURL+"/internal/task", nil)
+	req.Header.Set("Authorization", "Bearer "+first)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected task for agent-1, got %v, %v", resp, err)
+	}
+	var fetched struct {
+		Task application.Task `json:"task"`
+	}
+	json.NewDecoder(resp.Body).Decode(&fetched)
+	resp.Body.Close()
+
+	result := fmt.Sprintf(`{"id": "%s", "result": 5}`, fetched.Task.ID)
+	if code := agentRequest(t, "POST", httpURL+"/internal/task", second, result); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for result of a task leased to another agent, got %d", code)
+	}
+	batch := fmt.Sprintf(`{"results": [{"id": "%s", "result": 5}]}`, fetched.Task.ID)
+	req, _ = http.NewRequest("POST", httpURL+"/internal/task", bytes.NewBufferString(batch))
+	req.Header.Set("Authorization", "Bearer "+second)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	var statuses struct {
+		Results []application.ResultStatus `json:"results"`
+	}
+	json.NewDecoder(resp.Body).Decode(&statuses)
+	resp.Body.Close()
+	if len(statuses.Results) != 1 || statuses.Results[0].Status != "forbidden" {
+		t.Errorf("Expected forbidden status in batch, got %+v", statuses.Results)
+	}
+
+	// после возврата в очередь поздний результат принимается только от прежнего агента
+	time.Sleep(10 * time.Millisecond)
+	o.RequeueExpiredTasks()
+	if code := agentRequest(t, "POST", httpURL+"/internal/task", second, result); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for late result from another agent, got %d", code)
+	}
+	if code := agentRequest(t, "POST", httpURL+"/internal/task", first, result); code != http.StatusOK {
+		t.Errorf("Expected late result from the leaseholder to be accepted, got %d", code)
+	}
+}
@@ -0,0 +1,71 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"yandexlyceum/internal/application"
+)
+
+func registerAgent(t *testing.T, o *application.Orchestrator, body string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	o.RegisterAgentHandler(w, httptest.NewRequest("POST", "/internal/agents", bytes.NewBufferString(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func fetchAgentTask(o *application.Orchestrator, agentID string) *application.Task {
+	w := httptest.NewRecorder()
+	o.GetTaskHandler(w, httptest.NewRequest("GET", "/internal/task?agent="+agentID, nil))
+	if w.Code != http.StatusOK {
+		return nil
+	}
+	var resp struct {
+		Task application.Task `json:"task"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	return &resp.Task
+}
+
+func TestAgentRegistryAndHeartbeats(t *testing.T) {
+	o := newTestOrchestrator(t, "test_agents.db")
+	o.Config.AgentTimeout = 1
+
+	registerAgent(t, o, `{"id": "adder", "computing_power": 1, "operations": ["+"]}`)
+	registerAgent(t, o, `{"id": "any", "computing_power": 4, "operations": ["+", "*"]}`)
+
+	submitExpression(t, o, "2*3")
+	if task := fetchAgentTask(o, "adder"); task != nil {
+		t.Fatalf("Agent without '*' support got task %s", task.ID)
+	}
+	task := fetchAgentTask(o, "any")
+	if task == nil {
+		t.Fatal("Expected a task for agent supporting '*'")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	o.RequeueLostAgents()
+
+	if requeued := fetchAgentTask(o, "any"); requeued == nil || requeued.ID != task.ID {
+		t.Fatalf("Expected task %s to be requeued after lost heartbeat, got %v", task.ID, requeued)
+	}
+
+	w := httptest.NewRecorder()
+	o.HeartbeatHandler(w, httptest.NewRequest("POST", "/internal/agents/heartbeat", bytes.NewBufferString(`{"id": "unknown"}`)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown agent, got %d", w.Code)
+	}
+
+	if code := postTask(o, `{"id": "`+task.ID+`", "result": 6}`); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	agents, err := o.Agents()
+	if err != nil || len(agents) != 2 || agents[1].ID != "any" || agents[1].TasksCompleted != 1 {
+		t.Errorf("Unexpected agents list: %+v", agents)
+	}
+}
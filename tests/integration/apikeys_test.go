@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"yandexlyceum/internal/application"
+)
+
+func bearerRequest(o *application.Orchestrator, method, path, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	o.Routes().ServeHTTP(w, r)
+	return w
+}
+
+func createAPIKey(t *testing.T, o *application.Orchestrator, token, name, scope string) (int, string) {
+	t.Helper()
+	w := bearerRequest(o, "POST", "/api/v1/apikeys", token, `{"name": "`+name+`", "scope": "`+scope+`"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		ID  int    `json:"id"`
+		Key string `json:"key"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	return resp.ID, resp.Key
+}
+
+func TestAPIKeys(t *testing.T) {
+	o := newTestOrchestrator(t, "test_apikeys.db")
+	o.Config.TokenNotBefore = 0
+	access, _ := login(t, o, "cron", "secret-password")
+
+	readID, readKey := createAPIKey(t, o, access, "reports", application.ScopeRead)
+	_, submitKey := createAPIKey(t, o, access, "batch", application.ScopeSubmit)
+
+	if w := bearerRequest(o, "POST", "/api/v1/apikeys", access, `{"name": "x", "scope": "admin"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for unknown scope, got %d", w.Code)
+	}
+
+	testCases := []struct {
+		name   string
+		key    string
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"read: список переменных", readKey, "GET", "/api/v1/variables", "", http.StatusOK},
+		{"read: отправка выражения", readKey, "POST", "/api/v1/calculate", `{"expression": "1+1"}`, http.StatusForbidden},
+		{"submit: отправка выражения", submitKey, "POST", "/api/v1/calculate", `{"expression": "1+1"}`, http.StatusCreated},
+		{"submit: список переменных", submitKey, "GET", "/api/v1/variables", "", http.StatusOK},
+		{"submit: изменение переменной", submitKey, "PUT", "/api/v1/variables/x", `{"value": 1}`, http.StatusForbidden},
+		{"submit: создание ключа", submitKey, "POST", "/api/v1/apikeys", `{"name": "x", "scope": "read"}`, http.StatusForbidden},
+		{"неизвестный ключ", "ak_unknown", "GET", "/api/v1/variables", "", http.StatusUnauthorized},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if w := bearerRequest(o, tc.method, tc.path, tc.key, tc.body); w.Code != tc.code {
+				t.Errorf("Expected %d, got %d: %s", tc.code, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	w := bearerRequest(o, "GET", "/api/v1/apikeys", access, "")
+	var list struct {
+		APIKeys []struct {
+			ID    int    `json:"id"`
+			Name  string `json:"name"`
+			Scope string `json:"scope"`
+			Key   string `json:"key"`
+		} `json:"apikeys"`
+	}
+	json.NewDecoder(w.Body).Decode(&list)
+	if len(list.APIKeys) != 2 || list.APIKeys[0].Name != "reports" || list.APIKeys[0].Key != "" {
+		t.Fatalf("Unexpected API key list: %+v", list.APIKeys)
+	}
+
+	if w := bearerRequest(o, "DELETE", "/api/v1/apikeys/"+strconv.Itoa(readID), access, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 on revoke, got %d", w.Code)
+	}
+	if w := bearerRequest(o, "GET", "/api/v1/variables", readKey, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for revoked key, got %d", w.Code)
+	}
+	if w := bearerRequest(o, "DELETE", "/api/v1/apikeys/"+strconv.Itoa(readID), access, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for already revoked key, got %d", w.Code)
+	}
+}
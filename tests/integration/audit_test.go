@@ -0,0 +1,76 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+	"yandexlyceum/internal/application"
+	"yandexlyceum/internal/database"
+)
+
+func auditEvents(t *testing.T, o *application.Orchestrator, token, query string) []database.AuditEvent {
+	t.Helper()
+	w := bearerRequest(o, "GET", "/api/v1/admin/audit"+query, token, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for audit%s, got %d: %s", query, w.Code, w.Body.String())
+	}
+	var resp struct {
+		Events []database.AuditEvent `json:"events"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	return resp.Events
+}
+
+func TestAuditLog(t *testing.T) {
+	o := newTestOrchestrator(t, "test_audit.db")
+	o.Config.TokenNotBefore = 0
+	userToken, _ := login(t, o, "alice", "secret-password")
+	loginFrom(o, "10.0.0.7", "alice", "wrong-password")
+	bearerRequest(o, "POST", "/api/v1/calculate", userToken, `{"expression": "2+2"}`)
+	createAPIKey(t, o, userToken, "ci", "read")
+	login(t, o, "root", "secret-password")
+	o.Store.SetUserRole(context.TODO(), "root", application.RoleAdmin)
+	adminToken, _ := login(t, o, "root", "secret-password")
+
+	if w := bearerRequest(o, "GET", "/api/v1/admin/audit", userToken, ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for user, got %d", w.Code)
+	}
+
+	failed := auditEvents(t, o, adminToken, "?event=login&outcome=failure")
+	if len(failed) != 1 || failed[0].Actor != "alice" || failed[0].IP != "10.0.0.7" {
+		t.Errorf("Unexpected failed logins: %+v", failed)
+	}
+	alice := auditEvents(t, o, adminToken, "?actor=alice")
+	events := map[string]bool{}
+	for _, event := range alice {
+		events[event.Event] = true
+	}
+	for _, event := range []string{"register", "login", "expression_submit", "apikey_create"} {
+		if !events[event] {
+			t.Errorf("Expected %s event for alice, got %+v", event, alice)
+		}
+	}
+	// новые записи идут первыми
+	if all := auditEvents(t, o, adminToken, "?limit=2"); len(all) != 2 || all[0].Id < all[1].Id {
+		t.Errorf("Expected 2 newest events, got %+v", all)
+	}
+	from := time.Now().Add(time.Hour).Format(time.RFC3339)
+	if later := auditEvents(t, o, adminToken, "?from="+from); len(later) != 0 {
+		t.Errorf("Expected no events in the future, got %+v", later)
+	}
+	for _, query := range []string{"?limit=0", "?from=yesterday", "?actor_id=x"} {
+		if w := bearerRequest(o, "GET", "/api/v1/admin/audit"+query, adminToken, ""); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 for %s, got %d", query, w.Code)
+		}
+	}
+
+	db := o.Store.(*database.SQLStore).DB()
+	if _, err := db.Exec(`DELETE FROM audit_log`); err == nil {
+		t.Error("Expected audit log to be append-only")
+	}
+	if _, err := db.Exec(`UPDATE audit_log SET outcome = 'success'`); err == nil {
+		t.Error("Expected audit log to be append-only")
+	}
+}
@@ -0,0 +1,192 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"yandexlyceum/internal/application"
+	"yandexlyceum/internal/database"
+)
+
+func authStatus(o *application.Orchestrator, token string) int {
+	r := httptest.NewRequest("GET", "/api/v1/variables", nil)
+	r.AddCookie(&http.Cookie{Name: "auth_token", Value: token})
+	w := httptest.NewRecorder()
+	o.Routes().ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	o := newTestOrchestrator(t, "test_jwt.db")
+	o.Config.TokenNotBefore = 0
+	o.Config.JWTKeys, _ = application.ParseKeySet("k1=first-secret", "")
+	if err := o.Store.CreateSession(context.TODO(), "s1", 1, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	oldToken, err := o.GenerateJWT(database.User{Id: 1, Login: "user", Role: application.RoleUser}, "s1")
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+	if code := authStatus(o, oldToken); code != http.StatusOK {
+		t.Fatalf("Expected 200 for fresh token, got %d", code)
+	}
+
+	// новый ключ становится активным, старый остаётся для проверки
+	o.Config.JWTKeys, _ = application.ParseKeySet("k1=first-secret,k2=second-secret", "k2")
+	if code := authStatus(o, oldToken); code != http.StatusOK {
+		t.Errorf("Expected token signed with previous key to stay valid, got %d", code)
+	}
+	newToken, _ := o.GenerateJWT(database.User{Id: 1, Login: "user", Role: application.RoleUser}, "s1")
+	if code := authStatus(o, newToken); code != http.StatusOK {
+		t.Errorf("Expected 200 for token signed with new key, got %d", code)
+	}
+
+	o.Config.JWTKeys, _ = application.ParseKeySet("k2=second-secret", "")
+	if code := authStatus(o, oldToken); code != http.StatusForbidden {
+		t.Errorf("Expected 403 after removing old key, got %d", code)
+	}
+
+	forged, _ := application.ParseKeySet("k2=another-secret", "")
+	o.Config.JWTKeys = forged
+	forgedToken, _ := o.GenerateJWT(database.User{Id: 1, Login: "user", Role: application.RoleUser}, "s1")
+	o.Config.JWTKeys, _ = application.ParseKeySet("k2=second-secret", "")
+	if code := authStatus(o, forgedToken); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for token with wrong signature, got %d", code)
+	}
+
+	o.Config.TokenTTL = -time.Minute
+	expired, _ := o.GenerateJWT(database.User{Id: 1, Login: "user", Role: application.RoleUser}, "")
+	if code := authStatus(o, expired); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for expired token, got %d", code)
+	}
+}
+
+func postJSON(o *application.Orchestrator, path, body string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", path, bytes.NewBufferString(body))
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	o.Routes().ServeHTTP(w, r)
+	return w
+}
+
+func login(t *testing.T, o *application.Orchestrator, user, password string) (string, string) {
+	t.Helper()
+	postJSON(o, "/api/v1/register", `{"login": "`+user+`", "password": "`+password+`"}`)
+	w := postJSON(o, "/api/v1/login", `{"login": "`+user+`", "password": "`+password+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Login failed with %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	return resp.Token, resp.RefreshToken
+}
+
+func TestRefreshAndLogout(t *testing.T) {
+	o := newTestOrchestrator(t, "test_refresh.db")
+	o.Config.TokenNotBefore = 0
+	access, refresh := login(t, o, "alice", "secret-password")
+	if access == "" || refresh == "" {
+		t.Fatal("Expected access and refresh tokens after login")
+	}
+
+	w := postJSON(o, "/api/v1/refresh", `{"refresh_token": "`+refresh+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on refresh, got %d: %s", w.Code, w.Body.String())
+	}
+	var rotated struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	json.NewDecoder(w.Body).Decode(&rotated)
+	if rotated.RefreshToken == "" || rotated.RefreshToken == refresh {
+		t.Fatal("Expected refresh token to be rotated")
+	}
+	if code := authStatus(o, rotated.Token); code != http.StatusOK {
+		t.Errorf("Expected 200 for refreshed token, got %d", code)
+	}
+
+	// повторное использование старого refresh-токена отзывает всю сессию
+	if w := postJSON(o, "/api/v1/refresh", `{"refresh_token": "`+refresh+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 on refresh token reuse, got %d", w.Code)
+	}
+	if w := postJSON(o, "/api/v1/refresh", `{"refresh_token": "`+rotated.RefreshToken+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for refresh token of revoked session, got %d", w.Code)
+	}
+	if code := authStatus(o, rotated.Token); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for access token of revoked session, got %d", code)
+	}
+
+	access, refresh = login(t, o, "alice", "secret-password")
+	w = postJSON(o, "/api/v1/logout", "", &http.Cookie{Name: "auth_token", Value: access})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on logout, got %d: %s", w.Code, w.Body.String())
+	}
+	if code := authStatus(o, access); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 after logout, got %d", code)
+	}
+	if w := postJSON(o, "/api/v1/refresh", `{"refresh_token": "`+refresh+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 on refresh after logout, got %d", w.Code)
+	}
+	if w := postJSON(o, "/api/v1/logout", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 on logout without tokens, got %d", w.Code)
+	}
+}
+
+func TestAuthorizationHeader(t *testing.T) {
+	o := newTestOrchestrator(t, "test_bearer.db")
+	o.Config.TokenNotBefore = 0
+	access, _ := login(t, o, "bob", "secret-password")
+	o.Config.TokenTTL = -time.Minute
+	expired, _ := o.GenerateJWT(database.User{Id: 1, Login: "bob", Role: application.RoleUser}, "")
+	o.Config.TokenTTL = time.Hour
+	noSession, _ := o.GenerateJWT(database.User{Id: 1, Login: "bob", Role: application.RoleAdmin}, "")
+
+	testCases := []struct {
+		name   string
+		header string
+		cookie string
+		code   int
+		error  string
+	}{
+		{"Bearer", "Bearer " + access, "", http.StatusOK, ""},
+		{"Регистр схемы", "bearer " + access, "", http.StatusOK, ""},
+		{"Cookie", "", access, http.StatusOK, ""},
+		{"Нет токена", "", "", http.StatusUnauthorized, "Missing token"},
+		{"Другая схема", "Basic " + access, "", http.StatusUnauthorized, "Malformed token"},
+		{"Пустой Bearer", "Bearer ", "", http.StatusUnauthorized, "Malformed token"},
+		{"Не JWT", "Bearer not-a-jwt", "", http.StatusUnauthorized, "Malformed token"},
+		{"Истёкший", "Bearer " + expired, "", http.StatusUnauthorized, "Token expired"},
+		{"Заголовок важнее Cookie", "Bearer " + expired, access, http.StatusUnauthorized, "Token expired"},
+		{"Без сессии", "Bearer " + noSession, "", http.StatusUnauthorized, "Malformed token"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/variables", nil)
+			if tc.header != "" {
+				r.Header.Set("Authorization", tc.header)
+			}
+			if tc.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: "auth_token", Value: tc.cookie})
+			}
+			w := httptest.NewRecorder()
+			o.Routes().ServeHTTP(w, r)
+			if w.Code != tc.code {
+				t.Fatalf("Expected %d, got %d: %s", tc.code, w.Code, w.Body.String())
+			}
+			if tc.error != "" && !strings.Contains(w.Body.String(), tc.error) {
+				t.Errorf("Expected error %q, got %s", tc.error, w.Body.String())
+			}
+		})
+	}
+}
@@ -26,9 +26,7 @@ func TestCalculateHandlerWithDB(t *testing.T) {
 		_ = os.Remove(dbPath)
 	}()
 
-	o := application.NewOrchestrator()
-	o.Db = db
-	o.Config = application.ConfigFromEnv()
+	o := application.NewOrchestrator(application.ConfigFromEnv(), database.NewSQLStore(db))
 
 	_, err = db.Exec("INSERT INTO users(login, password) VALUES(?, ?)",
 		"testuser", "hashedpassword")
@@ -0,0 +1,70 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+	"yandexlyceum/internal/application"
+)
+
+func loginFrom(o *application.Orchestrator, ip, user, password string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/api/v1/login", bytes.NewBufferString(`{"login": "`+user+`", "password": "`+password+`"}`))
+	r.RemoteAddr = ip + ":12345"
+	w := httptest.NewRecorder()
+	o.Routes().ServeHTTP(w, r)
+	return w
+}
+
+func TestLoginLockout(t *testing.T) {
+	o := newTestOrchestrator(t, "test_lockout.db")
+	o.Config.TokenNotBefore = 0
+	o.Config.LoginMaxFailures = 3
+	o.Config.LoginLockout = time.Minute
+	login(t, o, "victim", "secret-password")
+
+	for i := 0; i < 3; i++ {
+		if w := loginFrom(o, "10.0.0.1", "victim", "wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Attempt %d: expected 401, got %d", i+1, w.Code)
+		}
+	}
+	// блокировка действует и для правильного пароля, и с другого адреса
+	w := loginFrom(o, "10.0.0.2", "victim", "secret-password")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 for locked account, got %d", w.Code)
+	}
+	if retry, _ := strconv.Atoi(w.Header().Get("Retry-After")); retry < 1 || retry > 60 {
+		t.Errorf("Expected Retry-After within lockout, got %q", w.Header().Get("Retry-After"))
+	}
+
+	login(t, o, "root", "secret-password")
+	o.Store.SetUserRole(context.TODO(), "root", application.RoleAdmin)
+	adminToken, _ := login(t, o, "root", "secret-password")
+	victim, _ := o.Store.GetUserByLogin(context.TODO(), "victim")
+	if w := bearerRequest(o, "POST", "/api/v1/admin/users/"+strconv.Itoa(victim.Id)+"/unlock", adminToken, ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on unlock, got %d", w.Code)
+	}
+	if w := loginFrom(o, "10.0.0.2", "victim", "secret-password"); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 after unlock, got %d", w.Code)
+	}
+}
+
+func TestLoginLockoutPerIP(t *testing.T) {
+	o := newTestOrchestrator(t, "test_lockout_ip.db")
+	o.Config.TokenNotBefore = 0
+	o.Config.LoginMaxFailuresIP = 4
+	login(t, o, "alice", "secret-password")
+
+	for i := 0; i < 4; i++ {
+		loginFrom(o, "10.0.0.3", "user"+strconv.Itoa(i), "wrong")
+	}
+	if w := loginFrom(o, "10.0.0.3", "alice", "secret-password"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 for locked address, got %d", w.Code)
+	}
+	if w := loginFrom(o, "10.0.0.4", "alice", "secret-password"); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 from another address, got %d", w.Code)
+	}
+}
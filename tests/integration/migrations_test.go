@@ -0,0 +1,128 @@
+package tests
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+	"yandexlyceum/internal/database"
+)
+
+// схема базы до появления миграций (первая версия приложения)
+const legacySchema = `
+CREATE TABLE users(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	login TEXT UNIQUE,
+	password TEXT
+);
+CREATE TABLE expressions(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	expression TEXT NOT NULL,
+	result FLOAT,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+INSERT INTO users (login, password) VALUES ('alice', 'hash');
+INSERT INTO expressions (user_id, expression, result) VALUES (1, '2+2', 4);`
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	dbPath := "test_migrate_legacy.db"
+	_ = os.Remove(dbPath)
+	t.Cleanup(func() { _ = os.Remove(dbPath) })
+	legacy, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	if _, err := legacy.Exec(legacySchema); err != nil {
+		t.Fatalf("Failed to create legacy schema: %v", err)
+	}
+	legacy.Close()
+
+	db, err := database.InitDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to migrate legacy DB: %v", err)
+	}
+	defer db.Close()
+	if version, _ := database.SchemaVersion(context.TODO(), db); version != database.LatestVersion() {
+		t.Errorf("Expected schema version %d, got %d", database.LatestVersion(), version)
+	}
+	store := database.NewSQLStore(db)
+	user, err := store.GetUserByLogin(context.TODO(), "alice")
+	if err != nil || user.Role != "user" || user.Disabled || user.TOTPEnabled {
+		t.Errorf("Unexpected migrated user: %+v, %v", user, err)
+	}
+	expr, err := store.GetExpressionByID(context.TODO(), user.Id, 1)
+	if err != nil || expr.Result == nil || *expr.Result != 4 || expr.Status != "completed" {
+		t.Errorf("Unexpected migrated expression: %+v, %v", expr, err)
+	}
+	if _, err := store.AddExpression(context.TODO(), user.Id, "1+1"); err != nil {
+		t.Errorf("Failed to add expression after migration: %v", err)
+	}
+}
+
+// База, созданная до появления миграций, уже содержит все таблицы и столбцы, но не schema_migrations
+func TestMigrateUnversionedDatabase(t *testing.T) {
+	dbPath := "test_migrate_unversioned.db"
+	_ = os.Remove(dbPath)
+	t.Cleanup(func() { _ = os.Remove(dbPath) })
+	db, err := database.InitDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	if _, err := db.Exec(`DROP TABLE schema_migrations`); err != nil {
+		t.Fatalf("Failed to drop schema_migrations: %v", err)
+	}
+	db.Close()
+
+	db, err = database.InitDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to migrate unversioned DB: %v", err)
+	}
+	defer db.Close()
+	if version, _ := database.SchemaVersion(context.TODO(), db); version != database.LatestVersion() {
+		t.Errorf("Expected schema version %d, got %d", database.LatestVersion(), version)
+	}
+}
+
+func TestMigrateToVersion(t *testing.T) {
+	dbPath := "test_migrate_version.db"
+	_ = os.Remove(dbPath)
+	t.Cleanup(func() { _ = os.Remove(dbPath) })
+	db, err := database.Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+	ctx := context.TODO()
+
+	if err := database.Migrate(ctx, 2, db); err != nil {
+		t.Fatalf("Failed to migrate to version 2: %v", err)
+	}
+	states, err := database.MigrationStatus(ctx, db)
+	if err != nil || len(states) != database.LatestVersion() {
+		t.Fatalf("Unexpected status: %+v, %v", states, err)
+	}
+	for _, state := range states {
+		if applied := state.AppliedAt != nil; applied != (state.Version <= 2) {
+			t.Errorf("Migration %d: applied=%v", state.Version, applied)
+		}
+	}
+	var tables int
+	db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'variables'`).Scan(&tables)
+	if tables != 0 {
+		t.Error("Expected later migrations not to be applied")
+	}
+
+	if err := database.Migrate(ctx, 1, db); err == nil {
+		t.Error("Expected error for downgrade")
+	}
+	if err := database.Migrate(ctx, database.LatestVersion()+1, db); err == nil {
+		t.Error("Expected error for unknown version")
+	}
+	if err := database.Migrate(ctx, database.LatestVersion(), db); err != nil {
+		t.Fatalf("Failed to migrate to latest: %v", err)
+	}
+	if version, _ := database.SchemaVersion(ctx, db); version != database.LatestVersion() {
+		t.Errorf("Expected latest version, got %d", version)
+	}
+}
@@ -0,0 +1,656 @@
+package tests
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"yandexlyceum/internal/application"
+	"yandexlyceum/internal/database"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type storeBackend struct {
+	name string
+	open func(t *testing.T) database.Store
+}
+
+// storeBackends перечисляет реализации хранилища, на которых прогоняются одни и те же проверки.
+// PostgreSQL проверяется, если в TEST_POSTGRES_DSN указана база, которую можно очищать; в CI
+// (переменная CI) без неё тесты падают, чтобы PostgreSQL не пропускался незаметно
+func storeBackends() []storeBackend {
+	return []storeBackend{
+		{"sqlite", func(t *testing.T) database.Store {
+			dbPath := "test_store.db"
+			_ = os.Remove(dbPath)
+			db, err := database.InitDB(dbPath)
+			if err != nil {
+				t.Fatalf("Failed to init DB: %v", err)
+			}
+			t.Cleanup(func() {
+				db.Close()
+				_ = os.Remove(dbPath)
+			})
+			return database.NewSQLStore(db)
+		}},
+		{"memory", func(t *testing.T) database.Store {
+			return database.NewMemoryStore()
+		}},
+		{"postgres", func(t *testing.T) database.Store {
+			dsn := os.Getenv("TEST_POSTGRES_DSN")
+			if dsn == "" {
+				if os.Getenv("CI") != "" {
+					t.Fatal("TEST_POSTGRES_DSN must be set in CI")
+				}
+				t.Skip("TEST_POSTGRES_DSN is not set")
+			}
+			db, err := database.Open(dsn)
+			if err != nil {
+				t.Fatalf("Failed to connect to PostgreSQL: %v", err)
+			}
+			if _, err := db.Exec(`DROP SCHEMA public CASCADE; CREATE SCHEMA public`); err != nil {
+				t.Fatalf("Failed to reset schema: %v", err)
+			}
+			db.Close()
+			db, err = database.InitDB(dsn)
+			if err != nil {
+				t.Fatalf("Failed to init DB: %v", err)
+			}
+			t.Cleanup(func() { db.Close() })
+			return database.NewSQLStore(db)
+		}},
+	}
+}
+
+func TestStore(t *testing.T) {
+	checks := []struct {
+		name  string
+		check func(t *testing.T, s database.Store)
+	}{
+		{"Пользователи", checkStoreUsers},
+		{"Выражения и задачи", checkStoreExpressions},
+		{"Аренда задач", checkStoreTaskLeases},
+		{"Выборка выражений", checkStoreExpressionFilter},
+		{"Переменные", checkStoreVariables},
+		{"Токены агентов", checkStoreAgentTokens},
+		{"Сессии", checkStoreSessions},
+		{"API-ключи", checkStoreAPIKeys},
+		{"Блокировка входа", checkStoreLoginLock},
+		{"2FA", checkStoreTwoFactor},
+		{"Аудит", checkStoreAudit},
+	}
+	for _, backend := range storeBackends() {
+		t.Run(backend.name, func(t *testing.T) {
+			for _, c := range checks {
+				t.Run(c.name, func(t *testing.T) {
+					c.check(t, backend.open(t))
+				})
+			}
+		})
+	}
+}
+
+func addStoreUser(t *testing.T, s database.Store, login, password string) int {
+	t.Helper()
+	hash, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err := s.InsertUsers(context.TODO(), login, string(hash)); err != nil {
+		t.Fatalf("InsertUsers failed: %v", err)
+	}
+	return s.GetUserID(context.TODO(), login)
+}
+
+func checkStoreUsers(t *testing.T, s database.Store) {
+	ctx := context.TODO()
+	id := addStoreUser(t, s, "alice", "secret-password")
+	if id == 0 {
+		t.Fatal("Expected user id after insert")
+	}
+	if err := s.InsertUsers(ctx, "alice", "hash"); err == nil {
+		t.Error("Expected error for duplicate login")
+	}
+	if !s.IsAuth(ctx, "alice", "secret-password") || s.IsAuth(ctx, "alice", "wrong-password") || s.IsAuth(ctx, "bob", "secret-password") {
+		t.Error("IsAuth returned wrong result")
+	}
+	if s.GetUserID(ctx, "bob") != 0 {
+		t.Error("Expected zero id for unknown user")
+	}
+	if _, err := s.GetUserByLogin(ctx, "bob"); err == nil {
+		t.Error("Expected error for unknown login")
+	}
+
+	if ok, _ := s.SetUserRole(ctx, "alice", application.RoleAdmin); !ok {
+		t.Error("Expected SetUserRole to find user")
+	}
+	if ok, _ := s.SetUserRole(ctx, "bob", application.RoleAdmin); ok {
+		t.Error("Expected SetUserRole to miss unknown user")
+	}
+	disabled := true
+	if ok, _ := s.UpdateUser(ctx, id, nil, &disabled); !ok {
+		t.Error("Expected UpdateUser to find user")
+	}
+	user, err := s.GetUserByID(ctx, id)
+	if err != nil || user.Login != "alice" || user.Role != application.RoleAdmin || !user.Disabled {
+		t.Errorf("Unexpected user: %+v, %v", user, err)
+	}
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("new-password"), bcrypt.MinCost)
+	s.UpdatePassword(ctx, id, string(hash))
+	if !s.IsAuth(ctx, "alice", "new-password") {
+		t.Error("Expected new password to be accepted")
+	}
+
+	other := addStoreUser(t, s, "bob", "secret-password")
+	exprID, _ := s.AddExpression(ctx, id, "2+2")
+	s.AddExpression(ctx, other, "3+3")
+	ids, err := s.DeleteUser(ctx, id)
+	if err != nil || len(ids) != 1 || ids[0] != exprID {
+		t.Errorf("Expected deleted expression ids [%d], got %v, %v", exprID, ids, err)
+	}
+	if _, err := s.DeleteUser(ctx, id); err == nil {
+		t.Error("Expected error when deleting missing user")
+	}
+	users, _ := s.GetUsers(ctx)
+	if len(users) != 1 || users[0].Login != "bob" {
+		t.Errorf("Expected only bob to remain, got %+v", users)
+	}
+	expressions, _ := s.GetAllExpressions(ctx)
+	if len(expressions) != 1 || expressions[0].UserId != other {
+		t.Errorf("Expected only expressions of bob to remain, got %+v", expressions)
+	}
+}
+
+func checkStoreExpressions(t *testing.T, s database.Store) {
+	ctx := context.TODO()
+	id := addStoreUser(t, s, "alice", "secret-password")
+	other := addStoreUser(t, s, "bob", "secret-password")
+	done, _ := s.AddExpression(ctx, id, "2+2")
+	failed, _ := s.AddExpression(ctx, id, "1/0")
+	pending, _ := s.AddExpression(ctx, id, "2*3+1")
+	foreign, _ := s.AddExpression(ctx, other, "5")
+	s.AddAnswer(ctx, done, 4)
+	s.AddError(ctx, failed, "division by zero")
+	s.AddAnswer(ctx, foreign, 5)
+	s.SaveExpressionState(ctx, pending, "in_progress", `{"op":"+"}`)
+
+	expressions, _ := s.GetExpressions(ctx, id, database.ExpressionFilter{})
+	if len(expressions) != 3 || expressions[0].Id != done || expressions[0].Result == nil || *expressions[0].Result != 4 ||
+		expressions[1].Error != "division by zero" || expressions[2].Status != "in_progress" || expressions[2].Expression != "2*3+1" {
+		t.Errorf("Unexpected expressions: %+v", expressions)
+	}
+	if expr, err := s.GetExpressionByID(ctx, id, done); err != nil || expr.Status != "completed" || expr.Result == nil || *expr.Result != 4 ||
+		expr.CreatedAt == nil || expr.StartedAt == nil || expr.CompletedAt == nil {
+		t.Errorf("Unexpected expression: %+v, %v", expr, err)
+	}
+	if expr, err := s.GetExpressionByID(ctx, id, pending); err != nil || expr.Result != nil || expr.StartedAt == nil || expr.CompletedAt != nil {
+		t.Errorf("Unexpected unfinished expression: %+v, %v", expr, err)
+	}
+	if _, err := s.GetExpressionByID(ctx, id, foreign); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected sql.ErrNoRows for expression of another user, got %v", err)
+	}
+	unfinished, _ := s.GetUnfinishedExpressions(ctx)
+	if len(unfinished) != 1 || unfinished[0].Id != pending || unfinished[0].AST != `{"op":"+"}` {
+		t.Errorf("Unexpected unfinished expressions: %+v", unfinished)
+	}
+
+	first, _ := s.AddTask(ctx, database.TaskRecord{ExpressionId: pending, Arg1: 2, Arg2: 3, Operation: "*", OperationTime: 10, NodePath: "L"})
+	s.AddTask(ctx, database.TaskRecord{ExpressionId: pending, Args: []float64{1, 2, 3}, Operation: "+", NodePath: "R"})
+	tasks, _ := s.GetTasks(ctx)
+	if len(tasks) != 2 || tasks[0].Id != first || tasks[0].Arg2 != 3 || tasks[0].NodePath != "L" || len(tasks[1].Args) != 3 {
+		t.Errorf("Unexpected tasks: %+v", tasks)
+	}
+	s.DeleteTask(ctx, first)
+	if tasks, _ := s.GetTasks(ctx); len(tasks) != 1 {
+		t.Errorf("Expected one task after delete, got %+v", tasks)
+	}
+	s.DeleteExpressionTasks(ctx, pending)
+	if tasks, _ := s.GetTasks(ctx); len(tasks) != 0 {
+		t.Errorf("Expected no tasks, got %+v", tasks)
+	}
+
+}
+
+func checkStoreTaskLeases(t *testing.T, s database.Store) {
+	ctx := context.TODO()
+	id := addStoreUser(t, s, "alice", "secret-password")
+	expr, _ := s.AddExpression(ctx, id, "2*3+1")
+	s.SaveExpressionState(ctx, expr, "pending", `{"op":"+"}`)
+	err := s.UpdateExpression(ctx, expr, func(state database.ExpressionState, tasks []database.TaskRecord) (database.ExpressionUpdate, error) {
+		if state.Status != "pending" || state.AST != `{"op":"+"}` || len(tasks) != 0 {
+			t.Errorf("Unexpected expression state: %+v, %+v", state, tasks)
+		}
+		return database.ExpressionUpdate{Status: "pending", AST: `{"op":"*"}`, AddTasks: []database.TaskRecord{
+			{Arg1: 2, Arg2: 3, Operation: "*", OperationTime: 10, NodePath: "0"},
+			{Args: []float64{1, 2}, Operation: "max", OperationTime: 10, NodePath: "1"},
+		}}, nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateExpression failed: %v", err)
+	}
+
+	now := time.Now()
+	leased, _ := s.LeaseTasks(ctx, "adder", []string{"+", "max"}, 5, now)
+	if len(leased) != 1 || leased[0].Operation != "max" || leased[0].AgentId != "adder" || leased[0].ExpressionId != expr ||
+		leased[0].LeaseDeadline.UnixMilli() != now.UnixMilli()+10 || len(leased[0].Args) != 2 {
+		t.Fatalf("Unexpected leased tasks: %+v", leased)
+	}
+	if e, _ := s.GetExpressionByID(ctx, id, expr); e.Status != "in_progress" || e.StartedAt == nil {
+		t.Errorf("Expected leased expression to be in_progress, got %+v", e)
+	}
+	expired, _ := s.LeaseTasks(ctx, "any", nil, 5, now.Add(-time.Hour))
+	if len(expired) != 1 || expired[0].Operation != "*" {
+		t.Fatalf("Expected the remaining task, got %+v", expired)
+	}
+	if more, _ := s.LeaseTasks(ctx, "any", nil, 5, now); len(more) != 0 {
+		t.Errorf("Expected leased tasks to be hidden, got %+v", more)
+	}
+
+	if ids, _ := s.RequeueExpiredTasks(ctx, now); len(ids) != 1 || ids[0] != expired[0].Id {
+		t.Errorf("Expected task %d to be requeued, got %v", expired[0].Id, ids)
+	}
+	if task, err := s.GetTask(ctx, expired[0].Id); err != nil || !task.LeaseDeadline.IsZero() || task.AgentId != "any" {
+		t.Errorf("Expected requeued task to keep its agent, got %+v, %v", task, err)
+	}
+	if requeued, _ := s.RequeueAgentTasks(ctx, "adder"); requeued != 1 {
+		t.Errorf("Expected one task of agent adder to be requeued, got %d", requeued)
+	}
+
+	rejected := errors.New("rejected")
+	err = s.UpdateExpression(ctx, expr, func(state database.ExpressionState, tasks []database.TaskRecord) (database.ExpressionUpdate, error) {
+		return database.ExpressionUpdate{Status: "completed", Result: 7}, rejected
+	})
+	if !errors.Is(err, rejected) {
+		t.Errorf("Expected the update error, got %v", err)
+	}
+	if tasks, _ := s.GetTasks(ctx); len(tasks) != 2 {
+		t.Errorf("Expected rejected update to keep the tasks, got %+v", tasks)
+	}
+	s.UpdateExpression(ctx, expr, func(state database.ExpressionState, tasks []database.TaskRecord) (database.ExpressionUpdate, error) {
+		return database.ExpressionUpdate{Status: "completed", Result: 7}, nil
+	})
+	if e, _ := s.GetExpressionByID(ctx, id, expr); e.Status != "completed" || e.Result == nil || *e.Result != 7 || e.CompletedAt == nil {
+		t.Errorf("Expected completed expression, got %+v", e)
+	}
+	if tasks, _ := s.GetTasks(ctx); len(tasks) != 0 {
+		t.Errorf("Expected tasks of completed expression to be deleted, got %+v", tasks)
+	}
+	if _, err := s.GetTask(ctx, expired[0].Id); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected sql.ErrNoRows for deleted task, got %v", err)
+	}
+	noop := func(database.ExpressionState, []database.TaskRecord) (database.ExpressionUpdate, error) {
+		return database.ExpressionUpdate{}, nil
+	}
+	if err := s.UpdateExpression(ctx, expr+100, noop); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected sql.ErrNoRows for unknown expression, got %v", err)
+	}
+}
+
+func checkStoreExpressionFilter(t *testing.T, s database.Store) {
+	ctx := context.TODO()
+	id := addStoreUser(t, s, "alice", "secret-password")
+	other := addStoreUser(t, s, "bob", "secret-password")
+	var ids []int
+	for _, text := range []string{"1+1", "rate*2", "RATE_X+3", "100%3", "2*2"} {
+		exprID, _ := s.AddExpression(ctx, id, text)
+		ids = append(ids, exprID)
+	}
+	s.AddExpression(ctx, other, "rate*5")
+	s.AddAnswer(ctx, ids[0], 2)
+	s.AddError(ctx, ids[1], "unknown variable rate")
+
+	exprIDs := func(expressions []database.Expression) []int {
+		var answ []int
+		for _, expr := range expressions {
+			answ = append(answ, expr.Id)
+		}
+		return answ
+	}
+	if got, _ := s.GetExpressions(ctx, id, database.ExpressionFilter{Statuses: []string{"completed", "failed"}}); fmt.Sprint(exprIDs(got)) != fmt.Sprint(ids[:2]) {
+		t.Errorf("Unexpected expressions by status: %+v", got)
+	}
+	if got, _ := s.GetExpressions(ctx, id, database.ExpressionFilter{Search: "rate"}); fmt.Sprint(exprIDs(got)) != fmt.Sprint(ids[1:3]) {
+		t.Errorf("Expected case-insensitive search, got %+v", got)
+	}
+	if got, _ := s.GetExpressions(ctx, id, database.ExpressionFilter{Search: "_"}); fmt.Sprint(exprIDs(got)) != fmt.Sprint(ids[2:3]) {
+		t.Errorf("Expected LIKE wildcards to be matched literally, got %+v", got)
+	}
+	if got, _ := s.GetExpressions(ctx, id, database.ExpressionFilter{From: time.Now().Add(time.Hour)}); len(got) != 0 {
+		t.Errorf("Expected no expressions created in the future, got %+v", got)
+	}
+	if got, _ := s.GetExpressions(ctx, id, database.ExpressionFilter{From: time.Now().Add(-time.Hour), To: time.Now().Add(time.Hour)}); len(got) != len(ids) {
+		t.Errorf("Expected all expressions in range, got %+v", got)
+	}
+
+	// одинаковое время создания: порядок внутри секунды задаёт id
+	filter := database.ExpressionFilter{SortBy: database.SortByCreatedAt, Desc: true, Limit: 2}
+	var pages []int
+	for range ids {
+		page, err := s.GetExpressions(ctx, id, filter)
+		if err != nil || len(page) == 0 {
+			break
+		}
+		pages = append(pages, exprIDs(page)...)
+		cursor := filter.CursorOf(page[len(page)-1])
+		filter.After = &cursor
+	}
+	if fmt.Sprint(pages) != fmt.Sprint([]int{ids[4], ids[3], ids[2], ids[1], ids[0]}) {
+		t.Errorf("Expected pages in descending order without gaps, got %v", pages)
+	}
+	filter = database.ExpressionFilter{SortBy: database.SortByID, After: &database.ExpressionCursor{Key: int64(ids[2]), Id: ids[2]}}
+	if got, _ := s.GetExpressions(ctx, id, filter); fmt.Sprint(exprIDs(got)) != fmt.Sprint(ids[3:]) {
+		t.Errorf("Unexpected expressions after cursor: %+v", got)
+	}
+}
+
+func checkStoreVariables(t *testing.T, s database.Store) {
+	ctx := context.TODO()
+	id := addStoreUser(t, s, "alice", "secret-password")
+	other := addStoreUser(t, s, "bob", "secret-password")
+	s.SetVariable(ctx, id, "x", 1)
+	s.SetVariable(ctx, id, "x", 2)
+	s.SetVariable(ctx, other, "y", 3)
+	variables, _ := s.GetVariables(ctx, id)
+	if len(variables) != 1 || variables["x"] != 2 {
+		t.Errorf("Unexpected variables: %v", variables)
+	}
+	if ok, _ := s.DeleteVariable(ctx, id, "x"); !ok {
+		t.Error("Expected variable to be deleted")
+	}
+	if ok, _ := s.DeleteVariable(ctx, id, "x"); ok {
+		t.Error("Expected missing variable not to be deleted")
+	}
+}
+
+func checkStoreAgentTokens(t *testing.T, s database.Store) {
+	ctx := context.TODO()
+	s.SetAgentToken(ctx, "agent-1", "old")
+	s.SetAgentToken(ctx, "agent-1", "new")
+	s.SetAgentToken(ctx, "agent-2", "other")
+	if _, err := s.GetAgentByToken(ctx, "old"); err == nil {
+		t.Error("Expected replaced token to be rejected")
+	}
+	if agent, err := s.GetAgentByToken(ctx, "new"); err != nil || agent != "agent-1" {
+		t.Errorf("Expected agent-1, got %q, %v", agent, err)
+	}
+	tokens, _ := s.GetAgentTokens(ctx)
+	if len(tokens) != 2 || tokens[0].AgentId != "agent-1" || tokens[0].CreatedAt.IsZero() {
+		t.Errorf("Unexpected agent tokens: %+v", tokens)
+	}
+	if ok, _ := s.DeleteAgentToken(ctx, "agent-1"); !ok {
+		t.Error("Expected token to be deleted")
+	}
+	if ok, _ := s.DeleteAgentToken(ctx, "agent-1"); ok {
+		t.Error("Expected missing token not to be deleted")
+	}
+}
+
+func checkStoreSessions(t *testing.T, s database.Store) {
+	ctx := context.TODO()
+	now := time.Now()
+	id := addStoreUser(t, s, "alice", "secret-password")
+	s.CreateSession(ctx, "s1", id, now.Add(time.Hour))
+	s.AddRefreshToken(ctx, "r1", "s1", now.Add(time.Hour))
+
+	if session, err := s.UseRefreshToken(ctx, "r1", now); err != nil || session.Id != "s1" || session.Login != "alice" {
+		t.Errorf("Unexpected session: %+v, %v", session, err)
+	}
+	if sessionID, _ := s.GetSessionByRefreshToken(ctx, "r1"); sessionID != "s1" {
+		t.Errorf("Expected session s1, got %q", sessionID)
+	}
+	if _, err := s.UseRefreshToken(ctx, "missing", now); !errors.Is(err, database.ErrRefreshTokenInvalid) {
+		t.Errorf("Expected invalid refresh token, got %v", err)
+	}
+	if _, err := s.UseRefreshToken(ctx, "r1", now); !errors.Is(err, database.ErrRefreshTokenReused) {
+		t.Errorf("Expected reused refresh token, got %v", err)
+	}
+	if revoked, _ := s.IsTokenRevoked(ctx, "jti", "s1"); !revoked {
+		t.Error("Expected session to be revoked after reuse")
+	}
+
+	s.CreateSession(ctx, "s2", id, now.Add(time.Hour))
+	s.AddRefreshToken(ctx, "r2", "s2", now.Add(time.Hour))
+	if _, err := s.UseRefreshToken(ctx, "r2", now.Add(2*time.Hour)); !errors.Is(err, database.ErrRefreshTokenInvalid) {
+		t.Errorf("Expected expired refresh token to be invalid, got %v", err)
+	}
+	s.RevokeToken(ctx, "jti", now.Add(time.Minute))
+	if revoked, _ := s.IsTokenRevoked(ctx, "jti", "s2"); !revoked {
+		t.Error("Expected jti to be revoked")
+	}
+	s.RevokeUserSessions(ctx, id, now)
+	if revoked, _ := s.IsTokenRevoked(ctx, "other", "s2"); !revoked {
+		t.Error("Expected all user sessions to be revoked")
+	}
+
+	s.CreateSession(ctx, "s3", id, now.Add(3*time.Hour))
+	s.PurgeExpiredTokens(ctx, now.Add(2*time.Hour))
+	if revoked, _ := s.IsTokenRevoked(ctx, "jti", "s3"); revoked {
+		t.Error("Expected expired revoked jti to be purged")
+	}
+	if _, err := s.GetSessionByRefreshToken(ctx, "r2"); err == nil {
+		t.Error("Expected refresh tokens of expired session to be purged")
+	}
+	if revoked, _ := s.IsTokenRevoked(ctx, "other", "s2"); !revoked {
+		t.Error("Expected tokens of purged session to stay revoked")
+	}
+	if revoked, _ := s.IsTokenRevoked(ctx, "other", ""); !revoked {
+		t.Error("Expected token without session to be revoked")
+	}
+}
+
+func checkStoreAPIKeys(t *testing.T, s database.Store) {
+	ctx := context.TODO()
+	id := addStoreUser(t, s, "alice", "secret-password")
+	key, err := s.AddAPIKey(ctx, id, "ci", "read", "hash")
+	if err != nil || key.Id == 0 || key.CreatedAt.IsZero() {
+		t.Fatalf("Unexpected key: %+v, %v", key, err)
+	}
+	used, err := s.UseAPIKey(ctx, "hash")
+	if err != nil || used.Id != key.Id || used.Login != "alice" || used.Scope != "read" {
+		t.Errorf("Unexpected used key: %+v, %v", used, err)
+	}
+	keys, _ := s.GetAPIKeys(ctx, id)
+	if len(keys) != 1 || keys[0].LastUsedAt == nil {
+		t.Errorf("Expected last use to be recorded, got %+v", keys)
+	}
+	if ok, _ := s.DeleteAPIKey(ctx, id+1, key.Id); ok {
+		t.Error("Expected key of another user not to be deleted")
+	}
+	disabled := true
+	s.UpdateUser(ctx, id, nil, &disabled)
+	if _, err := s.UseAPIKey(ctx, "hash"); err == nil {
+		t.Error("Expected key of disabled user to be rejected")
+	}
+	if ok, _ := s.DeleteAPIKey(ctx, id, key.Id); !ok {
+		t.Error("Expected key to be deleted")
+	}
+	if keys, _ := s.GetAPIKeys(ctx, id); len(keys) != 0 {
+		t.Errorf("Expected no keys, got %+v", keys)
+	}
+}
+
+func checkStoreLoginLock(t *testing.T, s database.Store) {
+	ctx := context.TODO()
+	now := time.Now()
+	windowStart := now.Add(-time.Minute)
+	for i := 1; i <= 3; i++ {
+		if failures, _ := s.RecordLoginFailure(ctx, "login:alice", now, windowStart); failures != i {
+			t.Errorf("Expected %d failures, got %d", i, failures)
+		}
+	}
+	if failures, _ := s.RecordLoginFailure(ctx, "login:alice", now.Add(2*time.Minute), now.Add(time.Minute)); failures != 1 {
+		t.Errorf("Expected counter to restart after window, got %d", failures)
+	}
+	s.SetLoginLock(ctx, "login:alice", now.Add(time.Hour))
+	if until, _ := s.GetLoginLock(ctx, []string{"ip:127.0.0.1", "login:alice"}); until.Unix() != now.Add(time.Hour).Unix() {
+		t.Errorf("Unexpected lock: %v", until)
+	}
+	if ok, _ := s.ResetLoginAttempts(ctx, "login:alice"); !ok {
+		t.Error("Expected attempts to be reset")
+	}
+	if until, _ := s.GetLoginLock(ctx, []string{"login:alice"}); until.After(now) {
+		t.Errorf("Expected no lock after reset, got %v", until)
+	}
+}
+
+func checkStoreTwoFactor(t *testing.T, s database.Store) {
+	ctx := context.TODO()
+	now := time.Now()
+	id := addStoreUser(t, s, "alice", "secret-password")
+	s.SetTOTPSecret(ctx, id, "secret")
+	if secret, enabled, _ := s.GetTOTPSecret(ctx, id); secret != "secret" || enabled {
+		t.Errorf("Unexpected TOTP state: %q, %v", secret, enabled)
+	}
+	s.EnableTOTP(ctx, id, 10, []string{"c1", "c2"})
+	if user, _ := s.GetUserByID(ctx, id); !user.TOTPEnabled {
+		t.Error("Expected 2FA to be enabled")
+	}
+	if ok, _ := s.UseTOTPStep(ctx, id, 10); ok {
+		t.Error("Expected used step to be rejected")
+	}
+	if ok, _ := s.UseTOTPStep(ctx, id, 11); !ok {
+		t.Error("Expected next step to be accepted")
+	}
+	if ok, _ := s.UseRecoveryCode(ctx, id, "c1"); !ok {
+		t.Error("Expected recovery code to be accepted")
+	}
+	if ok, _ := s.UseRecoveryCode(ctx, id, "c1"); ok {
+		t.Error("Expected recovery code to be single-use")
+	}
+
+	s.CreateLoginChallenge(ctx, "ch", id, now.Add(time.Minute))
+	if user, err := s.GetLoginChallenge(ctx, "ch", now); err != nil || user.Id != id {
+		t.Errorf("Unexpected challenge user: %+v, %v", user, err)
+	}
+	if _, err := s.GetLoginChallenge(ctx, "ch", now.Add(time.Hour)); err == nil {
+		t.Error("Expected expired challenge to be rejected")
+	}
+	s.DeleteLoginChallenge(ctx, "ch")
+	if _, err := s.GetLoginChallenge(ctx, "ch", now); err == nil {
+		t.Error("Expected deleted challenge to be rejected")
+	}
+
+	s.DisableTOTP(ctx, id)
+	if secret, enabled, _ := s.GetTOTPSecret(ctx, id); secret != "" || enabled {
+		t.Errorf("Expected 2FA to be disabled, got %q, %v", secret, enabled)
+	}
+	if ok, _ := s.UseRecoveryCode(ctx, id, "c2"); ok {
+		t.Error("Expected recovery codes to be removed")
+	}
+}
+
+func checkStoreAudit(t *testing.T, s database.Store) {
+	ctx := context.TODO()
+	now := time.Now()
+	s.AddAuditEvent(ctx, database.AuditEvent{CreatedAt: now.Add(-time.Hour), Event: "login", Actor: "alice", ActorId: 1, Outcome: "failure"})
+	s.AddAuditEvent(ctx, database.AuditEvent{CreatedAt: now, Event: "login", Actor: "alice", ActorId: 1, IP: "10.0.0.1", Outcome: "success"})
+	s.AddAuditEvent(ctx, database.AuditEvent{CreatedAt: now, Event: "register", Actor: "bob", ActorId: 2, Outcome: "success"})
+
+	all, _ := s.GetAuditEvents(ctx, database.AuditFilter{Limit: 100})
+	if len(all) != 3 || all[0].Event != "register" || all[2].Outcome != "failure" {
+		t.Errorf("Expected events newest first, got %+v", all)
+	}
+	if events, _ := s.GetAuditEvents(ctx, database.AuditFilter{Event: "login", Outcome: "success", Limit: 100}); len(events) != 1 || events[0].IP != "10.0.0.1" {
+		t.Errorf("Unexpected filtered events: %+v", events)
+	}
+	if events, _ := s.GetAuditEvents(ctx, database.AuditFilter{ActorId: 1, From: now.Add(-time.Minute), Limit: 100}); len(events) != 1 {
+		t.Errorf("Unexpected events in range: %+v", events)
+	}
+	if events, _ := s.GetAuditEvents(ctx, database.AuditFilter{Limit: 2}); len(events) != 2 {
+		t.Errorf("Expected limit to be applied, got %+v", events)
+	}
+}
+
+func TestHandlersWithMemoryStore(t *testing.T) {
+	o := application.NewOrchestrator(application.ConfigFromEnv(), database.NewMemoryStore())
+	o.Config.TokenNotBefore = 0
+	access, _ := login(t, o, "alice", "secret-password")
+
+	w := bearerRequest(o, "POST", "/api/v1/calculate", access, `{"expression": "2+2"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	task := fetchTask(o)
+	if task == nil {
+		t.Fatal("Expected a task to be available")
+	}
+	if code := postTask(o, fmt.Sprintf(`{"id": "%s", "result": %v}`, task.ID, task.Arg1+task.Arg2)); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	w = bearerRequest(o, "GET", "/api/v1/expressions", access, "")
+	var resp struct {
+		Expressions []database.Expression `json:"expressions"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if w.Code != http.StatusOK || len(resp.Expressions) != 1 || resp.Expressions[0].Result == nil || *resp.Expressions[0].Result != 4 {
+		t.Errorf("Unexpected expressions: %d %+v", w.Code, resp.Expressions)
+	}
+}
+
+func TestExpressionsPagination(t *testing.T) {
+	o := application.NewOrchestrator(application.ConfigFromEnv(), database.NewMemoryStore())
+	o.Config.TokenNotBefore = 0
+	access, _ := login(t, o, "alice", "secret-password")
+	for i := 1; i <= 5; i++ {
+		if w := bearerRequest(o, "POST", "/api/v1/calculate", access, fmt.Sprintf(`{"expression": "%d+%d"}`, i, i)); w.Code != http.StatusCreated {
+			t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	var seen []string
+	url := "/api/v1/expressions?limit=2&sort=-id"
+	for page := 0; page < 5; page++ {
+		w := bearerRequest(o, "GET", url, access, "")
+		var resp struct {
+			Expressions []database.Expression `json:"expressions"`
+			NextCursor  string                `json:"next_cursor"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		for _, expr := range resp.Expressions {
+			seen = append(seen, expr.Expression)
+		}
+		if resp.NextCursor == "" {
+			break
+		}
+		url = "/api/v1/expressions?limit=2&sort=-id&cursor=" + resp.NextCursor
+	}
+	if fmt.Sprint(seen) != "[5+5 4+4 3+3 2+2 1+1]" {
+		t.Errorf("Unexpected pages: %v", seen)
+	}
+
+	w := bearerRequest(o, "GET", "/api/v1/expressions?q=3%2B&status=pending,in_progress", access, "")
+	var resp struct {
+		Expressions []database.Expression `json:"expressions"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if w.Code != http.StatusOK || len(resp.Expressions) != 1 || resp.Expressions[0].Expression != "3+3" {
+		t.Errorf("Unexpected filtered expressions: %d %+v", w.Code, resp.Expressions)
+	}
+
+	w = bearerRequest(o, "GET", "/api/v1/expressions?q=nothing", access, "")
+	if body := strings.TrimSpace(w.Body.String()); w.Code != http.StatusOK || body != `{"expressions":[]}` {
+		t.Errorf("Expected 200 with an empty list, got %d %s", w.Code, body)
+	}
+
+	for _, query := range []string{"limit=0", "limit=x", "status=done", "status=cancelled", "sort=result", "from=yesterday", "cursor=!!!"} {
+		if w := bearerRequest(o, "GET", "/api/v1/expressions?"+query, access, ""); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 for %s, got %d", query, w.Code)
+		}
+	}
+	w = bearerRequest(o, "GET", "/api/v1/expressions?limit=2", access, "")
+	var first struct {
+		NextCursor string `json:"next_cursor"`
+	}
+	json.NewDecoder(w.Body).Decode(&first)
+	if w := bearerRequest(o, "GET", "/api/v1/expressions?sort=created_at&cursor="+first.NextCursor, access, ""); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected cursor of another sort to be rejected, got %d", w.Code)
+	}
+}
@@ -0,0 +1,161 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+	"yandexlyceum/internal/application"
+	"yandexlyceum/internal/database"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestExpiredLeaseRequeuesTask(t *testing.T) {
+	dbPath := "test_lease.db"
+	_ = os.Remove(dbPath)
+
+	db, err := database.InitDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	defer func() {
+		db.Close()
+		_ = os.Remove(dbPath)
+	}()
+
+	o := application.NewOrchestrator(application.ConfigFromEnv(), database.NewSQLStore(db))
+	o.Config.TimeAddition = 1
+	o.Config.LeaseGrace = 1
+
+	req := httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "2+2"}`))
+	ctx := context.WithValue(req.Context(), application.UserContextKey, jwt.MapClaims{"user_id": float64(1)})
+	w := httptest.NewRecorder()
+	o.CalculateHandler(w, req.WithContext(ctx))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", w.Code)
+	}
+
+	getTask := func() string {
+		w := httptest.NewRecorder()
+		o.GetTaskHandler(w, httptest.NewRequest("GET", "/internal/task", nil))
+		if w.Code != http.StatusOK {
+			return ""
+		}
+		var resp struct {
+			Task application.Task `json:"task"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp.Task.ID
+	}
+
+	first := getTask()
+	if first == "" {
+		t.Fatal("Expected a task to be available")
+	}
+	if id := getTask(); id != "" {
+		t.Fatalf("Expected leased task to be hidden, got %s", id)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	o.RequeueExpiredTasks()
+
+	if id := getTask(); id != first {
+		t.Fatalf("Expected task %s to be requeued, got %q", first, id)
+	}
+
+	postResult := func() int {
+		w := httptest.NewRecorder()
+		body := bytes.NewBufferString(`{"id": "` + first + `", "result": 4}`)
+		o.PostTaskHandler(w, httptest.NewRequest("POST", "/internal/task", body))
+		return w.Code
+	}
+	if code := postResult(); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if code := postResult(); code != http.StatusNotFound {
+		t.Errorf("Expected duplicate result to be rejected with 404, got %d", code)
+	}
+}
+
+// TestSharedDatabaseLeases запускает два оркестратора на одном хранилище: агенты обоих разбирают
+// очередь одновременно, каждая задача выдаётся ровно одному из них, а результат принимает другой
+func TestSharedDatabaseLeases(t *testing.T) {
+	for _, backend := range storeBackends() {
+		t.Run(backend.name, func(t *testing.T) {
+			store := backend.open(t)
+			userID := addStoreUser(t, store, "alice", "secret")
+			orchestrators := []*application.Orchestrator{
+				application.NewOrchestrator(application.ConfigFromEnv(), store),
+				application.NewOrchestrator(application.ConfigFromEnv(), store),
+			}
+
+			body := bytes.NewBufferString(`{"expression": "(1+2)*(3+4)+(5+6)*(7+8)"}`)
+			w := httptest.NewRecorder()
+			orchestrators[0].CalculateHandler(w, withUser(httptest.NewRequest("POST", "/api/v1/calculate", body), userID))
+			if w.Code != http.StatusCreated {
+				t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+			}
+			var created map[string]string
+			json.NewDecoder(w.Body).Decode(&created)
+			exprID, _ := strconv.Atoi(created["id"])
+
+			type lease struct {
+				task  *application.Task
+				owner int
+			}
+			for round := 1; ; round++ {
+				var mu sync.Mutex
+				var wg sync.WaitGroup
+				var leases []lease
+				for i := 0; i < 8; i++ {
+					wg.Add(1)
+					go func(owner int) {
+						defer wg.Done()
+						if task := fetchTask(orchestrators[owner]); task != nil {
+							mu.Lock()
+							leases = append(leases, lease{task, owner})
+							mu.Unlock()
+						}
+					}(i % 2)
+				}
+				wg.Wait()
+				if len(leases) == 0 {
+					if round != 4 {
+						t.Fatalf("Expected the queue to drain after 3 rounds, drained after %d", round-1)
+					}
+					break
+				}
+				seen := make(map[string]bool)
+				for _, l := range leases {
+					if seen[l.task.ID] {
+						t.Fatalf("Task %s was leased twice", l.task.ID)
+					}
+					seen[l.task.ID] = true
+					var value float64
+					switch l.task.Operation {
+					case "+":
+						value = l.task.Arg1 + l.task.Arg2
+					case "*":
+						value = l.task.Arg1 * l.task.Arg2
+					}
+					other := orchestrators[1-l.owner]
+					if code := postTask(other, `{"id": "`+l.task.ID+`", "result": `+strconv.FormatFloat(value, 'f', -1, 64)+`}`); code != http.StatusOK {
+						t.Fatalf("Expected the other orchestrator to accept task %s, got %d", l.task.ID, code)
+					}
+				}
+			}
+
+			expr, err := store.GetExpressionByID(context.TODO(), userID, exprID)
+			if err != nil || expr.Status != "completed" || expr.Result == nil || *expr.Result != 186 {
+				t.Errorf("Expected completed expression with result 186, got %+v (%v)", expr, err)
+			}
+		})
+	}
+}
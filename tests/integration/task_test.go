@@ -0,0 +1,305 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+	"yandexlyceum/internal/application"
+	"yandexlyceum/internal/database"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func newTestOrchestrator(t *testing.T, dbPath string) *application.Orchestrator {
+	t.Helper()
+	_ = os.Remove(dbPath)
+	db, err := database.InitDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		_ = os.Remove(dbPath)
+	})
+	return application.NewOrchestrator(application.ConfigFromEnv(), database.NewSQLStore(db))
+}
+
+func withUser(r *http.Request, userID int) *http.Request {
+	ctx := context.WithValue(r.Context(), application.UserContextKey, jwt.MapClaims{"user_id": float64(userID)})
+	return r.WithContext(ctx)
+}
+
+func submitExpression(t *testing.T, o *application.Orchestrator, expression string) string {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"expression": expression})
+	w := httptest.NewRecorder()
+	o.CalculateHandler(w, withUser(httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewReader(body)), 1))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp map[string]string
+	json.NewDecoder(w.Body).Decode(&resp)
+	return resp["id"]
+}
+
+func fetchTask(o *application.Orchestrator) *application.Task {
+	w := httptest.NewRecorder()
+	o.GetTaskHandler(w, httptest.NewRequest("GET", "/internal/task", nil))
+	if w.Code != http.StatusOK {
+		return nil
+	}
+	var resp struct {
+		Task application.Task `json:"task"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	return &resp.Task
+}
+
+func postTask(o *application.Orchestrator, body string) int {
+	w := httptest.NewRecorder()
+	o.PostTaskHandler(w, httptest.NewRequest("POST", "/internal/task", bytes.NewBufferString(body)))
+	return w.Code
+}
+
+func TestTaskFailureFailsExpression(t *testing.T) {
+	o := newTestOrchestrator(t, "test_failure.db")
+
+	id := submitExpression(t, o, "1/0+(2*3)")
+
+	var division, multiplication *application.Task
+	for task := fetchTask(o); task != nil; task = fetchTask(o) {
+		switch task.Operation {
+		case "/":
+			division = task
+		case "*":
+			multiplication = task
+		}
+	}
+	if division == nil || multiplication == nil {
+		t.Fatal("Expected division and multiplication tasks")
+	}
+	failure := `{"id": "` + division.ID + `", "error": {"code": "division_by_zero", "message": "division by zero"}}`
+	if code := postTask(o, failure); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+
+	w := httptest.NewRecorder()
+	o.ExpressionByIDHandler(w, withUser(httptest.NewRequest("GET", "/api/v1/expressions/"+id, nil), 1))
+	var resp struct {
+		Expression database.Expression `json:"expression"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Expression.Status != "failed" || resp.Expression.Error != "division by zero" {
+		t.Errorf("Expected failed expression with error, got %+v", resp.Expression)
+	}
+	if code := postTask(o, `{"id": "`+multiplication.ID+`", "result": 6}`); code != http.StatusNotFound {
+		t.Errorf("Expected remaining tasks to be cancelled, got status %d", code)
+	}
+}
+
+func TestRestoreStateAfterRestart(t *testing.T) {
+	o := newTestOrchestrator(t, "test_restore.db")
+
+	id := submitExpression(t, o, "(1+2)*(3+4)")
+	first := fetchTask(o)
+	if first == nil {
+		t.Fatal("Expected a task to be available")
+	}
+	result := first.Arg1 + first.Arg2
+	if code := postTask(o, fmt.Sprintf(`{"id": "%s", "result": %v}`, first.ID, result)); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	leased := fetchTask(o)
+	if leased == nil {
+		t.Fatal("Expected a second task to be available")
+	}
+
+	restarted := application.NewOrchestrator(o.Config, o.Store)
+	if err := restarted.RestoreState(); err != nil {
+		t.Fatalf("RestoreState failed: %v", err)
+	}
+
+	// аренда хранится в базе и переживает перезапуск: задача остаётся за агентом, и его результат принимается
+	if task := fetchTask(restarted); task != nil {
+		t.Fatalf("Expected leased task to stay with its agent, got %+v", task)
+	}
+	if code := postTask(restarted, fmt.Sprintf(`{"id": "%s", "result": %v}`, leased.ID, leased.Arg1+leased.Arg2)); code != http.StatusOK {
+		t.Fatalf("Expected status 200 for the leased task, got %d", code)
+	}
+
+	for task := fetchTask(restarted); task != nil; task = fetchTask(restarted) {
+		var value float64
+		switch task.Operation {
+		case "+":
+			value = task.Arg1 + task.Arg2
+		case "*":
+			value = task.Arg1 * task.Arg2
+		}
+		if code := postTask(restarted, fmt.Sprintf(`{"id": "%s", "result": %v}`, task.ID, value)); code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	restarted.ExpressionByIDHandler(w, withUser(httptest.NewRequest("GET", "/api/v1/expressions/"+id, nil), 1))
+	var resp struct {
+		Expression database.Expression `json:"expression"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Expression.Status != "completed" || resp.Expression.Result == nil || *resp.Expression.Result != 21 {
+		t.Errorf("Expected completed expression with result 21, got %+v", resp.Expression)
+	}
+}
+
+// taskFailingStore не сохраняет задачи, как хранилище с недоступной таблицей tasks
+type taskFailingStore struct {
+	database.Store
+}
+
+func (s taskFailingStore) UpdateExpression(ctx context.Context, id int, update func(database.ExpressionState, []database.TaskRecord) (database.ExpressionUpdate, error)) error {
+	return s.Store.UpdateExpression(ctx, id, func(state database.ExpressionState, tasks []database.TaskRecord) (database.ExpressionUpdate, error) {
+		changes, err := update(state, tasks)
+		if err == nil && len(changes.AddTasks) > 0 {
+			err = errors.New("tasks table is unavailable")
+		}
+		return changes, err
+	})
+}
+
+func TestScheduleFailureFailsExpression(t *testing.T) {
+	o := newTestOrchestrator(t, "test_schedule_failure.db")
+	o.Store = taskFailingStore{o.Store}
+
+	body, _ := json.Marshal(map[string]string{"expression": "1+2"})
+	w := httptest.NewRecorder()
+	o.CalculateHandler(w, withUser(httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewReader(body)), 1))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected status 500, got %d: %s", w.Code, w.Body.String())
+	}
+
+	expr, err := o.Store.GetExpressionByID(context.Background(), 1, 1)
+	if err != nil {
+		t.Fatalf("GetExpressionByID failed: %v", err)
+	}
+	if expr.Status != "failed" {
+		t.Errorf("Expected expression without a saved task to fail, got %+v", expr)
+	}
+	if task := fetchTask(o); task != nil {
+		t.Errorf("Expected no task in the queue, got %+v", task)
+	}
+}
+
+func TestBatchFetchAndSubmit(t *testing.T) {
+	o := newTestOrchestrator(t, "test_batch.db")
+
+	submitExpression(t, o, "(1+2)*(3+4)-(5+6)")
+
+	w := httptest.NewRecorder()
+	o.GetTaskHandler(w, httptest.NewRequest("GET", "/internal/task?max=2", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	var resp struct {
+		Tasks []application.Task `json:"tasks"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if len(resp.Tasks) != 2 {
+		t.Fatalf("Expected 2 tasks, got %d", len(resp.Tasks))
+	}
+
+	results := make([]application.TaskResult, 0, len(resp.Tasks)+1)
+	for _, task := range resp.Tasks {
+		results = append(results, application.TaskResult{ID: task.ID, Result: task.Arg1 + task.Arg2})
+	}
+	results = append(results, application.TaskResult{ID: "unknown"})
+	body, _ := json.Marshal(map[string]interface{}{"results": results})
+	w = httptest.NewRecorder()
+	o.PostTaskHandler(w, httptest.NewRequest("POST", "/internal/task", bytes.NewReader(body)))
+	var statuses struct {
+		Results []map[string]string `json:"results"`
+	}
+	json.NewDecoder(w.Body).Decode(&statuses)
+	if len(statuses.Results) != 3 ||
+		statuses.Results[0]["status"] != "accepted" ||
+		statuses.Results[1]["status"] != "accepted" ||
+		statuses.Results[2]["status"] != "not_found" {
+		t.Fatalf("Unexpected batch statuses: %v", statuses.Results)
+	}
+
+	w = httptest.NewRecorder()
+	o.GetTaskHandler(w, httptest.NewRequest("GET", "/internal/task?max=10", nil))
+	json.NewDecoder(w.Body).Decode(&resp)
+	if len(resp.Tasks) != 2 {
+		t.Errorf("Expected the remaining 2 tasks, got %d", len(resp.Tasks))
+	}
+
+	w = httptest.NewRecorder()
+	o.GetTaskHandler(w, httptest.NewRequest("GET", "/internal/task?max=0", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid max, got %d", w.Code)
+	}
+}
+
+func TestOversizedBatchIsClamped(t *testing.T) {
+	o := newTestOrchestrator(t, "test_batch_limit.db")
+	o.Config.TaskBatchMax = 3
+
+	submitExpression(t, o, "(1+2)*(3+4)-(5+6)*(7+8)")
+
+	fetch := func(query string) int {
+		w := httptest.NewRecorder()
+		o.GetTaskHandler(w, httptest.NewRequest("GET", "/internal/task?"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s, got %d", query, w.Code)
+		}
+		var resp struct {
+			Tasks []application.Task `json:"tasks"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return len(resp.Tasks)
+	}
+
+	registerAgent(t, o, `{"id": "small", "computing_power": 1}`)
+	if n := fetch("max=2000000000&agent=small"); n != 1 {
+		t.Errorf("Expected agent to get at most its computing power, got %d tasks", n)
+	}
+	if n := fetch("max=2000000000"); n != 3 {
+		t.Errorf("Expected batch to be clamped to TASK_BATCH_MAX, got %d tasks", n)
+	}
+}
+
+func TestLongPollingWakesOnNewTask(t *testing.T) {
+	o := newTestOrchestrator(t, "test_long_poll.db")
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	o.GetTaskHandler(w, httptest.NewRequest("GET", "/internal/task?wait=50ms", nil))
+	if w.Code != http.StatusNotFound || time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("Expected 404 after waiting, got %d in %v", w.Code, time.Since(start))
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		o.GetTaskHandler(w, httptest.NewRequest("GET", "/internal/task?wait=5", nil))
+		done <- w
+	}()
+	time.Sleep(20 * time.Millisecond)
+	submitExpression(t, o, "2+2")
+
+	select {
+	case w := <-done:
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", w.Code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Waiting agent was not woken up by a new task")
+	}
+}
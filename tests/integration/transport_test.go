@@ -0,0 +1,184 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"yandexlyceum/internal/application"
+	"yandexlyceum/internal/database"
+	"yandexlyceum/internal/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func startServers(t *testing.T, o *application.Orchestrator) (string, string) {
+	t.Helper()
+	httpServer := httptest.NewServer(o.Routes())
+	t.Cleanup(httpServer.Close)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	grpcServer := application.NewGRPCServer(o)
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+	return httpServer.URL, lis.Addr().String()
+}
+
+func waitForExpression(t *testing.T, o *application.Orchestrator, id string) database.Expression {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		w := httptest.NewRecorder()
+		o.ExpressionByIDHandler(w, withUser(httptest.NewRequest("GET", "/api/v1/expressions/"+id, nil), 1))
+		var resp struct {
+			Expression database.Expression `json:"expression"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		if w.Code == http.StatusOK && (resp.Expression.Status == "completed" || resp.Expression.Status == "failed") {
+			return resp.Expression
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("Expression %s was not computed in time", id)
+	return database.Expression{}
+}
+
+func TestAgentTransports(t *testing.T) {
+	for _, transport := range []string{"http", "grpc", "grpc-stream"} {
+		t.Run(transport, func(t *testing.T) {
+			o := newTestOrchestrator(t, "test_transport_"+transport+".db")
+			o.Config.AgentSecret = "test-secret"
+			httpURL, grpcAddr := startServers(t, o)
+
+			agent := &application.Agent{
+				ComputingPower:  2,
+				OrchestratorURL: httpURL,
+				Transport:       transport,
+				GRPCAddr:        grpcAddr,
+				Token:           "test-secret",
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error)
+			go func() { done <- agent.RunContext(ctx) }()
+			defer func() {
+				cancel()
+				<-done
+			}()
+
+			id := submitExpression(t, o, "(1+2)*sqrt(16)-10/5")
+			if expr := waitForExpression(t, o, id); expr.Status != "completed" || expr.Result == nil || *expr.Result != 10 {
+				t.Errorf("Expected completed expression with result 10, got %+v", expr)
+			}
+
+			id = submitExpression(t, o, "1/0")
+			if expr := waitForExpression(t, o, id); expr.Status != "failed" {
+				t.Errorf("Expected failed expression, got %+v", expr)
+			}
+		})
+	}
+}
+
+func TestGRPCStream(t *testing.T) {
+	o := newTestOrchestrator(t, "test_stream.db")
+	o.Config.AgentSecret = "test-secret"
+	_, grpcAddr := startServers(t, o)
+
+	conn, err := grpc.NewClient(grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer test-secret")
+	stream, err := pb.NewTaskServiceClient(conn).Stream(ctx)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if err := stream.Send(&pb.AgentMessage{Payload: &pb.AgentMessage_Ready{Ready: 1}}); err != nil {
+		t.Fatalf("Failed to send ready: %v", err)
+	}
+
+	id := submitExpression(t, o, "2*21")
+
+	msg, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Failed to receive task: %v", err)
+	}
+	task := msg.GetTask()
+	if task == nil || task.GetOperation() != "*" {
+		t.Fatalf("Expected multiplication task, got %v", msg)
+	}
+	result := &pb.TaskResult{Id: task.GetId(), Result: task.GetArg1() * task.GetArg2()}
+	if err := stream.Send(&pb.AgentMessage{Payload: &pb.AgentMessage_Result{Result: result}}); err != nil {
+		t.Fatalf("Failed to send result: %v", err)
+	}
+	msg, err = stream.Recv()
+	if err != nil {
+		t.Fatalf("Failed to receive status: %v", err)
+	}
+	if status := msg.GetStatus(); status == nil || status.GetStatus() != "accepted" {
+		t.Fatalf("Expected accepted status, got %v", msg)
+	}
+	stream.CloseSend()
+
+	if expr := waitForExpression(t, o, id); expr.Result == nil || *expr.Result != 42 {
+		t.Errorf("Expected result 42, got %+v", expr)
+	}
+}
+
+func TestGRPCStreamLimits(t *testing.T) {
+	o := newTestOrchestrator(t, "test_stream_limits.db")
+	o.Config.AgentSecret = "test-secret"
+	_, grpcAddr := startServers(t, o)
+
+	conn, err := grpc.NewClient(grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer test-secret")
+	client := pb.NewTaskServiceClient(conn)
+
+	stream, err := client.Stream(ctx)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	stream.Send(&pb.AgentMessage{Payload: &pb.AgentMessage_Ready{Ready: -1}})
+	if _, err := stream.Recv(); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument for negative ready, got %v", err)
+	}
+
+	if _, err := client.Register(ctx, &pb.RegisterRequest{Id: "streamer", ComputingPower: 1}); err != nil {
+		t.Fatalf("Failed to register agent: %v", err)
+	}
+	stream, err = client.Stream(ctx)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	ready := &pb.AgentMessage{AgentId: "streamer", Payload: &pb.AgentMessage_Ready{Ready: math.MaxInt32}}
+	if err := stream.Send(ready); err != nil {
+		t.Fatalf("Failed to send ready: %v", err)
+	}
+	submitExpression(t, o, "(1+2)*(3+4)")
+	if msg, err := stream.Recv(); err != nil || msg.GetTask() == nil {
+		t.Fatalf("Expected a task, got %v, %v", msg, err)
+	}
+	// агент с мощностью 1 не получает вторую задачу, сколько бы воркеров он ни заявил
+	if task := fetchTask(o); task == nil {
+		t.Error("Expected the second task to stay in the queue")
+	}
+}
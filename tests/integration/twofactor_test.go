@@ -0,0 +1,146 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+	"yandexlyceum/internal/application"
+	"yandexlyceum/pkg/totp"
+)
+
+func loginChallenge(t *testing.T, o *application.Orchestrator, user, password string) string {
+	t.Helper()
+	w := postJSON(o, "/api/v1/login", `{"login": "`+user+`", "password": "`+password+`"}`)
+	var resp struct {
+		Required  bool   `json:"2fa_required"`
+		Challenge string `json:"challenge"`
+		Token     string `json:"token"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if w.Code != http.StatusOK || !resp.Required || resp.Challenge == "" || resp.Token != "" {
+		t.Fatalf("Expected 2FA challenge, got %d: %+v", w.Code, resp)
+	}
+	return resp.Challenge
+}
+
+// wrongCode возвращает код, не совпадающий с действительными в окне ±1 шаг
+func wrongCode(secret []byte, now time.Time) string {
+	valid := map[string]bool{}
+	for _, d := range []time.Duration{-totp.Period, 0, totp.Period} {
+		valid[totp.Code(secret, now.Add(d*time.Second))] = true
+	}
+	for _, code := range []string{"000000", "111111", "222222", "333333"} {
+		if !valid[code] {
+			return code
+		}
+	}
+	return "999999"
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	o := newTestOrchestrator(t, "test_2fa.db")
+	o.Config.TokenNotBefore = 0
+	now := time.Unix(1700000000, 0)
+	o.Now = func() time.Time { return now }
+	access, _ := login(t, o, "alice", "secret-password")
+
+	w := bearerRequest(o, "POST", "/api/v1/2fa/setup", access, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on setup, got %d: %s", w.Code, w.Body.String())
+	}
+	var setup struct {
+		Secret string `json:"secret"`
+		URI    string `json:"otpauth_uri"`
+	}
+	json.NewDecoder(w.Body).Decode(&setup)
+	secret, err := totp.DecodeSecret(setup.Secret)
+	if err != nil || setup.URI == "" {
+		t.Fatalf("Invalid setup response: %+v", setup)
+	}
+	if w := bearerRequest(o, "POST", "/api/v1/2fa/verify", access, `{"code": "`+wrongCode(secret, now)+`"}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for wrong code, got %d", w.Code)
+	}
+	w = bearerRequest(o, "POST", "/api/v1/2fa/verify", access, `{"code": "`+totp.Code(secret, now)+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on verify, got %d: %s", w.Code, w.Body.String())
+	}
+	var verify struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	json.NewDecoder(w.Body).Decode(&verify)
+	if len(verify.RecoveryCodes) != 10 {
+		t.Fatalf("Expected 10 recovery codes, got %v", verify.RecoveryCodes)
+	}
+
+	// код, которым подтверждалась настройка, повторно не принимается
+	challenge := loginChallenge(t, o, "alice", "secret-password")
+	if w := postJSON(o, "/api/v1/login/2fa", `{"challenge": "`+challenge+`", "code": "`+totp.Code(secret, now)+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for replayed code, got %d", w.Code)
+	}
+	now = now.Add(totp.Period * time.Second)
+	w = postJSON(o, "/api/v1/login/2fa", `{"challenge": "`+challenge+`", "code": "`+totp.Code(secret, now)+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on second step, got %d: %s", w.Code, w.Body.String())
+	}
+	var tokens struct {
+		Token string `json:"token"`
+	}
+	json.NewDecoder(w.Body).Decode(&tokens)
+	if code := authStatus(o, tokens.Token); code != http.StatusOK {
+		t.Errorf("Expected token from second step to work, got %d", code)
+	}
+	if w := postJSON(o, "/api/v1/login/2fa", `{"challenge": "`+challenge+`", "code": "`+totp.Code(secret, now)+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected used challenge to be rejected, got %d", w.Code)
+	}
+
+	// код восстановления одноразовый
+	recovery := verify.RecoveryCodes[0]
+	challenge = loginChallenge(t, o, "alice", "secret-password")
+	if w := postJSON(o, "/api/v1/login/2fa", `{"challenge": "`+challenge+`", "code": "`+recovery+`"}`); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 for recovery code, got %d", w.Code)
+	}
+	challenge = loginChallenge(t, o, "alice", "secret-password")
+	if w := postJSON(o, "/api/v1/login/2fa", `{"challenge": "`+challenge+`", "code": "`+recovery+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for used recovery code, got %d", w.Code)
+	}
+
+	// просроченный вызов
+	now = now.Add(10 * time.Minute)
+	if w := postJSON(o, "/api/v1/login/2fa", `{"challenge": "`+challenge+`", "code": "`+totp.Code(secret, now)+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for expired challenge, got %d", w.Code)
+	}
+
+	now = now.Add(totp.Period * time.Second)
+	if w := bearerRequest(o, "POST", "/api/v1/2fa/disable", tokens.Token, `{"code": "`+totp.Code(secret, now)+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on disable, got %d: %s", w.Code, w.Body.String())
+	}
+	if token, _ := login(t, o, "alice", "secret-password"); token == "" {
+		t.Error("Expected plain login after disabling 2FA")
+	}
+}
+
+func TestTwoFactorBruteForce(t *testing.T) {
+	o := newTestOrchestrator(t, "test_2fa_lockout.db")
+	o.Config.TokenNotBefore = 0
+	o.Config.LoginMaxFailures = 3
+	access, _ := login(t, o, "alice", "secret-password")
+	w := bearerRequest(o, "POST", "/api/v1/2fa/setup", access, "")
+	var setup struct {
+		Secret string `json:"secret"`
+	}
+	json.NewDecoder(w.Body).Decode(&setup)
+	secret, _ := totp.DecodeSecret(setup.Secret)
+	bearerRequest(o, "POST", "/api/v1/2fa/verify", access, `{"code": "`+totp.Code(secret, o.Now())+`"}`)
+
+	challenge := loginChallenge(t, o, "alice", "secret-password")
+	wrong := wrongCode(secret, o.Now())
+	for i := 0; i < 3; i++ {
+		if w := postJSON(o, "/api/v1/login/2fa", `{"challenge": "`+challenge+`", "code": "`+wrong+`"}`); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Attempt %d: expected 401, got %d", i+1, w.Code)
+		}
+	}
+	if w := postJSON(o, "/api/v1/login/2fa", `{"challenge": "`+challenge+`", "code": "`+wrong+`"}`); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 after repeated wrong codes, got %d", w.Code)
+	}
+}
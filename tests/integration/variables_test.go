@@ -0,0 +1,45 @@
+package tests
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestVariablesInCalculate(t *testing.T) {
+	o := newTestOrchestrator(t, "test_variables.db")
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("PUT", "/api/v1/variables/rate", bytes.NewBufferString(`{"value": 10}`))
+	o.VariableHandler(w, withUser(req, 1))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("PUT", "/api/v1/variables/"+url.PathEscape("ширина"), bytes.NewBufferString(`{"value": 3}`))
+	o.VariableHandler(w, withUser(req, 1))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422 for non-ASCII variable name, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	body := `{"expression": "rate * hours", "variables": {"hours": 4}}`
+	o.CalculateHandler(w, withUser(httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(body)), 1))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	task := fetchTask(o)
+	if task == nil || task.Arg1 != 10 || task.Arg2 != 4 {
+		t.Fatalf("Expected task 10 * 4, got %+v", task)
+	}
+
+	w = httptest.NewRecorder()
+	body = `{"expression": "rate * bonus"}`
+	o.CalculateHandler(w, withUser(httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(body)), 2))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422 for another user's variables, got %d", w.Code)
+	}
+}
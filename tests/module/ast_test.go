@@ -0,0 +1,96 @@
+package tests
+
+import (
+	"testing"
+	"yandexlyceum/internal/application"
+	"yandexlyceum/pkg/calculation"
+)
+
+func evaluate(t *testing.T, node *application.ASTNode) float64 {
+	t.Helper()
+	if node.IsLeaf {
+		return node.Value
+	}
+	if node.Function != "" {
+		args := make([]float64, 0, len(node.Args))
+		for _, arg := range node.Args {
+			args = append(args, evaluate(t, arg))
+		}
+		result, err := calculation.Call(node.Function, args)
+		if err != nil {
+			t.Fatalf("Call failed: %v", err)
+		}
+		return result
+	}
+	result, err := calculation.Compute(node.Operator, evaluate(t, node.Left), evaluate(t, node.Right))
+	if err != nil {
+		t.Fatalf("Compute failed: %v", err)
+	}
+	return result
+}
+
+func TestParseAST(t *testing.T) {
+	tests := []struct {
+		expression string
+		expected   float64
+		shouldErr  bool
+	}{
+		{"2+2*2", 6, false},
+		{"(2+2)*2", 8, false},
+		{"-5+3", -2, false},
+		{"2^3^2", 512, false},
+		{"-2^2", -4, false},
+		{"2^-1", 0.5, false},
+		{"-(2+3)", -5, false},
+		{"7%3*2", 2, false},
+		{"7//2+1", 4, false},
+		{"2*3^2", 18, false},
+		{"sqrt(16)*3", 12, false},
+		{"max(1, 2+3, 4)", 5, false},
+		{"min(7)", 7, false},
+		{"abs(-3)^2", 9, false},
+		{"-abs(sqrt(4)-5)", -3, false},
+		{"", 0, true},
+		{"foo(1)", 0, true},
+		{"sqrt(1,2)", 0, true},
+		{"max()", 0, true},
+		{"sqrt(4", 0, true},
+		{"2+", 0, true},
+		{"(2+2", 0, true},
+		{"2//", 0, true},
+	}
+	for _, tc := range tests {
+		ast, err := application.ParseAST(tc.expression)
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("Expected error for expression %q", tc.expression)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseAST(%q) returned error: %v", tc.expression, err)
+			continue
+		}
+		if result := evaluate(t, ast); result != tc.expected {
+			t.Errorf("ParseAST(%q) evaluates to %f; expected %f", tc.expression, result, tc.expected)
+		}
+	}
+}
+
+func TestResolveVariables(t *testing.T) {
+	ast, err := application.ParseAST("rate * hours + -bonus")
+	if err != nil {
+		t.Fatalf("ParseAST returned error: %v", err)
+	}
+	err = application.ResolveVariables(ast, map[string]float64{"rate": 10})
+	if err == nil || err.Error() != "undefined variables: bonus, hours" {
+		t.Fatalf("Expected undefined variables error, got %v", err)
+	}
+	err = application.ResolveVariables(ast, map[string]float64{"rate": 10, "hours": 4, "bonus": 5})
+	if err != nil {
+		t.Fatalf("ResolveVariables returned error: %v", err)
+	}
+	if result := evaluate(t, ast); result != 35 {
+		t.Errorf("Expected 35, got %f", result)
+	}
+}
@@ -17,7 +17,24 @@ func TestCompute(t *testing.T) {
 		{"*", 4, 3, 12, false},
 		{"/", 10, 2, 5, false},
 		{"/", 10, 0, 0, true},
-		{"^", 2, 3, 0, true},
+		{"^", 2, 3, 8, false},
+		{"^", 4, 0.5, 2, false},
+		{"^", -8, 1.0 / 3, 0, true},
+		{"^", 0, -1, 0, true},
+		{"^", 2, 10000, 0, true},
+		{"*", 1e308, 10, 0, true},
+		{"%", 7, 3, 1, false},
+		{"%", -7, 2, 1, false},
+		{"%", 7, -2, -1, false},
+		{"%", -7, -2, -1, false},
+		{"%", -6, 3, 0, false},
+		{"%", 7, 0, 0, true},
+		{"//", 7, 2, 3, false},
+		{"//", -7, 2, -4, false},
+		{"//", 7, -2, -4, false},
+		{"//", -7, -2, 3, false},
+		{"//", 7, 0, 0, true},
+		{"&", 2, 3, 0, true},
 	}
 	for _, tc := range tests {
 		result, err := calculation.Compute(tc.op, tc.a, tc.b)
@@ -29,3 +46,34 @@ func TestCompute(t *testing.T) {
 		}
 	}
 }
+
+func TestCall(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []float64
+		expected  float64
+		shouldErr bool
+	}{
+		{"sqrt", []float64{9}, 3, false},
+		{"sqrt", []float64{-1}, 0, true},
+		{"log", []float64{1}, 0, false},
+		{"log", []float64{0}, 0, true},
+		{"cos", []float64{0}, 1, false},
+		{"sin", []float64{0}, 0, false},
+		{"abs", []float64{-2}, 2, false},
+		{"min", []float64{3, 1, 2}, 1, false},
+		{"max", []float64{3, 1, 2}, 3, false},
+		{"max", nil, 0, true},
+		{"abs", []float64{1, 2}, 0, true},
+		{"tan", []float64{1}, 0, true},
+	}
+	for _, tc := range tests {
+		result, err := calculation.Call(tc.name, tc.args)
+		if tc.shouldErr && err == nil {
+			t.Errorf("Expected error for %s%v", tc.name, tc.args)
+		}
+		if !tc.shouldErr && result != tc.expected {
+			t.Errorf("Call(%s, %v) = %f; expected %f", tc.name, tc.args, result, tc.expected)
+		}
+	}
+}
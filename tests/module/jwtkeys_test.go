@@ -0,0 +1,30 @@
+package tests
+
+import (
+	"testing"
+	"yandexlyceum/internal/application"
+)
+
+func TestParseKeySet(t *testing.T) {
+	keys, err := application.ParseKeySet("old=secret1,\nnew = secret2\n# comment", "new")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if keys.ActiveID != "new" || len(keys.Keys) != 2 || string(keys.Keys["old"]) != "secret1" {
+		t.Errorf("Unexpected key set: %+v", keys)
+	}
+
+	keys, err = application.ParseKeySet("k1=a,k2=b", "")
+	if err != nil || keys.ActiveID != "k1" {
+		t.Errorf("Expected first key to be active, got %+v, %v", keys, err)
+	}
+
+	for _, spec := range []string{"", "k1", "k1=", "=secret"} {
+		if _, err := application.ParseKeySet(spec, ""); err == nil {
+			t.Errorf("Expected error for %q", spec)
+		}
+	}
+	if _, err := application.ParseKeySet("k1=a", "k2"); err == nil {
+		t.Error("Expected error for unknown active key")
+	}
+}
@@ -1,6 +1,8 @@
 package tests
 
 import (
+	"errors"
+	"strings"
 	"testing"
 	"yandexlyceum/internal/application"
 
@@ -13,8 +15,7 @@ func TestGeneratePassword(t *testing.T) {
 		password string
 	}{
 		{"Обычный пароль", "mySecurePassword123"},
-		{"Пустой пароль", ""},
-		{"Длинный пароль", "veryLongPassword" + string(make([]byte, 72))},
+		{"Ровно 72 байта", strings.Repeat("a", 72)},
 		{"Спецсимволы", "!@#$%^&*()"},
 		{"Юникод", "парольΔtest"},
 	}
@@ -37,3 +38,57 @@ func TestGeneratePassword(t *testing.T) {
 		})
 	}
 }
+
+func TestGeneratePasswordErrors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		password string
+		err      error
+	}{
+		{"Пустой пароль", "", application.ErrEmptyPassword},
+		{"Длинный пароль", "veryLongPassword" + string(make([]byte, 72)), application.ErrPasswordTooLong},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			hash, err := application.GeneratePassword(tc.password)
+			if !errors.Is(err, tc.err) || hash != "" {
+				t.Errorf("Ожидалась ошибка %v, получено %q, %v", tc.err, hash, err)
+			}
+		})
+	}
+}
+
+func TestCredentialsPolicy(t *testing.T) {
+	policy := application.CredentialsPolicy{LoginMinLength: 3, LoginMaxLength: 8, PasswordMinLength: 6, PasswordRequireMixed: true}
+
+	logins := map[string]bool{
+		"bob":        true,
+		"иван_1.x":   true,
+		"":           false,
+		"ab":         false,
+		"too-long-1": false,
+		"with space": false,
+		"a@b":        false,
+	}
+	for login, ok := range logins {
+		if err := policy.ValidateLogin(login); (err == nil) != ok {
+			t.Errorf("ValidateLogin(%q) = %v, ожидалось ok=%v", login, err, ok)
+		}
+	}
+
+	passwords := map[string]bool{
+		"abc123":                 true,
+		"пароль1":                true,
+		"":                       false,
+		"ab12":                   false,
+		"abcdefgh":               false,
+		"12345678":               false,
+		strings.Repeat("a1", 37): false,
+	}
+	for password, ok := range passwords {
+		if err := policy.ValidatePassword(password); (err == nil) != ok {
+			t.Errorf("ValidatePassword(%q) = %v, ожидалось ok=%v", password, err, ok)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"yandexlyceum/pkg/totp"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// тестовые векторы RFC 6238 для SHA1, последние 6 цифр
+	secret := []byte("12345678901234567890")
+	testCases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tc := range testCases {
+		if code := totp.Code(secret, time.Unix(tc.unix, 0)); code != tc.code {
+			t.Errorf("Code at %d = %s, want %s", tc.unix, code, tc.code)
+		}
+	}
+}
+
+func TestTOTPValidate(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	code := totp.Code(secret, now)
+
+	if step, ok := totp.Validate(secret, code, now.Add(totp.Period*time.Second), 1); !ok || step != totp.Step(now) {
+		t.Errorf("Expected code to be valid in the next interval, got %d, %v", step, ok)
+	}
+	if _, ok := totp.Validate(secret, code, now.Add(2*totp.Period*time.Second), 1); ok {
+		t.Error("Expected code to expire after skew")
+	}
+	if _, ok := totp.Validate(secret, "12345", now, 1); ok {
+		t.Error("Expected short code to be rejected")
+	}
+
+	encoded := totp.EncodeSecret(secret)
+	decoded, err := totp.DecodeSecret(strings.ToLower(encoded))
+	if err != nil || string(decoded) != string(secret) {
+		t.Errorf("Secret round trip failed: %q, %v", decoded, err)
+	}
+	uri := totp.URI("Calculator", "alice", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/Calculator:alice?") || !strings.Contains(uri, "secret="+encoded) {
+		t.Errorf("Unexpected URI %s", uri)
+	}
+}